@@ -0,0 +1,70 @@
+package nostr
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventBuilder builds and signs an Event step by step:
+//
+//	evt, err := NewBuilder().Kind(1).Content("hi").Tag("e", id).Tag("p", pubkey).CreatedNow().Sign(sk)
+//
+// Errors are reported by Sign, which is the last step.
+type EventBuilder struct {
+	event   Event
+	kindSet bool
+	err     error
+}
+
+func NewBuilder() *EventBuilder {
+	return &EventBuilder{}
+}
+
+func (b *EventBuilder) Kind(kind int) *EventBuilder {
+	b.event.Kind = kind
+	b.kindSet = true
+	return b
+}
+
+func (b *EventBuilder) Content(content string) *EventBuilder {
+	b.event.Content = content
+	return b
+}
+
+// Tag appends a tag made of a key and its values, e.g. Tag("e", id, relayURL).
+func (b *EventBuilder) Tag(key string, values ...string) *EventBuilder {
+	if key == "" && b.err == nil {
+		b.err = fmt.Errorf("tag %d has an empty key", len(b.event.Tags))
+	}
+	b.event.Tags = append(b.event.Tags, append(Tag{key}, values...))
+	return b
+}
+
+func (b *EventBuilder) CreatedAt(createdAt time.Time) *EventBuilder {
+	b.event.CreatedAt = createdAt
+	return b
+}
+
+// CreatedNow sets the creation time to Now(), which is also what Sign does if no time
+// was set.
+func (b *EventBuilder) CreatedNow() *EventBuilder {
+	return b.CreatedAt(Now())
+}
+
+// Sign returns the event signed with privateKey, see Event.Sign. It fails if the kind
+// was never set or a tag is invalid.
+func (b *EventBuilder) Sign(privateKey string) (Event, error) {
+	if b.err != nil {
+		return Event{}, b.err
+	}
+	if !b.kindSet {
+		return Event{}, fmt.Errorf("event kind is not set")
+	}
+
+	evt := b.event
+	evt.Tags = b.event.Tags.Clone()
+	if err := evt.Sign(privateKey); err != nil {
+		return Event{}, err
+	}
+	return evt, nil
+}
@@ -0,0 +1,45 @@
+package nostr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBuilder(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	id := "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+
+	evt, err := NewBuilder().Kind(1).Content("hi").Tag("e", id, "wss://x.com").Tag("p", pub).CreatedNow().Sign(priv)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if evt.Kind != 1 || evt.Content != "hi" || evt.PubKey != pub {
+		t.Errorf("built event %+v; want kind 1 with content \"hi\" by %s", evt, pub)
+	}
+	if len(evt.Tags) != 2 || evt.Tags[0].Relay() != "wss://x.com" || evt.Tags[1].Value() != pub {
+		t.Errorf("built event has tags %v", evt.Tags)
+	}
+	if time.Since(evt.CreatedAt) > time.Minute {
+		t.Errorf("built event was created at %v; want now", evt.CreatedAt)
+	}
+	if ok, err := evt.CheckSignature(); !ok || err != nil {
+		t.Errorf("signature check failed: ok=%t, err=%v", ok, err)
+	}
+
+	// metadata has kind 0, which must be accepted when set explicitly
+	if _, err := NewBuilder().Kind(0).Content("{}").Sign(priv); err != nil {
+		t.Errorf("Sign with kind 0: %v", err)
+	}
+
+	for name, b := range map[string]*EventBuilder{
+		"no kind":       NewBuilder().Content("hi"),
+		"empty tag key": NewBuilder().Kind(1).Tag("", "x"),
+	} {
+		if _, err := b.Sign(priv); err == nil {
+			t.Errorf("Sign with %s returned no error", name)
+		}
+	}
+	if _, err := NewBuilder().Kind(1).Sign("xyz"); err == nil {
+		t.Error("Sign with an invalid key returned no error")
+	}
+}
@@ -1,13 +1,18 @@
 package nostr
 
 import (
-	"github.com/gorilla/websocket"
 	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type Connection struct {
 	socket *websocket.Conn
 	mutex  sync.Mutex
+
+	// writeTimeout, if set, bounds every WriteJSON and WriteMessage
+	writeTimeout time.Duration
 }
 
 func NewConnection(socket *websocket.Conn) *Connection {
@@ -19,15 +24,31 @@ func NewConnection(socket *websocket.Conn) *Connection {
 func (c *Connection) WriteJSON(v interface{}) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	c.setWriteDeadline()
 	return c.socket.WriteJSON(v)
 }
 
 func (c *Connection) WriteMessage(messageType int, data []byte) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	c.setWriteDeadline()
 	return c.socket.WriteMessage(messageType, data)
 }
 
+// setWriteDeadline must be called with c.mutex held.
+func (c *Connection) setWriteDeadline() {
+	if c.writeTimeout > 0 {
+		c.socket.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+}
+
+// Ping sends a websocket ping control frame, giving up at deadline.
+func (c *Connection) Ping(deadline time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.socket.WriteControl(websocket.PingMessage, nil, deadline)
+}
+
 func (c *Connection) Close() error {
 	return c.socket.Close()
 }
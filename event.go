@@ -3,12 +3,17 @@ package nostr
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"time"
 )
 
+// Now is the time source for the created_at of new events, e.g. in Sign. Tests can replace
+// it to produce events, and thus ids and signatures, that don't depend on the current time.
+var Now = time.Now
+
 type Event struct {
 	ID        string
 	PubKey    string
@@ -36,8 +41,30 @@ const (
 	KindChannelMessage         int = 42
 	KindChannelHideMessage     int = 43
 	KindChannelMuteUser        int = 44
+	KindZapRequest             int = 9734
+	KindZap                    int = 9735
+	KindRelayList              int = 10002
+	KindClientAuthentication   int = 22242
 )
 
+// IsReplaceable tells whether events of kind are replaceable, i.e. relays only keep the
+// latest one for each pubkey (kinds 0, 3 and 10000-19999).
+func IsReplaceable(kind int) bool {
+	return kind == KindSetMetadata || kind == KindContactList || (kind >= 10000 && kind < 20000)
+}
+
+// IsEphemeral tells whether events of kind are ephemeral, i.e. not stored by relays
+// (kinds 20000-29999).
+func IsEphemeral(kind int) bool {
+	return kind >= 20000 && kind < 30000
+}
+
+// IsParameterizedReplaceable tells whether events of kind are parameterized replaceable, i.e.
+// relays only keep the latest one for each pubkey and "d" tag (kinds 30000-39999).
+func IsParameterizedReplaceable(kind int) bool {
+	return kind >= 30000 && kind < 40000
+}
+
 // GetID serializes and returns the event ID as a string
 func (evt *Event) GetID() string {
 	h := sha256.Sum256(evt.Serialize())
@@ -45,7 +72,8 @@ func (evt *Event) GetID() string {
 }
 
 // Serialize outputs a byte array that can be hashed/signed to identify/authenticate.
-// JSON encoding as defined in RFC4627.
+// JSON encoding as defined in RFC4627, in the canonical form of NIP-01: no whitespace, no
+// HTML escaping and only quotes, backslashes and control characters escaped in strings.
 func (evt *Event) Serialize() []byte {
 	// the serialization process is just putting everything into a JSON array
 	// so the order is kept. See NIP-01
@@ -72,45 +100,79 @@ func (evt *Event) Serialize() []byte {
 	return dst
 }
 
+// CheckID checks if the event id is the hash of its serialized content, as in NIP-01.
+func (evt *Event) CheckID() bool {
+	return evt.ID == evt.GetID()
+}
+
+// Errors wrapped by the errors of CheckSignature and Verify, telling why an event isn't
+// valid. A malformed pubkey or signature usually points at a buggy relay or client, while
+// an ErrBadSignature means the event was forged or changed after it was signed.
+var (
+	ErrInvalidPubKey    = errors.New("invalid pubkey")
+	ErrInvalidSignature = errors.New("invalid signature encoding")
+	ErrIDMismatch       = errors.New("id doesn't match the event")
+	ErrBadSignature     = errors.New("signature doesn't match the event")
+)
+
 // CheckSignature checks if the signature is valid for the id
 // (which is a hash of the serialized event content).
-// returns an error if the signature itself is invalid.
+// When it isn't, the error wraps ErrInvalidPubKey, ErrInvalidSignature or ErrBadSignature.
 func (evt Event) CheckSignature() (bool, error) {
 	// read and check pubkey
-	pk, err := hex.DecodeString(evt.PubKey)
+	pk, err := decodeHex("event pubkey", evt.PubKey, 32)
 	if err != nil {
-		return false, fmt.Errorf("event pubkey '%s' is invalid hex: %w", evt.PubKey, err)
+		return false, fmt.Errorf("%w: %v", ErrInvalidPubKey, err)
 	}
 
 	pubkey, err := schnorr.ParsePubKey(pk)
 	if err != nil {
-		return false, fmt.Errorf("event has invalid pubkey '%s': %w", evt.PubKey, err)
+		return false, fmt.Errorf("%w '%s': %v", ErrInvalidPubKey, evt.PubKey, err)
 	}
 
 	// read signature
-	s, err := hex.DecodeString(evt.Sig)
+	s, err := decodeHex("event signature", evt.Sig, 64)
 	if err != nil {
-		return false, fmt.Errorf("signature '%s' is invalid hex: %w", evt.Sig, err)
+		return false, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
 	}
 	sig, err := schnorr.ParseSignature(s)
 	if err != nil {
-		return false, fmt.Errorf("failed to parse signature: %w", err)
+		return false, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
 	}
 
 	// check signature
 	hash := sha256.Sum256(evt.Serialize())
-	return sig.Verify(hash[:], pubkey), nil
+	if !sig.Verify(hash[:], pubkey) {
+		return false, ErrBadSignature
+	}
+	return true, nil
 }
 
-// Sign signs an event with a given privateKey
-func (evt *Event) Sign(privateKey string) error {
-	h := sha256.Sum256(evt.Serialize())
+// Verify checks both the id and the signature of evt, returning nil if they are valid and
+// otherwise an error wrapping ErrIDMismatch or one of the errors of CheckSignature.
+func (evt *Event) Verify() error {
+	if id := evt.GetID(); id != evt.ID {
+		return fmt.Errorf("%w: it is %s", ErrIDMismatch, id)
+	}
+	_, err := evt.CheckSignature()
+	return err
+}
 
-	s, err := hex.DecodeString(privateKey)
+// Sign signs an event with a given privateKey.
+// It sets evt.PubKey to the public key of privateKey, evt.CreatedAt to Now() if it is zero,
+// then evt.ID and evt.Sig.
+func (evt *Event) Sign(privateKey string) error {
+	s, err := decodeHex("private key", privateKey, 32)
 	if err != nil {
-		return fmt.Errorf("Sign called with invalid private key '%s': %w", privateKey, err)
+		return fmt.Errorf("Sign called with an invalid key: %w", err)
 	}
-	sk, _ := btcec.PrivKeyFromBytes(s)
+	sk, pk := btcec.PrivKeyFromBytes(s)
+
+	evt.PubKey = hex.EncodeToString(schnorr.SerializePubKey(pk))
+	if evt.CreatedAt.IsZero() {
+		evt.CreatedAt = Now()
+	}
+	h := sha256.Sum256(evt.Serialize())
 
 	sig, err := schnorr.Sign(sk, h[:])
 	if err != nil {
@@ -121,3 +183,17 @@ func (evt *Event) Sign(privateKey string) error {
 	evt.Sig = hex.EncodeToString(sig.Serialize())
 	return nil
 }
+
+// Clone returns a copy of evt that can be changed, e.g. re-tagged and signed again, without
+// affecting evt. Tags are copied deeply, values set with SetExtra are not.
+func (evt *Event) Clone() *Event {
+	clone := *evt
+	clone.Tags = evt.Tags.Clone()
+	if evt.extra != nil {
+		clone.extra = make(map[string]any, len(evt.extra))
+		for k, v := range evt.extra {
+			clone.extra[k] = v
+		}
+	}
+	return &clone
+}
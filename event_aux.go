@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/valyala/fastjson"
+	"math"
 	"time"
 )
 
@@ -41,6 +42,12 @@ func (evt *Event) UnmarshalJSON(payload []byte) error {
 			evt.PubKey = string(id)
 		case "created_at":
 			val, err := v.Int64()
+			if err != nil {
+				// some relays send it as a float, which is fine as long as it is integral
+				if f, ferr := v.Float64(); ferr == nil && f == math.Trunc(f) {
+					val, err = int64(f), nil
+				}
+			}
 			if err != nil {
 				visiterr = fmt.Errorf("invalid 'created_at' field: %w", err)
 			}
@@ -2,19 +2,23 @@ package nostr
 
 import (
 	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestEventParsingAndVerifying(t *testing.T) {
-	rawEvents := []string{
-		`{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524"}`,
-		`{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524","extrakey":55}`,
-		`{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524","extrakey":"aaa"}`,
-		`{"id":"9e662bdd7d8abc40b5b15ee1ff5e9320efc87e9274d8d440c58e6eed2dddfbe2","pubkey":"373ebe3d45ec91977296a178d9f19f326c70631d2a1b0bbba5c5ecc2eb53b9e7","created_at":1644844224,"kind":3,"tags":[["p","3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"],["p","75fc5ac2487363293bd27fb0d14fb966477d0f1dbc6361d37806a6a740eda91e"],["p","46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"]],"content":"{\"wss://nostr-pub.wellorder.net\":{\"read\":true,\"write\":true},\"wss://nostr.bitcoiner.social\":{\"read\":false,\"write\":true},\"wss://expensive-relay.fiatjaf.com\":{\"read\":true,\"write\":true},\"wss://relayer.fiatjaf.com\":{\"read\":true,\"write\":true},\"wss://relay.bitid.nz\":{\"read\":true,\"write\":true},\"wss://nostr.rocks\":{\"read\":true,\"write\":true}}","sig":"811355d3484d375df47581cb5d66bed05002c2978894098304f20b595e571b7e01b2efd906c5650080ffe49cf1c62b36715698e9d88b9e8be43029a2f3fa66be"}`,
-	}
+// realEvents are events as published on relays, in the canonical form.
+var realEvents = []string{
+	`{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524"}`,
+	`{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524","extrakey":55}`,
+	`{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524","extrakey":"aaa"}`,
+	`{"id":"9e662bdd7d8abc40b5b15ee1ff5e9320efc87e9274d8d440c58e6eed2dddfbe2","pubkey":"373ebe3d45ec91977296a178d9f19f326c70631d2a1b0bbba5c5ecc2eb53b9e7","created_at":1644844224,"kind":3,"tags":[["p","3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"],["p","75fc5ac2487363293bd27fb0d14fb966477d0f1dbc6361d37806a6a740eda91e"],["p","46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"]],"content":"{\"wss://nostr-pub.wellorder.net\":{\"read\":true,\"write\":true},\"wss://nostr.bitcoiner.social\":{\"read\":false,\"write\":true},\"wss://expensive-relay.fiatjaf.com\":{\"read\":true,\"write\":true},\"wss://relayer.fiatjaf.com\":{\"read\":true,\"write\":true},\"wss://relay.bitid.nz\":{\"read\":true,\"write\":true},\"wss://nostr.rocks\":{\"read\":true,\"write\":true}}","sig":"811355d3484d375df47581cb5d66bed05002c2978894098304f20b595e571b7e01b2efd906c5650080ffe49cf1c62b36715698e9d88b9e8be43029a2f3fa66be"}`,
+}
 
-	for _, raw := range rawEvents {
+func TestEventParsingAndVerifying(t *testing.T) {
+	for _, raw := range realEvents {
 		var ev Event
 		err := json.Unmarshal([]byte(raw), &ev)
 		if err != nil {
@@ -88,6 +92,105 @@ func TestEventSerialization(t *testing.T) {
 	}
 }
 
+func TestEventCheckID(t *testing.T) {
+	raw := `{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524"}`
+	var ev Event
+	if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+		t.Fatalf("failed to parse event json: %v", err)
+	}
+	if !ev.CheckID() {
+		t.Error("id check failed when it should have succeeded")
+	}
+
+	// the signature covers the content, not the id, so it still checks out
+	ev.ID = "9e662bdd7d8abc40b5b15ee1ff5e9320efc87e9274d8d440c58e6eed2dddfbe2"
+	if ev.CheckID() {
+		t.Error("id check succeeded for an id that doesn't match the content")
+	}
+	if ok, _ := ev.CheckSignature(); !ok {
+		t.Error("signature verification failed when it should have succeeded")
+	}
+}
+
+// TestEventSerializationVectors checks the canonical NIP-01 serialization, which is what
+// JSON.stringify (used by nostr-tools and most other implementations) produces: no HTML
+// escaping, only quotes, backslashes and control characters escaped, everything else verbatim.
+func TestEventSerializationVectors(t *testing.T) {
+	pubkey := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	vectors := []struct {
+		name       string
+		event      Event
+		serialized string
+		id         string
+	}{
+		{
+			"html",
+			Event{PubKey: pubkey, CreatedAt: time.Unix(1644271588, 0), Kind: 1, Tags: Tags{}, Content: `<script>alert("hi") & 'bye'</script>`},
+			`[0,"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",1644271588,1,[],"<script>alert(\"hi\") & 'bye'</script>"]`,
+			"7824fb32fcc995f19b4c810a68930e44b5c80284f45dd3943bf23b97298d095f",
+		},
+		{
+			"control characters",
+			Event{PubKey: pubkey, CreatedAt: time.Unix(1644271588, 0), Kind: 1, Tags: Tags{}, Content: "a\nb\tc\rd\be\ff\x00g\x01h\x0bi\x1fj\x7fk\\l"},
+			`[0,"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",1644271588,1,[],"a\nb\tc\rd\be\ff\u0000g\u0001h\u000bi\u001fj` + "\x7f" + `k\\l"]`,
+			"f1ba56d241967a8c6c988704b92fe6ae7b418e453ad5ca72f1e3d440169d4f8d",
+		},
+		{
+			"unicode",
+			Event{PubKey: pubkey, CreatedAt: time.Unix(1644271588, 0), Kind: 1, Tags: Tags{}, Content: "café 🤙 \u2028\u2029 日本"},
+			`[0,"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",1644271588,1,[],"café 🤙 ` + "\u2028\u2029" + ` 日本"]`,
+			"b3ee9c3bd7ed5c7a51e97126e5fd625f5308adda4f3eec9e78875b8f1a1fdfd6",
+		},
+		{
+			"escaped tags",
+			Event{PubKey: pubkey, CreatedAt: time.Unix(1700000000, 0), Kind: 30023, Tags: Tags{
+				Tag{"d", `a"b\c`},
+				Tag{"t", "<&>"},
+				Tag{"e", "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962", "wss://x.com/?a=1&b=2"},
+			}, Content: `{"k":"v"}`},
+			`[0,"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",1700000000,30023,[["d","a\"b\\c"],["t","<&>"],["e","dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","wss://x.com/?a=1&b=2"]],"{\"k\":\"v\"}"]`,
+			"161128584a42add69957ae42084cf896ff664b6968131d03b6dfc35ae4b7d25c",
+		},
+	}
+
+	for _, v := range vectors {
+		if got := string(v.event.Serialize()); got != v.serialized {
+			t.Errorf("%s: serialized as\n%s\nwant\n%s", v.name, got, v.serialized)
+		}
+		if got := v.event.GetID(); got != v.id {
+			t.Errorf("%s: id is %s; want %s", v.name, got, v.id)
+		}
+	}
+}
+
+func TestKindRanges(t *testing.T) {
+	for _, tc := range []struct {
+		kind                                             int
+		replaceable, ephemeral, parameterizedReplaceable bool
+	}{
+		{KindSetMetadata, true, false, false},
+		{KindTextNote, false, false, false},
+		{KindContactList, true, false, false},
+		{KindReaction, false, false, false},
+		{10002, true, false, false},
+		{19999, true, false, false},
+		{20000, false, true, false},
+		{KindClientAuthentication, false, true, false},
+		{30023, false, false, true},
+		{40000, false, false, false},
+	} {
+		if IsReplaceable(tc.kind) != tc.replaceable {
+			t.Errorf("IsReplaceable(%d) = %v", tc.kind, !tc.replaceable)
+		}
+		if IsEphemeral(tc.kind) != tc.ephemeral {
+			t.Errorf("IsEphemeral(%d) = %v", tc.kind, !tc.ephemeral)
+		}
+		if IsParameterizedReplaceable(tc.kind) != tc.parameterizedReplaceable {
+			t.Errorf("IsParameterizedReplaceable(%d) = %v", tc.kind, !tc.parameterizedReplaceable)
+		}
+	}
+}
+
 func TestEventSerializationWithExtraFields(t *testing.T) {
 	evt := Event{
 		ID:        "92570b321da503eac8014b23447301eb3d0bbdfbace0d11a4e4072e72bb7205d",
@@ -144,3 +247,217 @@ func mustSignEvent(t *testing.T, privkey string, event *Event) {
 		t.Fatalf("event.Sign: %v", err)
 	}
 }
+
+func TestEventSignFillsFields(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	event := Event{Kind: 1, Content: "hello"}
+	mustSignEvent(t, priv, &event)
+
+	if event.PubKey != pub {
+		t.Errorf("Sign set pubkey %s; want %s", event.PubKey, pub)
+	}
+	if event.CreatedAt.IsZero() {
+		t.Error("Sign did not set created_at")
+	}
+	if !event.CheckID() {
+		t.Errorf("Sign set id %s; want %s", event.ID, event.GetID())
+	}
+	if ok, err := event.CheckSignature(); !ok || err != nil {
+		t.Errorf("signature check failed: ok=%t, err=%v", ok, err)
+	}
+
+	createdAt := time.Unix(1672068534, 0)
+	event = Event{Kind: 1, Content: "hello", CreatedAt: createdAt}
+	mustSignEvent(t, priv, &event)
+	if !event.CreatedAt.Equal(createdAt) {
+		t.Errorf("Sign changed created_at to %v", event.CreatedAt)
+	}
+
+	if err := event.Sign("abcd"); err == nil {
+		t.Error("Sign accepted a short private key")
+	}
+}
+
+func TestEventSignFrozenClock(t *testing.T) {
+	Now = func() time.Time { return time.Unix(1700000000, 0) }
+	defer func() { Now = time.Now }()
+
+	event := Event{Kind: 1, Content: "hello"}
+	mustSignEvent(t, "0000000000000000000000000000000000000000000000000000000000000003", &event)
+
+	if !event.CreatedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Sign set created_at to %v; want the frozen time", event.CreatedAt)
+	}
+	if want := "a9d53fee641fe563de947fa330a3b4902e52e249894660aaa521cd039e896128"; event.ID != want {
+		t.Errorf("got id %s; want %s", event.ID, want)
+	}
+	// signatures are deterministic for the same key and id
+	if want := "28b9ae2bd96f42768706222b0ab24ea88661ca49f77d3f8e269655702ae8c5c6213d328beba59de30a21488f47de37ed7430dc62741d6676c89e58a8c20dee73"; event.Sig != want {
+		t.Errorf("got signature %s; want %s", event.Sig, want)
+	}
+}
+
+func TestEventClone(t *testing.T) {
+	evt := Event{Kind: 1, Content: "hi", Tags: Tags{Tag{"p", "aa"}, Tag{"e", "bb", "wss://x.com"}}}
+	evt.SetExtra("k", "v")
+
+	clone := evt.Clone()
+	clone.Tags[0][1] = "cc"
+	clone.Tags = append(clone.Tags, Tag{"t", "x"})
+	clone.SetExtra("k", "w")
+	clone.Content = "bye"
+
+	if evt.Tags[0][1] != "aa" || len(evt.Tags) != 2 {
+		t.Errorf("changing the clone's tags changed the original to %v", evt.Tags)
+	}
+	if evt.GetExtraString("k") != "v" || evt.Content != "hi" {
+		t.Error("changing the clone changed the original")
+	}
+	if clone.Tags[1].Relay() != "wss://x.com" || clone.Kind != 1 {
+		t.Errorf("clone %+v lost fields of the original", clone)
+	}
+}
+
+func TestEventMalformedHex(t *testing.T) {
+	priv, _ := makeKeyPair(t)
+	evt := Event{Kind: 1, Content: "hello"}
+	mustSignEvent(t, priv, &evt)
+
+	malformed := map[string]func(string) string{
+		"empty":      func(string) string { return "" },
+		"odd length": func(s string) string { return s[1:] },
+		"not hex":    func(s string) string { return "zz" + s[2:] },
+	}
+	for name, malform := range malformed {
+		bad := evt
+		bad.PubKey = malform(evt.PubKey)
+		if ok, err := bad.CheckSignature(); ok || err == nil {
+			t.Errorf("CheckSignature with %s pubkey returned %t, %v; want an error", name, ok, err)
+		}
+
+		bad = evt
+		bad.Sig = malform(evt.Sig)
+		if ok, err := bad.CheckSignature(); ok || err == nil {
+			t.Errorf("CheckSignature with %s signature returned %t, %v; want an error", name, ok, err)
+		}
+
+		sk := malform(priv)
+		if err := (&Event{Kind: 1}).Sign(sk); err == nil {
+			t.Errorf("Sign with %s private key returned no error", name)
+		} else if sk != "" && strings.Contains(err.Error(), sk) {
+			t.Errorf("Sign error %q includes the private key", err)
+		}
+	}
+}
+
+func TestEventJSONRoundTrip(t *testing.T) {
+	// real events, then signed ones with random content and tags, heavy on the characters
+	// that need escaping or could be re-encoded: quotes, backslashes, control characters,
+	// HTML, line separators, emoji and invalid UTF-8
+	var events []Event
+	for _, raw := range realEvents {
+		var ev Event
+		if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+			t.Fatalf("failed to parse event json: %v", err)
+		}
+		events = append(events, ev)
+	}
+	alphabet := []string{"a", "Z", " ", "\"", "\\", "/", "\x00", "\x08", "\x1f", "\x7f", "\n", "\t",
+		"<", ">", "&", "\u2028", "\u2029", "é", "😀", "\xff", "\xc3", "\\u0041"}
+	random := rand.New(rand.NewSource(1))
+	randomString := func() string {
+		var b strings.Builder
+		for n := random.Intn(20); n > 0; n-- {
+			b.WriteString(alphabet[random.Intn(len(alphabet))])
+		}
+		return b.String()
+	}
+	sk := GeneratePrivateKey()
+	for i := 0; i < 200; i++ {
+		ev := Event{Kind: random.Intn(40000), Content: randomString(), CreatedAt: time.Unix(random.Int63n(1<<32), 0)}
+		for n := random.Intn(4); n > 0; n-- {
+			ev.Tags = append(ev.Tags, Tag{randomString(), randomString()})
+		}
+		if err := ev.Sign(sk); err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		events = append(events, ev)
+	}
+
+	for _, ev := range events {
+		asjson, err := json.Marshal(ev)
+		if err != nil {
+			t.Fatalf("failed to marshal %q: %v", ev.Content, err)
+		}
+		var back Event
+		if err := json.Unmarshal(asjson, &back); err != nil {
+			t.Errorf("failed to parse %s: %v", asjson, err)
+			continue
+		}
+		if ok, err := back.CheckSignature(); !ok || !back.CheckID() {
+			t.Errorf("%s doesn't verify after a round trip: %v", asjson, err)
+		}
+		if again, _ := json.Marshal(back); string(again) != string(asjson) {
+			t.Errorf("marshaling again gives %s; want %s", again, asjson)
+		}
+	}
+}
+
+func TestEventUnmarshalFloatCreatedAt(t *testing.T) {
+	for _, createdAt := range []string{"1644271588", "1644271588.0", "1.644271588e9", "1644271588E0"} {
+		var ev Event
+		if err := json.Unmarshal([]byte(`{"created_at":`+createdAt+`}`), &ev); err != nil {
+			t.Errorf("failed to parse created_at %s: %v", createdAt, err)
+		} else if ev.CreatedAt.Unix() != 1644271588 {
+			t.Errorf("created_at %s parsed as %d", createdAt, ev.CreatedAt.Unix())
+		}
+	}
+	for _, createdAt := range []string{"1644271588.5", `"1644271588"`} {
+		var ev Event
+		if err := json.Unmarshal([]byte(`{"created_at":`+createdAt+`}`), &ev); err == nil {
+			t.Errorf("accepted created_at %s", createdAt)
+		}
+	}
+}
+
+func TestEventVerifyErrors(t *testing.T) {
+	priv, _ := makeKeyPair(t)
+	other, _ := makeKeyPair(t)
+	evt := Event{Kind: 1, Content: "hello"}
+	mustSignEvent(t, priv, &evt)
+	if err := evt.Verify(); err != nil {
+		t.Fatalf("Verify of a valid event returned %v", err)
+	}
+
+	forged := Event{Kind: 1, Content: "hello"}
+	mustSignEvent(t, other, &forged)
+	forged.Sig = evt.Sig // same id, signature of another key
+
+	badPubKey := evt
+	badPubKey.PubKey = "zz" + evt.PubKey[2:]
+	badPubKey.ID = badPubKey.GetID()
+
+	badSig := evt
+	badSig.Sig = evt.Sig[1:]
+
+	changed := evt
+	changed.Content = "changed"
+
+	resigned := changed
+	resigned.ID = resigned.GetID() // a consistent id, but not the one that was signed
+
+	for name, tc := range map[string]struct {
+		event Event
+		want  error
+	}{
+		"malformed pubkey":    {badPubKey, ErrInvalidPubKey},
+		"malformed signature": {badSig, ErrInvalidSignature},
+		"changed content":     {changed, ErrIDMismatch},
+		"changed and re-id'd": {resigned, ErrBadSignature},
+		"other signer":        {forged, ErrBadSignature},
+	} {
+		if err := tc.event.Verify(); !errors.Is(err, tc.want) {
+			t.Errorf("Verify of an event with %s returned %v; want %v", name, err, tc.want)
+		}
+	}
+}
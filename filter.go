@@ -16,7 +16,7 @@ type Filter struct {
 	Tags    TagMap
 	Since   *time.Time
 	Until   *time.Time
-	Limit   int
+	Limit   int // per relay, see PoolSubscription.GlobalLimit for a pool-wide one
 	Search  string
 }
 
@@ -41,6 +41,8 @@ func (ef Filter) String() string {
 	return string(j)
 }
 
+// Matches tells whether event passes the filter. Search (NIP-50) isn't evaluated, as what
+// matches a full-text query is up to each relay.
 func (ef Filter) Matches(event *Event) bool {
 	if event == nil {
 		return false
@@ -102,11 +104,15 @@ func FilterEqual(a Filter, b Filter) bool {
 		}
 	}
 
-	if a.Since != b.Since {
+	if !timeEqual(a.Since, b.Since) {
 		return false
 	}
 
-	if a.Until != b.Until {
+	if !timeEqual(a.Until, b.Until) {
+		return false
+	}
+
+	if a.Limit != b.Limit {
 		return false
 	}
 
@@ -116,3 +122,34 @@ func FilterEqual(a Filter, b Filter) bool {
 
 	return true
 }
+
+// WithKinds returns a copy of the filter that also matches events of the given kinds, e.g.
+// Filter{Authors: authors}.WithKinds(KindTextNote, KindBoost, KindReaction). Kinds already in
+// the filter aren't added again, and the Kinds of the original filter are left untouched.
+func (ef Filter) WithKinds(kinds ...int) Filter {
+	merged := slices.Clip(ef.Kinds)
+	for _, kind := range kinds {
+		if !slices.Contains(merged, kind) {
+			merged = append(merged, kind)
+		}
+	}
+	ef.Kinds = merged
+	return ef
+}
+
+// WithReplaceableKinds returns a copy of the filter that also matches every replaceable kind
+// this package has a constant for: KindSetMetadata, KindContactList and KindRelayList.
+// It is not every replaceable kind: the rest of 10000-19999 (see IsReplaceable) are far too
+// many to list in a filter, so the ones of interest must be added with WithKinds. Kind 41,
+// KindChannelMetadata, isn't included either: NIP-28 has only the latest one kept, but
+// for each channel rather than for each pubkey like the replaceable kinds.
+func (ef Filter) WithReplaceableKinds() Filter {
+	return ef.WithKinds(KindSetMetadata, KindContactList, KindRelayList)
+}
+
+func timeEqual(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -62,7 +62,7 @@ func (f *Filter) UnmarshalJSON(payload []byte) error {
 			}
 			f.Limit = val
 		case "search":
-			f.Search = v.String()
+			f.Search = string(v.GetStringBytes())
 		default:
 			if strings.HasPrefix(key, "#") {
 				f.Tags[key[1:]], err = fastjsonArrayToStringList(v)
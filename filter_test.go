@@ -41,6 +41,100 @@ func TestFilterMarshal(t *testing.T) {
 	}
 }
 
+func TestFilterMarshalFields(t *testing.T) {
+	since := time.Unix(1672068000, 0)
+	until := time.Unix(1672069000, 0)
+
+	for _, tc := range []struct {
+		filter   Filter
+		expected string
+	}{
+		{Filter{}, `{}`},
+		{Filter{IDs: []string{"abc", "def"}}, `{"ids":["abc","def"]}`},
+		{Filter{Authors: []string{"abc"}}, `{"authors":["abc"]}`},
+		{Filter{Kinds: []int{0, 3}}, `{"kinds":[0,3]}`},
+		{Filter{Since: &since}, `{"since":1672068000}`},
+		{Filter{Until: &until}, `{"until":1672069000}`},
+		{Filter{Limit: 20}, `{"limit":20}`},
+		{Filter{Tags: TagMap{"e": {"abc"}}}, `{"#e":["abc"]}`},
+		{Filter{Search: `best "nostr" apps`}, `{"search":"best \"nostr\" apps"}`},
+		{
+			Filter{IDs: []string{"abc"}, Kinds: []int{1}, Authors: []string{"def"}, Since: &since, Until: &until, Tags: TagMap{"p": {"ghi"}}, Limit: 5},
+			`{"ids":["abc"],"kinds":[1],"authors":["def"],"since":1672068000,"until":1672069000,"#p":["ghi"],"limit":5}`,
+		},
+	} {
+		filterj, err := json.Marshal(tc.filter)
+		if err != nil {
+			t.Errorf("failed to marshal filter json: %v", err)
+		}
+		if string(filterj) != tc.expected {
+			t.Errorf("filter json was wrong: %s != %s", string(filterj), tc.expected)
+		}
+
+		var parsed Filter
+		if err := json.Unmarshal(filterj, &parsed); err != nil {
+			t.Errorf("failed to parse filter json %s: %v", filterj, err)
+		}
+		if !FilterEqual(tc.filter, parsed) {
+			t.Errorf("filter %s parsed back as %s", tc.filter, parsed)
+		}
+	}
+}
+
+func TestFilterWithKinds(t *testing.T) {
+	base := Filter{Authors: []string{"abc"}, Kinds: []int{1}}
+	for _, tc := range []struct {
+		filter   Filter
+		expected string
+	}{
+		{Filter{}.WithKinds(KindTextNote, KindBoost, KindReaction), `{"kinds":[1,6,7]}`},
+		{base.WithKinds(KindBoost, KindTextNote, KindBoost), `{"kinds":[1,6],"authors":["abc"]}`},
+		{Filter{}.WithReplaceableKinds(), `{"kinds":[0,3,10002]}`},
+		{base.WithReplaceableKinds().WithKinds(10000), `{"kinds":[1,0,3,10002,10000],"authors":["abc"]}`},
+		{Filter{Limit: 5}.WithKinds(), `{"limit":5}`},
+	} {
+		filterj, err := json.Marshal(tc.filter)
+		if err != nil {
+			t.Errorf("failed to marshal filter json: %v", err)
+		}
+		if string(filterj) != tc.expected {
+			t.Errorf("filter json was wrong: %s != %s", string(filterj), tc.expected)
+		}
+	}
+
+	// the original filter is left untouched, even with spare capacity in its kinds
+	kinds := make([]int, 1, 4)
+	kinds[0] = KindTextNote
+	original := Filter{Kinds: kinds}
+	first, second := original.WithKinds(KindBoost), original.WithKinds(KindReaction)
+	if len(original.Kinds) != 1 || first.Kinds[1] != KindBoost || second.Kinds[1] != KindReaction {
+		t.Errorf("WithKinds changed the original filter: %v, %v, %v", original.Kinds, first.Kinds, second.Kinds)
+	}
+}
+
+func TestFilterTagsRoundTrip(t *testing.T) {
+	filter := Filter{
+		Kinds: []int{1, 7},
+		Tags: TagMap{
+			"e": {"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"},
+			"p": {"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d", "46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"},
+		},
+	}
+
+	filterj, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatalf("failed to marshal filter json: %v", err)
+	}
+
+	var parsed Filter
+	if err := json.Unmarshal(filterj, &parsed); err != nil {
+		t.Fatalf("failed to parse filter json %s: %v", filterj, err)
+	}
+	if !FilterEqual(filter, parsed) {
+		t.Errorf("filter %s parsed back as %s", filter, parsed)
+	}
+}
+
 func TestFilterMatching(t *testing.T) {
 	if (Filter{Kinds: []int{4, 5}}).Matches(&Event{Kind: 6}) {
 		t.Error("matched event that shouldn't have matched")
@@ -65,6 +159,93 @@ func TestFilterMatching(t *testing.T) {
 	}
 }
 
+func TestFilterMatchingFields(t *testing.T) {
+	since := time.Unix(1672068000, 0)
+	until := time.Unix(1672069000, 0)
+	event := &Event{
+		ID:        "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962",
+		PubKey:    "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",
+		CreatedAt: time.Unix(1672068534, 0),
+		Kind:      1,
+		Tags:      Tags{{"e", "9e662bdd7d8abc40b5b15ee1ff5e9320efc87e9274d8d440c58e6eed2dddfbe2"}, {"p", "46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"}},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		match  bool
+	}{
+		{"empty", Filter{}, true},
+		{"ids", Filter{IDs: []string{"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"}}, true},
+		{"ids prefix", Filter{IDs: []string{"aaaa", "dc90c9"}}, true},
+		{"other ids", Filter{IDs: []string{"aaaa"}}, false},
+		{"authors", Filter{Authors: []string{"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"}}, true},
+		{"other authors", Filter{Authors: []string{"46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"}}, false},
+		{"kinds", Filter{Kinds: []int{0, 1}}, true},
+		{"other kinds", Filter{Kinds: []int{0, 3}}, false},
+		{"since", Filter{Since: &since}, true},
+		{"since later", Filter{Since: &until}, false},
+		{"until", Filter{Until: &until}, true},
+		{"until earlier", Filter{Until: &since}, false},
+		{"e tag", Filter{Tags: TagMap{"e": {"9e662bdd7d8abc40b5b15ee1ff5e9320efc87e9274d8d440c58e6eed2dddfbe2"}}}, true},
+		{"other e tag", Filter{Tags: TagMap{"e": {"46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"}}}, false},
+		{"e and p tags", Filter{Tags: TagMap{
+			"e": {"9e662bdd7d8abc40b5b15ee1ff5e9320efc87e9274d8d440c58e6eed2dddfbe2"},
+			"p": {"aaaa", "46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"},
+		}}, true},
+		{"missing tag", Filter{Tags: TagMap{"t": {"nostr"}}}, false},
+		{"all fields", Filter{
+			IDs:     []string{"dc90c9"},
+			Authors: []string{"3bf0c6"},
+			Kinds:   []int{1},
+			Since:   &since,
+			Until:   &until,
+			Tags:    TagMap{"p": {"46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"}},
+		}, true},
+		{"all fields but one", Filter{
+			IDs:     []string{"dc90c9"},
+			Authors: []string{"3bf0c6"},
+			Kinds:   []int{7},
+			Since:   &since,
+			Until:   &until,
+		}, false},
+	} {
+		if tc.filter.Matches(event) != tc.match {
+			t.Errorf("%s: filter %s matching gave %v; want %v", tc.name, tc.filter, !tc.match, tc.match)
+		}
+	}
+
+	if (Filter{}).Matches(nil) {
+		t.Error("matched a nil event")
+	}
+}
+
+func TestFilterMatchingPrefixes(t *testing.T) {
+	event := &Event{
+		ID:     "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962",
+		PubKey: "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",
+	}
+
+	for _, tc := range []struct {
+		filter Filter
+		match  bool
+	}{
+		{Filter{Authors: []string{"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"}}, true},
+		{Filter{Authors: []string{"3bf0c63fcb"}}, true},
+		{Filter{Authors: []string{"3bf0c63fcc"}}, false},
+		{Filter{Authors: []string{""}}, false},
+		{Filter{Authors: []string{"", "3bf0"}}, true},
+		{Filter{IDs: []string{"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"}}, true},
+		{Filter{IDs: []string{"dc90c95f09"}}, true},
+		{Filter{IDs: []string{"dc90c95f0a"}}, false},
+		{Filter{IDs: []string{""}}, false},
+	} {
+		if tc.filter.Matches(event) != tc.match {
+			t.Errorf("filter %s matching gave %v; want %v", tc.filter, !tc.match, tc.match)
+		}
+	}
+}
+
 func TestFilterEquality(t *testing.T) {
 	if !FilterEqual(
 		Filter{Kinds: []int{4, 5}},
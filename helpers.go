@@ -1,7 +1,11 @@
 package nostr
 
 import (
+	"container/list"
+	"encoding/hex"
+	"fmt"
 	"strings"
+	"sync"
 
 	"golang.org/x/exp/constraints"
 )
@@ -29,7 +33,8 @@ func Similar[E constraints.Ordered](as, bs []E) bool {
 
 func ContainsPrefixOf(haystack []string, needle string) bool {
 	for _, hay := range haystack {
-		if strings.HasPrefix(needle, hay) {
+		// an empty prefix is invalid rather than matching everything
+		if hay != "" && strings.HasPrefix(needle, hay) {
 			return true
 		}
 	}
@@ -75,3 +80,111 @@ func escapeString(dst []byte, s string) []byte {
 	dst = append(dst, '"')
 	return dst
 }
+
+// decodeHex decodes value, which must be size bytes encoded as hex, like a key or a
+// signature. name describes the value in errors, which never include the value itself so
+// they are safe to log when it is a private key.
+func decodeHex(name, value string, size int) ([]byte, error) {
+	if len(value) != size*2 {
+		return nil, fmt.Errorf("%s has %d characters, not %d", name, len(value), size*2)
+	}
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not hex: %w", name, err)
+	}
+	return b, nil
+}
+
+// idCache is a bounded set of ids that forgets the least recently seen ones first.
+type idCache struct {
+	mutex sync.Mutex
+	size  int
+	ids   map[string]*list.Element
+	order *list.List
+}
+
+func newIDCache(size int) *idCache {
+	return &idCache{
+		size:  size,
+		ids:   make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
+
+// add records id and reports whether it was not in the cache yet.
+func (c *idCache) add(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.ids[id]; ok {
+		c.order.MoveToFront(el)
+		return false
+	}
+
+	c.ids[id] = c.order.PushFront(id)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.ids, oldest.Value.(string))
+	}
+	return true
+}
+
+// relayIndex remembers the relays each event was seen on, for a bounded number of events,
+// forgetting the least recently seen ones first.
+type relayIndex struct {
+	mutex  sync.Mutex
+	size   int
+	events map[string]*list.Element
+	order  *list.List
+}
+
+type relayIndexEntry struct {
+	id     string
+	relays []string
+}
+
+func newRelayIndex(size int) *relayIndex {
+	return &relayIndex{
+		size:   size,
+		events: make(map[string]*list.Element, size),
+		order:  list.New(),
+	}
+}
+
+// add records that the event with id was seen on the relay at url.
+func (ri *relayIndex) add(id, url string) {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	if el, ok := ri.events[id]; ok {
+		ri.order.MoveToFront(el)
+		entry := el.Value.(*relayIndexEntry)
+		for _, relay := range entry.relays {
+			if relay == url {
+				return
+			}
+		}
+		entry.relays = append(entry.relays, url)
+		return
+	}
+
+	ri.events[id] = ri.order.PushFront(&relayIndexEntry{id: id, relays: []string{url}})
+	if ri.order.Len() > ri.size {
+		oldest := ri.order.Back()
+		ri.order.Remove(oldest)
+		delete(ri.events, oldest.Value.(*relayIndexEntry).id)
+	}
+}
+
+// get returns a copy of the relays the event with id was seen on, in the order it was.
+func (ri *relayIndex) get(id string) []string {
+	ri.mutex.Lock()
+	defer ri.mutex.Unlock()
+
+	el, ok := ri.events[id]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), el.Value.(*relayIndexEntry).relays...)
+}
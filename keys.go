@@ -10,6 +10,8 @@ import (
 	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 )
 
+// GeneratePrivateKey returns a new random secp256k1 private key as 64 hex characters,
+// or "" if the system's random source fails.
 func GeneratePrivateKey() string {
 	params := btcec.S256().Params()
 	one := new(big.Int).SetInt64(1)
@@ -25,11 +27,12 @@ func GeneratePrivateKey() string {
 	k.Mod(k, n)
 	k.Add(k, one)
 
-	return hex.EncodeToString(k.Bytes())
+	return hex.EncodeToString(k.FillBytes(make([]byte, 32)))
 }
 
+// GetPublicKey returns the 32-byte x-only public key (as hex) of the private key sk.
 func GetPublicKey(sk string) (string, error) {
-	b, err := hex.DecodeString(sk)
+	b, err := decodeHex("private key", sk, 32)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,48 @@
+package nostr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePrivateKey(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		sk := GeneratePrivateKey()
+		if len(sk) != 64 {
+			t.Fatalf("generated private key %q has %d characters; want 64", sk, len(sk))
+		}
+		pk, err := GetPublicKey(sk)
+		if err != nil {
+			t.Fatalf("GetPublicKey(%q): %v", sk, err)
+		}
+		if len(pk) != 64 {
+			t.Fatalf("public key %q has %d characters; want 64", pk, len(pk))
+		}
+
+		event := Event{Kind: 1, Content: "hello"}
+		mustSignEvent(t, sk, &event)
+		if event.PubKey != pk {
+			t.Fatalf("event signed by %s; want %s", event.PubKey, pk)
+		}
+		if ok, err := event.CheckSignature(); !ok || err != nil {
+			t.Fatalf("signature check failed: ok=%t, err=%v", ok, err)
+		}
+	}
+}
+
+func TestGetPublicKey(t *testing.T) {
+	// from the BIP-340 test vectors
+	pk, err := GetPublicKey(strings.Repeat("0", 63) + "3")
+	if err != nil {
+		t.Fatalf("GetPublicKey: %v", err)
+	}
+	if want := "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9"; pk != want {
+		t.Errorf("GetPublicKey returned %s; want %s", pk, want)
+	}
+
+	for _, sk := range []string{"", "zz", "0003", strings.Repeat("0", 63), strings.Repeat("g", 64)} {
+		if _, err := GetPublicKey(sk); err == nil {
+			t.Errorf("GetPublicKey(%q) returned no error", sk)
+		}
+	}
+}
@@ -5,13 +5,20 @@ import (
 	"fmt"
 )
 
+// ProfileMetadata is the content of a metadata event (kind 0).
+// LUD16 is the lightning address of the user, used for zaps (NIP-57).
 type ProfileMetadata struct {
 	Name    string `json:"name,omitempty"`
 	About   string `json:"about,omitempty"`
 	Picture string `json:"picture,omitempty"`
+	Banner  string `json:"banner,omitempty"`
 	NIP05   string `json:"nip05,omitempty"`
+	LUD16   string `json:"lud16,omitempty"`
+	Website string `json:"website,omitempty"`
 }
 
+// ParseMetadata decodes the content of event, which must be a metadata event (kind 0).
+// Unknown keys are ignored and missing ones are left empty.
 func ParseMetadata(event Event) (*ProfileMetadata, error) {
 	if event.Kind != 0 {
 		return nil, fmt.Errorf("event %s is kind %d, not 0", event.ID, event.Kind)
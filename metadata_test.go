@@ -0,0 +1,29 @@
+package nostr
+
+import "testing"
+
+func TestParseMetadata(t *testing.T) {
+	event := Event{Kind: KindSetMetadata, Content: `{"name":"fiatjaf","about":"","picture":"https://x.com/p.png","banner":"https://x.com/b.png","nip05":"_@fiatjaf.com","lud16":"fiatjaf@x.com","website":"https://fiatjaf.com","display_name":"unknown keys are ignored"}`}
+	meta, err := ParseMetadata(event)
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	want := ProfileMetadata{
+		Name:    "fiatjaf",
+		Picture: "https://x.com/p.png",
+		Banner:  "https://x.com/b.png",
+		NIP05:   "_@fiatjaf.com",
+		LUD16:   "fiatjaf@x.com",
+		Website: "https://fiatjaf.com",
+	}
+	if *meta != want {
+		t.Errorf("got %+v; want %+v", *meta, want)
+	}
+
+	if _, err := ParseMetadata(Event{Kind: KindTextNote, Content: "{}"}); err == nil {
+		t.Error("ParseMetadata accepted a kind 1 event")
+	}
+	if _, err := ParseMetadata(Event{Kind: KindSetMetadata, Content: "not json"}); err == nil {
+		t.Error("ParseMetadata accepted invalid content")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strings"
 
 	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/nbd-wtf/go-nostr"
 )
 
 // ComputeSharedSecret returns a shared secret key used to encrypt messages.
@@ -96,13 +97,47 @@ func Decrypt(content string, key []byte) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("Error creating block cipher: %s. \n", err.Error())
 	}
+	if len(iv) != block.BlockSize() {
+		return "", fmt.Errorf("Error decrypting message: iv has %d bytes. \n", len(iv))
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return "", fmt.Errorf("Error decrypting message: ciphertext has %d bytes. \n", len(ciphertext))
+	}
 	mode := cipher.NewCBCDecrypter(block, iv)
 	plaintext := make([]byte, len(ciphertext))
 	mode.CryptBlocks(plaintext, ciphertext)
 
 	// remove padding
 	padding := int(plaintext[len(plaintext)-1]) // the padding amount is encoded in the padding bytes themselves
+	if padding < 1 || padding > block.BlockSize() {
+		return "", fmt.Errorf("Error decrypting message: invalid padding. \n")
+	}
 	message := string(plaintext[0 : len(plaintext)-padding])
 
 	return message, nil
 }
+
+// CreateUnsignedDirectMessage creates a kind 4 event with message encrypted to receiverPubKey
+// and a "p" tag pointing to it. It should be signed with senderSecretKey afterwards.
+func CreateUnsignedDirectMessage(message, receiverPubKey, senderSecretKey string) (nostr.Event, error) {
+	senderPubKey, err := nostr.GetPublicKey(senderSecretKey)
+	if err != nil {
+		return nostr.Event{}, fmt.Errorf("failed to get sender public key: %w", err)
+	}
+	sharedSecret, err := ComputeSharedSecret(receiverPubKey, senderSecretKey)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	content, err := Encrypt(message, sharedSecret)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	return nostr.Event{
+		PubKey:    senderPubKey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindEncryptedDirectMessage,
+		Tags:      nostr.Tags{nostr.Tag{"p", receiverPubKey}},
+		Content:   content,
+	}, nil
+}
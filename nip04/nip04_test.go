@@ -3,6 +3,8 @@ package nip04
 import (
 	"strings"
 	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
 )
 
 func TestEncryptionAndDecryption(t *testing.T) {
@@ -45,3 +47,47 @@ func TestEncryptionAndDecryptionWithMultipleLengths(t *testing.T) {
 		}
 	}
 }
+
+func TestDecryptMalformed(t *testing.T) {
+	sharedSecret := make([]byte, 32)
+	for _, content := range []string{
+		"",
+		"?iv=AAAAAAAAAAAAAAAAAAAAAA==",
+		"AAAA?iv=AAAAAAAAAAAAAAAAAAAAAA==",
+		"AAAAAAAAAAAAAAAAAAAAAA==?iv=AAAA",
+	} {
+		if _, err := Decrypt(content, sharedSecret); err == nil {
+			t.Errorf("decrypting %q should have failed", content)
+		}
+	}
+}
+
+func TestDirectMessage(t *testing.T) {
+	senderSk := nostr.GeneratePrivateKey()
+	receiverSk := nostr.GeneratePrivateKey()
+	receiverPk, _ := nostr.GetPublicKey(receiverSk)
+
+	evt, err := CreateUnsignedDirectMessage("hello there", receiverPk, senderSk)
+	if err != nil {
+		t.Fatalf("failed to create direct message: %s", err.Error())
+	}
+	if evt.Kind != nostr.KindEncryptedDirectMessage {
+		t.Errorf("direct message has kind %d", evt.Kind)
+	}
+	if evt.Tags.GetFirst([]string{"p", receiverPk}) == nil {
+		t.Error("direct message doesn't tag the receiver")
+	}
+
+	// the receiver computes the same secret from the other side
+	sharedSecret, err := ComputeSharedSecret(evt.PubKey, receiverSk)
+	if err != nil {
+		t.Fatalf("failed to compute shared secret: %s", err.Error())
+	}
+	plaintext, err := Decrypt(evt.Content, sharedSecret)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %s", err.Error())
+	}
+	if plaintext != "hello there" {
+		t.Errorf("decrypted '%s'; want 'hello there'", plaintext)
+	}
+}
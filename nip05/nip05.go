@@ -1,10 +1,13 @@
 package nip05
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -19,7 +22,28 @@ type WellKnownResponse struct {
 	Relays key2RelaysMap `json:"relays"` // NIP-35
 }
 
+// httpClient is used for all the requests, replaced in tests
+var httpClient = http.DefaultClient
+
+// QueryIdentifier is like Query, but returns nil on any error.
 func QueryIdentifier(fullname string) *nostr.ProfilePointer {
+	pp, err := Query(context.Background(), fullname)
+	if err != nil {
+		return nil
+	}
+	return pp
+}
+
+// Query fetches the .well-known/nostr.json of the domain in fullname ("name@domain",
+// or just "domain" for "_@domain") and returns the pubkey and relay hints it lists for name.
+func Query(ctx context.Context, fullname string) (*nostr.ProfilePointer, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		// if no timeout is set, force it to 7 seconds
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 7*time.Second)
+		defer cancel()
+	}
+
 	spl := strings.Split(fullname, "@")
 
 	var name, domain string
@@ -31,30 +55,48 @@ func QueryIdentifier(fullname string) *nostr.ProfilePointer {
 		name = spl[0]
 		domain = spl[1]
 	default:
-		return nil
+		return nil, fmt.Errorf("invalid identifier '%s'", fullname)
 	}
 
 	if strings.Index(domain, ".") == -1 {
-		return nil
+		return nil, fmt.Errorf("invalid domain '%s'", domain)
 	}
 
-	res, err := http.Get(fmt.Sprintf("https://%s/.well-known/nostr.json?name=%s", domain, name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("https://%s/.well-known/nostr.json?name=%s", domain, url.QueryEscape(name)), nil)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch nostr.json from '%s': %w", domain, err)
+	}
+	defer res.Body.Close()
 
 	var result WellKnownResponse
 	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to decode nostr.json from '%s': %w", domain, err)
 	}
 
-	pubkey, _ := result.Names[name]
+	pubkey, ok := result.Names[name]
+	if !ok {
+		return nil, fmt.Errorf("name '%s' not found in nostr.json from '%s'", name, domain)
+	}
 	relays, _ := result.Relays[pubkey]
 
 	return &nostr.ProfilePointer{
 		PublicKey: pubkey,
 		Relays:    relays,
+	}, nil
+}
+
+// Verify tells whether identifier resolves to pubkeyHex.
+func Verify(ctx context.Context, identifier string, pubkeyHex string) (bool, error) {
+	pp, err := Query(ctx, identifier)
+	if err != nil {
+		return false, err
 	}
+	return pp.PublicKey == pubkeyHex, nil
 }
 
 func NormalizeIdentifier(fullname string) string {
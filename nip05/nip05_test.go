@@ -0,0 +1,64 @@
+package nip05
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/nostr.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{
+  "names": {
+    "bob": "b0635d6a9851d3aed0cd6c495b282167acf761729078d975fc341b22650b07b9",
+    "_": "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d",
+    "a b": "46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"
+  },
+  "relays": {
+    "b0635d6a9851d3aed0cd6c495b282167acf761729078d975fc341b22650b07b9": ["wss://relay.example.com"]
+  }
+}`))
+	}))
+	defer ts.Close()
+	httpClient = ts.Client()
+	defer func() { httpClient = http.DefaultClient }()
+	domain := strings.TrimPrefix(ts.URL, "https://")
+
+	for _, tc := range []struct {
+		identifier string
+		pubkey     string
+		ok         bool
+	}{
+		{"bob@" + domain, "b0635d6a9851d3aed0cd6c495b282167acf761729078d975fc341b22650b07b9", true},
+		{"bob@" + domain, "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d", false},
+		{domain, "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d", true},
+		{"_@" + domain, "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d", true},
+		{"a b@" + domain, "46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea", true},
+	} {
+		ok, err := Verify(context.Background(), tc.identifier, tc.pubkey)
+		if err != nil {
+			t.Errorf("Verify(%s): %s", tc.identifier, err)
+		}
+		if ok != tc.ok {
+			t.Errorf("Verify(%s, %s) = %v; want %v", tc.identifier, tc.pubkey, ok, tc.ok)
+		}
+	}
+
+	pp, err := Query(context.Background(), "bob@"+domain)
+	if err != nil {
+		t.Fatalf("Query: %s", err)
+	}
+	if len(pp.Relays) != 1 || pp.Relays[0] != "wss://relay.example.com" {
+		t.Errorf("relays = %v; want [wss://relay.example.com]", pp.Relays)
+	}
+
+	if _, err := Verify(context.Background(), "alice@"+domain, "b0635d6a9851d3aed0cd6c495b282167acf761729078d975fc341b22650b07b9"); err == nil {
+		t.Error("verifying an unknown name should have failed")
+	}
+}
@@ -0,0 +1,33 @@
+package nip09
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CreateUnsignedDeletion creates a kind 5 event asking relays and clients to delete the
+// events with the given ids, which must have been published by pubkey.
+// reason is optional and goes in the content.
+// Honoring deletions is up to each relay and client; it is a request, not a guarantee.
+func CreateUnsignedDeletion(pubkey string, eventIDs []string, reason string) nostr.Event {
+	tags := make(nostr.Tags, 0, len(eventIDs))
+	for _, id := range eventIDs {
+		tags = append(tags, nostr.Tag{"e", id})
+	}
+
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindDeletion,
+		Tags:      tags,
+		Content:   reason,
+	}
+}
+
+// Deletes tells whether deletion is a kind 5 event from the author of event asking
+// for it to be deleted. Events from other authors can't be deleted this way.
+func Deletes(deletion *nostr.Event, event *nostr.Event) bool {
+	if deletion.Kind != nostr.KindDeletion || deletion.PubKey != event.PubKey {
+		return false
+	}
+	return deletion.Tags.GetFirst([]string{"e", event.ID}) != nil
+}
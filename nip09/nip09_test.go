@@ -0,0 +1,40 @@
+package nip09
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestDeletion(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+
+	note := nostr.Event{PubKey: pk, Kind: nostr.KindTextNote, Content: "oops"}
+	note.Sign(sk)
+	other := nostr.Event{PubKey: pk, Kind: nostr.KindTextNote, Content: "fine"}
+	other.Sign(sk)
+
+	deletion := CreateUnsignedDeletion(pk, []string{note.ID}, "posted by mistake")
+	if err := deletion.Sign(sk); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	if deletion.Kind != nostr.KindDeletion || deletion.Content != "posted by mistake" {
+		t.Errorf("unexpected deletion event %v", deletion)
+	}
+
+	if !Deletes(&deletion, &note) {
+		t.Error("deletion should delete the note")
+	}
+	if Deletes(&deletion, &other) {
+		t.Error("deletion shouldn't delete an event it doesn't tag")
+	}
+
+	// someone else can't delete the note
+	sk2 := nostr.GeneratePrivateKey()
+	pk2, _ := nostr.GetPublicKey(sk2)
+	forged := CreateUnsignedDeletion(pk2, []string{note.ID}, "")
+	if Deletes(&forged, &note) {
+		t.Error("deletion from another author shouldn't delete the note")
+	}
+}
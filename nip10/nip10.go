@@ -22,3 +22,70 @@ func GetImmediateReply(tags nostr.Tags) *nostr.Tag {
 
 	return tags.GetLast([]string{"e", ""})
 }
+
+// CreateUnsignedReply creates a kind 1 reply from pubkey to parent, in the thread started by
+// root, with "e" tags marked "root" and "reply" as in NIP-10. root can be nil, in which case
+// it is taken from the tags of parent, or is parent itself if it has none; when root is
+// parent there is only the "root" tag. The "p" tags are the ones of parent along with the
+// authors of parent and root, without duplicates, so everyone in the thread is notified.
+func CreateUnsignedReply(pubkey string, root, parent *nostr.Event, content string) nostr.Event {
+	rootID := parent.ID
+	if root != nil {
+		rootID = root.ID
+	} else if tag := GetThreadRoot(parent.Tags); tag != nil {
+		rootID = tag.Value()
+	}
+
+	tags := nostr.Tags{nostr.Tag{"e", rootID, "", "root"}}
+	if rootID != parent.ID {
+		tags = append(tags, nostr.Tag{"e", parent.ID, "", "reply"})
+	}
+
+	participants := map[string]bool{}
+	addParticipant := func(pk string) {
+		if pk != "" && !participants[pk] {
+			participants[pk] = true
+			tags = append(tags, nostr.Tag{"p", pk})
+		}
+	}
+	if root != nil {
+		addParticipant(root.PubKey)
+	}
+	for _, tag := range parent.Tags.GetAll([]string{"p", ""}) {
+		addParticipant(tag.Value())
+	}
+	addParticipant(parent.PubKey)
+
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindTextNote,
+		Tags:      tags,
+		Content:   content,
+	}
+}
+
+// Refs are the ids of the events an event refers to in a thread, see ThreadRefs.
+type Refs struct {
+	Root  string
+	Reply string
+}
+
+// ThreadRefs returns the id of the root of the thread of the event with tags and of the event
+// it replies to, which is the root itself for direct replies, using the markers of NIP-10
+// or, for events without them, the positions of the "e" tags. Both are "" if the event
+// isn't part of a thread.
+func ThreadRefs(tags nostr.Tags) Refs {
+	var refs Refs
+	if root := GetThreadRoot(tags); root != nil {
+		refs.Root = root.Value()
+	}
+	if reply := GetImmediateReply(tags); reply != nil {
+		refs.Reply = reply.Value()
+		if len(*reply) >= 4 && (*reply)[3] != "" && (*reply)[3] != "reply" {
+			// marked, but no "reply" tag: a direct reply to the root
+			refs.Reply = refs.Root
+		}
+	}
+	return refs
+}
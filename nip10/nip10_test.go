@@ -0,0 +1,54 @@
+package nip10
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCreateUnsignedReply(t *testing.T) {
+	alice := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	bob := "52b4a076bcbbbdc3a1aefa3735816cf74993b1b8db202b01c883c58be7fad8bd"
+	carol := "82341f882b6eabcd2ba7f1ef90aad961cf074af15b9ef44a09f9d2a8fbfbe6a2"
+
+	root := nostr.Event{ID: "aa", PubKey: alice, Kind: nostr.KindTextNote}
+	direct := CreateUnsignedReply(bob, &root, &root, "first")
+	direct.ID = "bb"
+	if refs := ThreadRefs(direct.Tags); refs.Root != "aa" || refs.Reply != "aa" {
+		t.Errorf("direct reply refers to %+v; want root and reply aa", refs)
+	}
+	if len(direct.Tags) != 2 || direct.Tags.GetFirst([]string{"p", alice}) == nil {
+		t.Errorf("direct reply has tags %v; want the root and its author", direct.Tags)
+	}
+	direct.PubKey = bob
+
+	// replying to the reply, with the root taken from its tags
+	nested := CreateUnsignedReply(carol, nil, &direct, "second")
+	if refs := ThreadRefs(nested.Tags); refs.Root != "aa" || refs.Reply != "bb" {
+		t.Errorf("nested reply refers to %+v; want root aa and reply bb", refs)
+	}
+	if got := nested.Tags.GetAll([]string{"p", ""}); len(got) != 2 ||
+		nested.Tags.GetFirst([]string{"p", alice}) == nil || nested.Tags.GetFirst([]string{"p", bob}) == nil {
+		t.Errorf("nested reply has p tags %v; want alice and bob once each", got)
+	}
+	if nested.Kind != nostr.KindTextNote || nested.PubKey != carol || nested.Content != "second" {
+		t.Errorf("unexpected reply event %v", nested)
+	}
+}
+
+func TestThreadRefs(t *testing.T) {
+	for name, tc := range map[string]struct {
+		tags nostr.Tags
+		want Refs
+	}{
+		"not a reply":     {nostr.Tags{nostr.Tag{"p", "aa"}}, Refs{}},
+		"positional root": {nostr.Tags{nostr.Tag{"e", "aa"}}, Refs{"aa", "aa"}},
+		"positional":      {nostr.Tags{nostr.Tag{"e", "aa"}, nostr.Tag{"e", "cc"}, nostr.Tag{"e", "bb"}}, Refs{"aa", "bb"}},
+		"marked":          {nostr.Tags{nostr.Tag{"e", "bb", "", "reply"}, nostr.Tag{"e", "aa", "", "root"}}, Refs{"aa", "bb"}},
+		"marked mention":  {nostr.Tags{nostr.Tag{"e", "aa", "", "root"}, nostr.Tag{"e", "cc", "", "mention"}}, Refs{"aa", "aa"}},
+	} {
+		if got := ThreadRefs(tc.tags); got != tc.want {
+			t.Errorf("%s: ThreadRefs returned %+v; want %+v", name, got, tc.want)
+		}
+	}
+}
@@ -15,6 +15,12 @@ import (
 
 // Fetch fetches the NIP-11 RelayInformationDocument.
 func Fetch(ctx context.Context, u string) (info *RelayInformationDocument, err error) {
+	return FetchWithClient(ctx, http.DefaultClient, u)
+}
+
+// FetchWithClient is like Fetch, but sends the request with client, e.g. one going through
+// the same proxy as the websocket connection.
+func FetchWithClient(ctx context.Context, client *http.Client, u string) (info *RelayInformationDocument, err error) {
 	if _, ok := ctx.Deadline(); !ok {
 		// if no timeout is set, force it to 7 seconds
 		var cancel context.CancelFunc
@@ -38,15 +44,23 @@ func Fetch(ctx context.Context, u string) (info *RelayInformationDocument, err e
 	p.Path = strings.TrimRight(p.Path, "/")
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
 
 	// add the NIP-11 header
 	req.Header.Add("Accept", "application/nostr+json")
 
 	// send the request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("relay returned HTTP status %d", resp.StatusCode)
+	}
+
 	info = &RelayInformationDocument{}
 	dec := json.NewDecoder(resp.Body)
 	err = dec.Decode(info)
@@ -0,0 +1,47 @@
+package nip11
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accept := r.Header.Get("Accept"); accept != "application/nostr+json" {
+			t.Errorf("Accept header is %q; want application/nostr+json", accept)
+		}
+		w.Header().Set("Content-Type", "application/nostr+json")
+		w.Write([]byte(`{"name":"test relay","supported_nips":[1,11,42],"software":"git+https://example.com/relay","version":"1.0","limitation":{"max_subscriptions":20,"max_limit":500,"auth_required":true}}`))
+	}))
+	defer ts.Close()
+
+	info, err := Fetch(context.Background(), "ws"+ts.URL[len("http"):])
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if info.Name != "test relay" || info.Version != "1.0" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if len(info.SupportedNIPs) != 3 || info.SupportedNIPs[2] != 42 {
+		t.Errorf("supported nips = %v; want [1 11 42]", info.SupportedNIPs)
+	}
+	if info.Limitation == nil {
+		t.Fatal("limitation is nil")
+	}
+	if info.Limitation.MaxSubscriptions != 20 || info.Limitation.MaxLimit != 500 || !info.Limitation.AuthRequired {
+		t.Errorf("unexpected limitation: %+v", info.Limitation)
+	}
+}
+
+func TestFetchBadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	if _, err := Fetch(context.Background(), ts.URL); err == nil {
+		t.Error("expected an error for a 404 response")
+	}
+}
@@ -1,10 +1,14 @@
 package nip19
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
+// ErrInvalidChecksum is returned (wrapped) by Decode when the bech32 checksum doesn't match.
+var ErrInvalidChecksum = errors.New("invalid bech32 checksum")
+
 const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
 
 var gen = []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
@@ -57,7 +61,7 @@ func decode(bech string) (string, []byte, error) {
 		if err == nil {
 			moreInfo = fmt.Sprintf("Expected %v, got %v.", expected, checksum)
 		}
-		return "", nil, fmt.Errorf("checksum failed. " + moreInfo)
+		return "", nil, fmt.Errorf("%w. %s", ErrInvalidChecksum, moreInfo)
 	}
 
 	// We exclude the last 6 bytes, which is the checksum.
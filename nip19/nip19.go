@@ -70,6 +70,8 @@ func Decode(bech32string string) (prefix string, value any, err error) {
 				result.ID = hex.EncodeToString(v)
 			case TLVRelay:
 				result.Relays = append(result.Relays, string(v))
+			case TLVAuthor:
+				result.Author = hex.EncodeToString(v)
 			default:
 				// ignore
 			}
@@ -143,18 +145,28 @@ func EncodeProfile(publicKeyHex string, relays []string) (string, error) {
 	return encode("nprofile", bits5)
 }
 
-func EncodeEvent(eventIdHex string, relays []string) (string, error) {
+// EncodeEvent encodes an nevent with relay hints. author is the hex pubkey of
+// the event author and is left out if empty.
+func EncodeEvent(eventIdHex string, relays []string, author string) (string, error) {
 	buf := &bytes.Buffer{}
-	pubkey, err := hex.DecodeString(eventIdHex)
+	id, err := hex.DecodeString(eventIdHex)
 	if err != nil {
 		return "", fmt.Errorf("invalid id '%s': %w", eventIdHex, err)
 	}
-	writeTLVEntry(buf, TLVDefault, pubkey)
+	writeTLVEntry(buf, TLVDefault, id)
 
 	for _, url := range relays {
 		writeTLVEntry(buf, TLVRelay, []byte(url))
 	}
 
+	if author != "" {
+		pubkey, err := hex.DecodeString(author)
+		if err != nil {
+			return "", fmt.Errorf("invalid author '%s': %w", author, err)
+		}
+		writeTLVEntry(buf, TLVAuthor, pubkey)
+	}
+
 	bits5, err := convertBits(buf.Bytes(), 8, 5, true)
 	if err != nil {
 		return "", fmt.Errorf("failed to convert bits: %w", err)
@@ -1,6 +1,9 @@
 package nip19
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"testing"
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -43,6 +46,9 @@ func TestFailDecodeBadChecksumNpub(t *testing.T) {
 	if err == nil {
 		t.Errorf("should have errored: %s", err)
 	}
+	if !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("error should be ErrInvalidChecksum: %s", err)
+	}
 }
 
 func TestDecodeNprofile(t *testing.T) {
@@ -107,3 +113,55 @@ func TestEncodeNprofile(t *testing.T) {
 		t.Error("produced an unexpected nprofile string")
 	}
 }
+
+func TestEncodeDecodeNevent(t *testing.T) {
+	relays := []string{"wss://r.x.com", "wss://djbas.sadkb.com", "wss://nostr.example.com"}
+	for _, author := range []string{"", "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"} {
+		nevent, err := EncodeEvent("dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962", relays, author)
+		if err != nil {
+			t.Fatalf("shouldn't error: %s", err)
+		}
+
+		prefix, data, err := Decode(nevent)
+		if err != nil {
+			t.Fatalf("shouldn't error: %s", err)
+		}
+		if prefix != "nevent" {
+			t.Error("what")
+		}
+		ep := data.(nostr.EventPointer)
+		if ep.ID != "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962" {
+			t.Error("decoded invalid id")
+		}
+		if ep.Author != author {
+			t.Errorf("decoded author %q; want %q", ep.Author, author)
+		}
+		if len(ep.Relays) != len(relays) {
+			t.Fatal("decoded wrong number of relays")
+		}
+		for i := range relays {
+			if ep.Relays[i] != relays[i] {
+				t.Errorf("relay %d decoded as %s; want %s", i, ep.Relays[i], relays[i])
+			}
+		}
+	}
+}
+
+func TestDecodeNeventIgnoresUnknownTLV(t *testing.T) {
+	buf := &bytes.Buffer{}
+	id, _ := hex.DecodeString("dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962")
+	writeTLVEntry(buf, TLVDefault, id)
+	writeTLVEntry(buf, 99, []byte("whatever"))
+	writeTLVEntry(buf, TLVRelay, []byte("wss://r.x.com"))
+	bits5, _ := convertBits(buf.Bytes(), 8, 5, true)
+	nevent, _ := encode("nevent", bits5)
+
+	_, data, err := Decode(nevent)
+	if err != nil {
+		t.Fatalf("shouldn't error: %s", err)
+	}
+	ep := data.(nostr.EventPointer)
+	if len(ep.Relays) != 1 || ep.Relays[0] != "wss://r.x.com" {
+		t.Errorf("decoded relays %v; want [wss://r.x.com]", ep.Relays)
+	}
+}
@@ -7,6 +7,7 @@ import (
 const (
 	TLVDefault uint8 = 0
 	TLVRelay   uint8 = 1
+	TLVAuthor  uint8 = 2
 )
 
 func readTLVEntry(data []byte) (typ uint8, value []byte) {
@@ -16,6 +17,10 @@ func readTLVEntry(data []byte) (typ uint8, value []byte) {
 
 	typ = data[0]
 	length := int(data[1])
+	if len(data) < 2+length {
+		// truncated entry
+		return 0, nil
+	}
 	value = data[2 : 2+length]
 	return
 }
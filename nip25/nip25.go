@@ -0,0 +1,49 @@
+package nip25
+
+import (
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CreateUnsignedReaction creates a kind 7 reaction from pubkey to target, with content "+"
+// for a like, "-" for a dislike or an emoji.
+// As NIP-25 says, the "e" and "p" tags of target are kept, so the people in the thread get
+// notified, and the id and the author of target are tagged last.
+func CreateUnsignedReaction(pubkey string, target *nostr.Event, content string) nostr.Event {
+	tags := make(nostr.Tags, 0, len(target.Tags)+2)
+	for _, tag := range target.Tags {
+		if len(tag) >= 2 && (tag[0] == "e" || tag[0] == "p") {
+			tags = append(tags, append(nostr.Tag(nil), tag...))
+		}
+	}
+	tags = append(tags, nostr.Tag{"e", target.ID}, nostr.Tag{"p", target.PubKey})
+
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindReaction,
+		Tags:      tags,
+		Content:   content,
+	}
+}
+
+// GetReactedEvent returns a pointer to the event reaction reacts to, made of the last "e"
+// tag, with its relay hint if any, and the last "p" tag of reaction. It returns nil if
+// reaction isn't a kind 7 event or has no "e" tag.
+func GetReactedEvent(reaction *nostr.Event) *nostr.EventPointer {
+	if reaction.Kind != nostr.KindReaction {
+		return nil
+	}
+	e := reaction.Tags.GetLast([]string{"e", ""})
+	if e == nil {
+		return nil
+	}
+
+	pointer := &nostr.EventPointer{ID: e.Value()}
+	if len(*e) >= 3 && (*e)[2] != "" {
+		pointer.Relays = []string{(*e)[2]}
+	}
+	if p := reaction.Tags.GetLast([]string{"p", ""}); p != nil {
+		pointer.Author = p.Value()
+	}
+	return pointer
+}
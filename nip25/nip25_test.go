@@ -0,0 +1,84 @@
+package nip25
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReaction(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	author := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	mentioned := "52b4a076bcbbbdc3a1aefa3735816cf74993b1b8db202b01c883c58be7fad8bd"
+	root := "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"
+
+	// a reply that already has "e" and "p" tags of its own
+	reply := nostr.Event{
+		ID:     "f3b4d2a6c0d5b8e1a2f4c6d8e0b2a4c6e8f0a2b4c6d8e0f2a4b6c8d0e2f4a6b8",
+		PubKey: author,
+		Kind:   nostr.KindTextNote,
+		Tags: nostr.Tags{
+			nostr.Tag{"e", root, "wss://relay.example.com", "root"},
+			nostr.Tag{"p", mentioned},
+			nostr.Tag{"t", "nostr"},
+		},
+		Content: "indeed",
+	}
+
+	reaction := CreateUnsignedReaction(pk, &reply, "🤙")
+	if err := reaction.Sign(sk); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	if reaction.Kind != nostr.KindReaction || reaction.Content != "🤙" {
+		t.Errorf("unexpected reaction event %v", reaction)
+	}
+	if len(reaction.Tags) != 4 || reaction.Tags.GetFirst([]string{"t", ""}) != nil {
+		t.Errorf("reaction has tags %v; want the e and p tags of the reply and two more", reaction.Tags)
+	}
+
+	// only the last "e" and "p" tags point to the event reacted to
+	pointer := GetReactedEvent(&reaction)
+	if pointer == nil || pointer.ID != reply.ID || pointer.Author != author || pointer.Relays != nil {
+		t.Errorf("GetReactedEvent returned %+v; want %s by %s", pointer, reply.ID, author)
+	}
+
+	// the tags of the reply are copied, not shared
+	reaction.Tags[0][1] = "changed"
+	if reply.Tags[0][1] != root {
+		t.Error("changing the reaction tags changed the reply")
+	}
+}
+
+func TestGetReactedEvent(t *testing.T) {
+	for name, tc := range map[string]struct {
+		event nostr.Event
+		want  *nostr.EventPointer
+	}{
+		"relay hint": {
+			nostr.Event{Kind: nostr.KindReaction, Tags: nostr.Tags{nostr.Tag{"e", "aa", "wss://relay.example.com"}, nostr.Tag{"p", "bb"}}},
+			&nostr.EventPointer{ID: "aa", Relays: []string{"wss://relay.example.com"}, Author: "bb"},
+		},
+		"no p tag": {
+			nostr.Event{Kind: nostr.KindReaction, Tags: nostr.Tags{nostr.Tag{"e", "aa"}}},
+			&nostr.EventPointer{ID: "aa"},
+		},
+		"no e tag": {
+			nostr.Event{Kind: nostr.KindReaction, Tags: nostr.Tags{nostr.Tag{"p", "bb"}}},
+			nil,
+		},
+		"not a reaction": {
+			nostr.Event{Kind: nostr.KindTextNote, Tags: nostr.Tags{nostr.Tag{"e", "aa"}}},
+			nil,
+		},
+	} {
+		got := GetReactedEvent(&tc.event)
+		if (got == nil) != (tc.want == nil) {
+			t.Errorf("%s: GetReactedEvent returned %+v; want %+v", name, got, tc.want)
+			continue
+		}
+		if got != nil && (got.ID != tc.want.ID || got.Author != tc.want.Author || len(got.Relays) != len(tc.want.Relays)) {
+			t.Errorf("%s: GetReactedEvent returned %+v; want %+v", name, got, tc.want)
+		}
+	}
+}
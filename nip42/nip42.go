@@ -13,8 +13,8 @@ import (
 func CreateUnsignedAuthEvent(challenge, pubkey, relayURL string) nostr.Event {
 	return nostr.Event{
 		PubKey:    pubkey,
-		CreatedAt: time.Now(),
-		Kind:      22242,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindClientAuthentication,
 		Tags: nostr.Tags{
 			nostr.Tag{"relay", relayURL},
 			nostr.Tag{"challenge", challenge},
@@ -35,7 +35,7 @@ func parseUrl(input string) (*url.URL, error) {
 // ValidateAuthEvent checks whether event is a valid NIP-42 event for given challenge and relayURL.
 // The result of the validation is encoded in the ok bool.
 func ValidateAuthEvent(event *nostr.Event, challenge string, relayURL string) (pubkey string, ok bool) {
-	if event.Kind != 22242 {
+	if event.Kind != nostr.KindClientAuthentication {
 		return "", false
 	}
 
@@ -59,7 +59,7 @@ func ValidateAuthEvent(event *nostr.Event, challenge string, relayURL string) (p
 		return "", false
 	}
 
-	now := time.Now()
+	now := nostr.Now()
 	if event.CreatedAt.After(now.Add(10*time.Minute)) || event.CreatedAt.Before(now.Add(-10*time.Minute)) {
 		return "", false
 	}
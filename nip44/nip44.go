@@ -0,0 +1,190 @@
+package nip44
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+const version = 2
+
+const (
+	minPlaintextSize = 1
+	maxPlaintextSize = 65535
+)
+
+// ErrDecrypt is returned by Decrypt when the payload was not encrypted with the conversation
+// key or was tampered with, as opposed to malformed.
+var ErrDecrypt = errors.New("invalid MAC")
+
+// GetConversationKey returns the key used to encrypt and decrypt the messages between the
+// owners of the hex encoded private key sk and public key pub, which is the same from both
+// sides: GetConversationKey(skA, pubB) == GetConversationKey(skB, pubA).
+// It is HKDF-extract, with "nip44-v2" as salt, of the x coordinate of their ECDH point.
+func GetConversationKey(sk string, pub string) ([32]byte, error) {
+	var key [32]byte
+
+	privKeyBytes, err := hex.DecodeString(sk)
+	if err != nil || len(privKeyBytes) != 32 {
+		return key, fmt.Errorf("invalid private key")
+	}
+	// PrivKeyFromBytes reduces it mod n, making 0 and n valid keys with a known shared point
+	var scalar btcec.ModNScalar
+	if overflow := scalar.SetByteSlice(privKeyBytes); overflow || scalar.IsZero() {
+		return key, fmt.Errorf("invalid private key: not between 1 and the curve order")
+	}
+	privKey, _ := btcec.PrivKeyFromBytes(privKeyBytes)
+
+	// public keys are x-only, 02 makes it a compressed one with an even y, which fails to
+	// parse if there is no point with that x
+	pubKeyBytes, err := hex.DecodeString("02" + pub)
+	if err != nil || len(pubKeyBytes) != 33 {
+		return key, fmt.Errorf("invalid public key '%s'", pub)
+	}
+	pubKey, err := btcec.ParsePubKey(pubKeyBytes)
+	if err != nil {
+		return key, fmt.Errorf("invalid public key '%s': %w", pub, err)
+	}
+
+	shared := btcec.GenerateSharedSecret(privKey, pubKey)
+	copy(key[:], hkdf.Extract(sha256.New, shared, []byte("nip44-v2")))
+	return key, nil
+}
+
+// Encrypt encrypts plaintext, which must be between 1 and 65535 bytes long, with
+// conversationKey (see GetConversationKey) as in version 2 of NIP-44: padded to hide its
+// exact length, encrypted with ChaCha20 and authenticated with HMAC-SHA256, using keys
+// derived from conversationKey and a random nonce.
+// Returns base64(version || nonce || ciphertext || mac).
+func Encrypt(conversationKey [32]byte, plaintext string) (string, error) {
+	var nonce [32]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return encrypt(conversationKey, plaintext, nonce)
+}
+
+func encrypt(conversationKey [32]byte, plaintext string, nonce [32]byte) (string, error) {
+	size := len(plaintext)
+	if size < minPlaintextSize || size > maxPlaintextSize {
+		return "", fmt.Errorf("plaintext has %d bytes, not between %d and %d", size, minPlaintextSize, maxPlaintextSize)
+	}
+
+	padded := make([]byte, 2+paddedLen(size))
+	binary.BigEndian.PutUint16(padded, uint16(size))
+	copy(padded[2:], plaintext)
+	return seal(conversationKey, nonce, padded)
+}
+
+// seal encrypts and authenticates the padded plaintext, returning the payload.
+func seal(conversationKey [32]byte, nonce [32]byte, padded []byte) (string, error) {
+	chachaKey, chachaNonce, hmacKey, err := messageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := make([]byte, len(padded))
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	cipher.XORKeyStream(ciphertext, padded)
+
+	payload := make([]byte, 0, 1+32+len(ciphertext)+32)
+	payload = append(payload, version)
+	payload = append(payload, nonce[:]...)
+	payload = append(payload, ciphertext...)
+	payload = append(payload, mac(hmacKey, nonce, ciphertext)...)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// Decrypt decrypts a payload made by Encrypt with the same conversationKey.
+func Decrypt(conversationKey [32]byte, payload string) (string, error) {
+	size := len(payload)
+	if size == 0 || payload[0] == '#' {
+		return "", fmt.Errorf("unknown encryption version")
+	}
+	if size < 132 || size > 87472 {
+		return "", fmt.Errorf("payload has %d characters, not between 132 and 87472", size)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("payload is not base64: %w", err)
+	}
+	if len(data) < 99 || len(data) > 65603 {
+		return "", fmt.Errorf("payload has %d bytes, not between 99 and 65603", len(data))
+	}
+	if data[0] != version {
+		return "", fmt.Errorf("unknown encryption version %d", data[0])
+	}
+
+	var nonce [32]byte
+	copy(nonce[:], data[1:33])
+	ciphertext := data[33 : len(data)-32]
+	givenMAC := data[len(data)-32:]
+
+	chachaKey, chachaNonce, hmacKey, err := messageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(givenMAC, mac(hmacKey, nonce, ciphertext)) {
+		return "", ErrDecrypt
+	}
+
+	padded := make([]byte, len(ciphertext))
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	cipher.XORKeyStream(padded, ciphertext)
+
+	unpaddedLen := int(binary.BigEndian.Uint16(padded))
+	if unpaddedLen < minPlaintextSize || len(padded) != 2+paddedLen(unpaddedLen) {
+		return "", fmt.Errorf("invalid padding")
+	}
+	return string(padded[2 : 2+unpaddedLen]), nil
+}
+
+// messageKeys derives the ChaCha20 key and nonce and the HMAC key for a message from
+// conversationKey and its nonce, with HKDF-expand.
+func messageKeys(conversationKey [32]byte, nonce [32]byte) (chachaKey, chachaNonce, hmacKey []byte, err error) {
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey[:], nonce[:]), keys); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to derive message keys: %w", err)
+	}
+	return keys[0:32], keys[32:44], keys[44:76], nil
+}
+
+// mac is the HMAC-SHA256 of ciphertext with the nonce as associated data.
+func mac(hmacKey []byte, nonce [32]byte, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(nonce[:])
+	h.Write(ciphertext)
+	return h.Sum(nil)
+}
+
+// paddedLen returns the size a plaintext of size bytes is padded to: at least 32 bytes,
+// then in chunks of 32 bytes up to 256 and of an eighth of the next power of two above that.
+func paddedLen(size int) int {
+	if size <= 32 {
+		return 32
+	}
+	nextPower := 1 << bits.Len(uint(size-1))
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((size-1)/chunk + 1)
+}
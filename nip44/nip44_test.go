@@ -0,0 +1,267 @@
+package nip44
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// vectors from https://github.com/paulmillr/nip44/blob/main/nip44.vectors.json
+func TestConversationKeyVectors(t *testing.T) {
+	for _, v := range []struct {
+		sec1, pub2, conversationKey string
+	}{
+		{
+			"315e59ff51cb9209768cf7da80791ddcaae56ac9775eb25b6dee1234bc5d2268",
+			"c2f9d9948dc8c7c38321e4b85c8558872eafa0641cd269db76848a6073e69133",
+			"3dfef0ce2a4d80a25e7a328accf73448ef67096f65f79588e358d9a0eb9013f1",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5",
+			"c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d",
+		},
+	} {
+		key, err := GetConversationKey(v.sec1, v.pub2)
+		if err != nil {
+			t.Fatalf("GetConversationKey: %v", err)
+		}
+		if got := hex.EncodeToString(key[:]); got != v.conversationKey {
+			t.Errorf("conversation key of %s and %s is %s; want %s", v.sec1, v.pub2, got, v.conversationKey)
+		}
+	}
+}
+
+func TestConversationKeyInvalidVectors(t *testing.T) {
+	for _, v := range []struct {
+		sec1, pub2, note string
+	}{
+		{
+			"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+			"1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcdef",
+			"sec1 higher than curve.n",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcdef",
+			"sec1 is 0",
+		},
+		{
+			"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364139",
+			"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+			"pub2 is invalid, no sqrt, all-ff",
+		},
+		{
+			"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141",
+			"1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcdef",
+			"sec1 == curve.n",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000002",
+			"1234567890abcdef1234567890abcdef1234567890abcdef1234567890abcdef",
+			"pub2 is invalid, no sqrt",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000002",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"pub2 is 0",
+		},
+	} {
+		if key, err := GetConversationKey(v.sec1, v.pub2); err == nil {
+			t.Errorf("%s: got conversation key %x; want an error", v.note, key)
+		}
+	}
+}
+
+func TestEncryptVectors(t *testing.T) {
+	for _, v := range []struct {
+		sec1, sec2, nonce, plaintext, payload string
+	}{
+		{
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"0000000000000000000000000000000000000000000000000000000000000002",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"a",
+			"AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb",
+		},
+		{
+			"0000000000000000000000000000000000000000000000000000000000000002",
+			"0000000000000000000000000000000000000000000000000000000000000001",
+			"f00000000000000000000000000000f00000000000000000000000000000000f",
+			"🍕🫃",
+			"AvAAAAAAAAAAAAAAAAAAAPAAAAAAAAAAAAAAAAAAAAAPSKSK6is9ngkX2+cSq85Th16oRTISAOfhStnixqZziKMDvB0QQzgFZdjLTPicCJaV8nDITO+QfaQ61+KbWQIOO2Yj",
+		},
+	} {
+		pub2, _ := nostr.GetPublicKey(v.sec2)
+		key, err := GetConversationKey(v.sec1, pub2)
+		if err != nil {
+			t.Fatalf("GetConversationKey: %v", err)
+		}
+		var nonce [32]byte
+		hex.Decode(nonce[:], []byte(v.nonce))
+
+		payload, err := encrypt(key, v.plaintext, nonce)
+		if err != nil {
+			t.Fatalf("encrypt: %v", err)
+		}
+		if payload != v.payload {
+			t.Errorf("payload of %q is %s; want %s", v.plaintext, payload, v.payload)
+		}
+
+		// the other side gets the same key
+		pub1, _ := nostr.GetPublicKey(v.sec1)
+		otherKey, _ := GetConversationKey(v.sec2, pub1)
+		plaintext, err := Decrypt(otherKey, v.payload)
+		if err != nil {
+			t.Fatalf("Decrypt: %v", err)
+		}
+		if plaintext != v.plaintext {
+			t.Errorf("decrypted %q; want %q", plaintext, v.plaintext)
+		}
+	}
+}
+
+func TestEncryptLongMessageVectors(t *testing.T) {
+	for _, v := range []struct {
+		conversationKey, nonce, pattern string
+		repeat                          int
+		plaintextSHA256, payloadSHA256  string
+	}{
+		{
+			"8fc262099ce0d0bb9b89bac05bb9e04f9bc0090acc181fef6840ccee470371ed",
+			"326bcb2c943cd6bb717588c9e5a7e738edf6ed14ec5f5344caa6ef56f0b9cff7",
+			"x", 65535,
+			"09ab7495d3e61a76f0deb12cb0306f0696cbb17ffc12131368c7a939f12f56d3",
+			"90714492225faba06310bff2f249ebdc2a5e609d65a629f1c87f2d4ffc55330a",
+		},
+		{
+			"56adbe3720339363ab9c3b8526ffce9fd77600927488bfc4b59f7a68ffe5eae0",
+			"ad68da81833c2a8ff609c3d2c0335fd44fe5954f85bb580c6a8d467aa9fc5dd0",
+			"!", 65535,
+			"6af297793b72ae092c422e552c3bb3cbc310da274bd1cf9e31023a7fe4a2d75e",
+			"8013e45a109fad3362133132b460a2d5bce235fe71c8b8f4014793fb52a49844",
+		},
+		{
+			"7fc540779979e472bb8d12480b443d1e5eb1098eae546ef2390bee499bbf46be",
+			"34905e82105c20de9a2f6cd385a0d541e6bcc10601d12481ff3a7575dc622033",
+			"🦄", 16383,
+			"a249558d161b77297bc0cb311dde7d77190f6571b25c7e4429cd19044634a61f",
+			"b3348422471da1f3c59d79acfe2fe103f3cd24488109e5b18734cdb5953afd15",
+		},
+	} {
+		var key, nonce [32]byte
+		hex.Decode(key[:], []byte(v.conversationKey))
+		hex.Decode(nonce[:], []byte(v.nonce))
+		plaintext := strings.Repeat(v.pattern, v.repeat)
+		if sum := sha256.Sum256([]byte(plaintext)); hex.EncodeToString(sum[:]) != v.plaintextSHA256 {
+			t.Fatalf("plaintext of %d %q has the wrong hash", v.repeat, v.pattern)
+		}
+
+		payload, err := encrypt(key, plaintext, nonce)
+		if err != nil {
+			t.Fatalf("encrypt: %v", err)
+		}
+		if sum := sha256.Sum256([]byte(payload)); hex.EncodeToString(sum[:]) != v.payloadSHA256 {
+			t.Errorf("payload of %d %q has hash %x; want %s", v.repeat, v.pattern, sum, v.payloadSHA256)
+		}
+		if decrypted, err := Decrypt(key, payload); err != nil || decrypted != plaintext {
+			t.Errorf("failed to decrypt %d %q: %v", v.repeat, v.pattern, err)
+		}
+	}
+}
+
+func TestPaddedLen(t *testing.T) {
+	for _, v := range [][2]int{
+		{16, 32}, {32, 32}, {33, 64}, {37, 64}, {45, 64}, {49, 64}, {64, 64}, {65, 96},
+		{100, 128}, {111, 128}, {200, 224}, {250, 256}, {320, 320}, {383, 384}, {384, 384},
+		{400, 448}, {500, 512}, {512, 512}, {515, 640}, {700, 768}, {800, 896}, {900, 1024},
+		{1020, 1024}, {65536, 65536},
+	} {
+		if got := paddedLen(v[0]); got != v[1] {
+			t.Errorf("paddedLen(%d) = %d; want %d", v[0], got, v[1])
+		}
+	}
+}
+
+func TestEncryptionAndDecryptionWithMultipleLengths(t *testing.T) {
+	sk1, sk2 := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	pub2, _ := nostr.GetPublicKey(sk2)
+	key, err := GetConversationKey(sk1, pub2)
+	if err != nil {
+		t.Fatalf("GetConversationKey: %v", err)
+	}
+
+	for _, size := range []int{1, 31, 32, 33, 255, 256, 257, 1000, 65535} {
+		message := strings.Repeat("x", size)
+		payload, err := Encrypt(key, message)
+		if err != nil {
+			t.Fatalf("failed to encrypt %d bytes: %v", size, err)
+		}
+		plaintext, err := Decrypt(key, payload)
+		if err != nil {
+			t.Fatalf("failed to decrypt %d bytes: %v", size, err)
+		}
+		if plaintext != message {
+			t.Errorf("decrypted message of %d bytes differs", size)
+		}
+	}
+
+	for _, size := range []int{0, 65536} {
+		if _, err := Encrypt(key, strings.Repeat("x", size)); err == nil {
+			t.Errorf("encrypted a message of %d bytes", size)
+		}
+	}
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	sk1, sk2 := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	pub2, _ := nostr.GetPublicKey(sk2)
+	key, _ := GetConversationKey(sk1, pub2)
+	payload, _ := Encrypt(key, "hello")
+
+	data, _ := base64.StdEncoding.DecodeString(payload)
+	data[40] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(data)
+	data[40] ^= 1
+	data[0] = 0
+	oldVersion := base64.StdEncoding.EncodeToString(data)
+
+	otherKey, _ := GetConversationKey(sk2, pub2)
+	if _, err := Decrypt(otherKey, payload); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("decrypting with the wrong key returned %v; want ErrDecrypt", err)
+	}
+	if _, err := Decrypt(key, tampered); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("decrypting a tampered payload returned %v; want ErrDecrypt", err)
+	}
+
+	// authenticated payloads whose padding is wrong
+	var nonce [32]byte
+	padding := func(unpaddedLen uint16, size int) string {
+		padded := make([]byte, size)
+		binary.BigEndian.PutUint16(padded, unpaddedLen)
+		sealed, _ := seal(key, nonce, padded)
+		return sealed
+	}
+
+	for name, invalid := range map[string]string{
+		"unknown version":          "#" + payload[1:],
+		"version 0":                oldVersion,
+		"invalid base64":           "Atф" + payload[3:],
+		"too short":                payload[:131],
+		"too long":                 strings.Repeat("A", 87473),
+		"unpadded length 0":        padding(0, 2+32),
+		"unpadded length too long": padding(33, 2+32),
+		"padded length too long":   padding(5, 2+64),
+		"padded length too short":  padding(40, 2+32),
+	} {
+		if _, err := Decrypt(key, invalid); err == nil || errors.Is(err, ErrDecrypt) {
+			t.Errorf("decrypting a payload with %s returned %v", name, err)
+		}
+	}
+}
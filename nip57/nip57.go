@@ -0,0 +1,111 @@
+package nip57
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CreateUnsignedZapRequest creates a kind 9734 zap request of amount millisatoshis from pubkey
+// to recipient. Once signed, it is sent to the LNURL server of the recipient (lnurl is its
+// bech32 encoded url), which publishes the zap receipt to relays.
+// eventID is optional: if given, the zap is for that event instead of just for the recipient.
+func CreateUnsignedZapRequest(pubkey, recipient string, amount int64, relays []string, lnurl, eventID, content string) nostr.Event {
+	tags := nostr.Tags{
+		append(nostr.Tag{"relays"}, relays...),
+		nostr.Tag{"amount", strconv.FormatInt(amount, 10)},
+		nostr.Tag{"lnurl", lnurl},
+		nostr.Tag{"p", recipient},
+	}
+	if eventID != "" {
+		tags = append(tags, nostr.Tag{"e", eventID})
+	}
+
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindZapRequest,
+		Tags:      tags,
+		Content:   content,
+	}
+}
+
+// ValidateZapRequest checks whether request is a signed zap request with exactly one "p" tag,
+// at most one "e" tag and a "relays" tag, as a LNURL server must do before accepting it.
+func ValidateZapRequest(request *nostr.Event) error {
+	if request.Kind != nostr.KindZapRequest {
+		return fmt.Errorf("zap request has kind %d", request.Kind)
+	}
+	if ok, err := request.CheckSignature(); !ok {
+		return fmt.Errorf("zap request has an invalid signature: %v", err)
+	}
+	if n := len(request.Tags.GetAll([]string{"p", ""})); n != 1 {
+		return fmt.Errorf("zap request has %d \"p\" tags", n)
+	}
+	if n := len(request.Tags.GetAll([]string{"e", ""})); n > 1 {
+		return fmt.Errorf("zap request has %d \"e\" tags", n)
+	}
+	if request.Tags.GetFirst([]string{"relays"}) == nil {
+		return fmt.Errorf("zap request has no \"relays\" tag")
+	}
+	if amount := request.Tags.GetFirst([]string{"amount", ""}); amount != nil {
+		if _, err := strconv.ParseInt(amount.Value(), 10, 64); err != nil {
+			return fmt.Errorf("zap request has an invalid amount '%s'", amount.Value())
+		}
+	}
+	return nil
+}
+
+// GetZapRequest returns the zap request embedded in the "description" tag of receipt.
+func GetZapRequest(receipt *nostr.Event) (*nostr.Event, error) {
+	description := receipt.Tags.GetFirst([]string{"description", ""})
+	if description == nil {
+		return nil, fmt.Errorf("zap receipt has no \"description\" tag")
+	}
+	var request nostr.Event
+	if err := json.Unmarshal([]byte(description.Value()), &request); err != nil {
+		return nil, fmt.Errorf("zap receipt description is not an event: %w", err)
+	}
+	return &request, nil
+}
+
+// ValidateZapReceipt checks whether receipt is a kind 9735 zap receipt for request, signed by
+// serverPubKey, which is the "nostrPubkey" advertised by the LNURL server of the recipient.
+// This doesn't check the invoice in the "bolt11" tag, only that it is there.
+func ValidateZapReceipt(receipt *nostr.Event, request *nostr.Event, serverPubKey string) error {
+	if receipt.Kind != nostr.KindZap {
+		return fmt.Errorf("zap receipt has kind %d", receipt.Kind)
+	}
+	if receipt.PubKey != serverPubKey {
+		return fmt.Errorf("zap receipt is from %s, not from the LNURL server %s", receipt.PubKey, serverPubKey)
+	}
+	if receipt.Tags.GetFirst([]string{"bolt11", ""}) == nil {
+		return fmt.Errorf("zap receipt has no \"bolt11\" tag")
+	}
+
+	embedded, err := GetZapRequest(receipt)
+	if err != nil {
+		return err
+	}
+	if embedded.ID != request.ID || !embedded.CheckID() {
+		return fmt.Errorf("zap receipt description doesn't match zap request %s", request.ID)
+	}
+
+	recipient := request.Tags.GetFirst([]string{"p", ""})
+	if recipient == nil || receipt.Tags.GetFirst([]string{"p", recipient.Value()}) == nil {
+		return fmt.Errorf("zap receipt is not for the recipient of the zap request")
+	}
+	if event := request.Tags.GetFirst([]string{"e", ""}); event != nil {
+		if receipt.Tags.GetFirst([]string{"e", event.Value()}) == nil {
+			return fmt.Errorf("zap receipt is not for the event of the zap request")
+		}
+	}
+
+	// save for last, as it is most expensive operation
+	if ok, err := receipt.CheckSignature(); !ok {
+		return fmt.Errorf("zap receipt has an invalid signature: %v", err)
+	}
+	return nil
+}
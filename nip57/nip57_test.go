@@ -0,0 +1,95 @@
+package nip57
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestZapRequestAndReceipt(t *testing.T) {
+	senderKey, serverKey := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	serverPubKey, _ := nostr.GetPublicKey(serverKey)
+	recipient := "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	eventID := "dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"
+
+	request := CreateUnsignedZapRequest("", recipient, 21000, []string{"wss://relay.example.com"}, "lnurl1dp68gurn8ghj7", eventID, "great post")
+	if err := request.Sign(senderKey); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := ValidateZapRequest(&request); err != nil {
+		t.Errorf("ValidateZapRequest: %v", err)
+	}
+	if amount := request.Tags.GetFirst([]string{"amount", ""}).Value(); amount != "21000" {
+		t.Errorf("zap request amount is %s; want 21000", amount)
+	}
+
+	description, _ := json.Marshal(request)
+	receipt := nostr.Event{
+		Kind: nostr.KindZap,
+		Tags: nostr.Tags{
+			nostr.Tag{"p", recipient},
+			nostr.Tag{"e", eventID},
+			nostr.Tag{"bolt11", "lnbc210n1..."},
+			nostr.Tag{"description", string(description)},
+		},
+	}
+	if err := receipt.Sign(serverKey); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := ValidateZapReceipt(&receipt, &request, serverPubKey); err != nil {
+		t.Errorf("ValidateZapReceipt: %v", err)
+	}
+	if embedded, err := GetZapRequest(&receipt); err != nil || embedded.ID != request.ID {
+		t.Errorf("GetZapRequest returned %v, %v; want the zap request", embedded, err)
+	}
+
+	// a receipt from anyone but the LNURL server is rejected
+	if err := ValidateZapReceipt(&receipt, &request, recipient); err == nil {
+		t.Error("ValidateZapReceipt accepted a receipt from the wrong pubkey")
+	}
+
+	// so is one for another zap request
+	other := CreateUnsignedZapRequest("", recipient, 1000, []string{"wss://relay.example.com"}, "lnurl1dp68gurn8ghj7", "", "")
+	if err := other.Sign(senderKey); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := ValidateZapReceipt(&receipt, &other, serverPubKey); err == nil {
+		t.Error("ValidateZapReceipt accepted a receipt for another zap request")
+	}
+
+	// and one whose description was tampered with
+	tampered := receipt
+	tampered.Tags = nostr.Tags{receipt.Tags[0], receipt.Tags[1], receipt.Tags[2],
+		nostr.Tag{"description", string(description[:len(description)-1]) + `,"content":"x"}`}}
+	if err := tampered.Sign(serverKey); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := ValidateZapReceipt(&tampered, &request, serverPubKey); err == nil {
+		t.Error("ValidateZapReceipt accepted a receipt with a tampered description")
+	}
+}
+
+func TestValidateZapRequestInvalid(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	for name, tags := range map[string]nostr.Tags{
+		"no p tag":       {nostr.Tag{"relays", "wss://relay.example.com"}},
+		"two p tags":     {nostr.Tag{"relays", "wss://relay.example.com"}, nostr.Tag{"p", "aa"}, nostr.Tag{"p", "bb"}},
+		"two e tags":     {nostr.Tag{"relays", "wss://relay.example.com"}, nostr.Tag{"p", "aa"}, nostr.Tag{"e", "cc"}, nostr.Tag{"e", "dd"}},
+		"no relays tag":  {nostr.Tag{"p", "aa"}},
+		"invalid amount": {nostr.Tag{"relays", "wss://relay.example.com"}, nostr.Tag{"p", "aa"}, nostr.Tag{"amount", "lots"}},
+	} {
+		request := nostr.Event{Kind: nostr.KindZapRequest, Tags: tags}
+		if err := request.Sign(sk); err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		if err := ValidateZapRequest(&request); err == nil {
+			t.Errorf("ValidateZapRequest accepted a zap request with %s", name)
+		}
+	}
+
+	unsigned := CreateUnsignedZapRequest("aa", "bb", 1000, nil, "", "", "")
+	if err := ValidateZapRequest(&unsigned); err == nil {
+		t.Error("ValidateZapRequest accepted an unsigned zap request")
+	}
+}
@@ -0,0 +1,185 @@
+package nip65
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RelayListEntry is a relay of a kind 10002 relay list. An "r" tag without a marker means
+// the relay is used for both reading and writing.
+type RelayListEntry struct {
+	URL   string
+	Read  bool
+	Write bool
+}
+
+// CreateUnsignedRelayList creates a kind 10002 event listing the relays pubkey reads from
+// and writes to, marking the ones used only for one of them.
+func CreateUnsignedRelayList(pubkey string, entries []RelayListEntry) nostr.Event {
+	tags := make(nostr.Tags, 0, len(entries))
+	for _, entry := range entries {
+		switch {
+		case entry.Read && entry.Write:
+			tags = append(tags, nostr.Tag{"r", entry.URL})
+		case entry.Read:
+			tags = append(tags, nostr.Tag{"r", entry.URL, "read"})
+		case entry.Write:
+			tags = append(tags, nostr.Tag{"r", entry.URL, "write"})
+		}
+	}
+
+	return nostr.Event{
+		PubKey:    pubkey,
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindRelayList,
+		Tags:      tags,
+	}
+}
+
+// ParseRelayList returns the relays in the "r" tags of event, which should be a kind 10002
+// relay list, in the order they are listed and with normalized URLs. Invalid URLs and
+// unknown markers are skipped; a relay listed more than once gets the markers of all its
+// tags combined.
+func ParseRelayList(event *nostr.Event) []RelayListEntry {
+	var entries []RelayListEntry
+	index := make(map[string]int)
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		url := nostr.NormalizeURL(tag[1])
+		if url == "" {
+			continue
+		}
+
+		entry := RelayListEntry{URL: url}
+		if len(tag) < 3 || tag[2] == "" {
+			entry.Read, entry.Write = true, true
+		} else if tag[2] == "read" {
+			entry.Read = true
+		} else if tag[2] == "write" {
+			entry.Write = true
+		} else {
+			continue
+		}
+
+		if i, ok := index[url]; ok {
+			entries[i].Read = entries[i].Read || entry.Read
+			entries[i].Write = entries[i].Write || entry.Write
+			continue
+		}
+		index[url] = len(entries)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// ReadRelays returns the URLs of the entries marked for reading, where the author of the
+// relay list expects to be mentioned.
+func ReadRelays(entries []RelayListEntry) []string {
+	var urls []string
+	for _, entry := range entries {
+		if entry.Read {
+			urls = append(urls, entry.URL)
+		}
+	}
+	return urls
+}
+
+// WriteRelays returns the URLs of the entries marked for writing, where the author of the
+// relay list publishes their events.
+func WriteRelays(entries []RelayListEntry) []string {
+	var urls []string
+	for _, entry := range entries {
+		if entry.Write {
+			urls = append(urls, entry.URL)
+		}
+	}
+	return urls
+}
+
+// SubscribeOutbox subscribes with filters, restricted to the events of the author of
+// relayList, on the write relays of that relay list only (the "outbox model" of NIP-65),
+// using RelayPool.SubOn. Write relays that aren't in pool yet are added to it for reading;
+// the ones that can't be connected to before ctx is done, or that pool doesn't read from
+// for the author, are skipped. As with SubOn, cancelling ctx closes the subscription.
+func SubscribeOutbox(ctx context.Context, pool *nostr.RelayPool, relayList *nostr.Event, filters nostr.Filters) (*nostr.PoolSubscription, error) {
+	author := relayList.PubKey
+	outbox := WriteRelays(ParseRelayList(relayList))
+	if len(outbox) == 0 {
+		return nil, fmt.Errorf("relay list of %s has no write relays", author)
+	}
+
+	missing := make(map[string]*nostr.Policy)
+	for _, url := range outbox {
+		missing[url] = &nostr.Policy{Read: true}
+	}
+	for _, status := range pool.List() {
+		delete(missing, status.URL)
+	}
+	pool.AddAll(ctx, missing)
+
+	readable := make(map[string]bool)
+	for _, status := range pool.List() {
+		specific, ok := status.Policy.ReadSpecific[author]
+		readable[status.URL] = ok && specific.Read || !ok && status.Policy.Read
+	}
+	var relays []string
+	for _, url := range outbox {
+		if readable[url] {
+			relays = append(relays, url)
+		}
+	}
+	if len(relays) == 0 {
+		return nil, nostr.ErrNoReadRelays
+	}
+
+	authored := make(nostr.Filters, len(filters))
+	for i, filter := range filters {
+		filter.Authors = []string{author}
+		authored[i] = filter
+	}
+	return pool.SubOn(ctx, relays, authored)
+}
+
+// PublishOutbox publishes event to the write relays of relayList, which should be the relay
+// list of its author, using RelayPool.PublishTo, and returns the results keyed by relay URL.
+// Write relays that aren't in pool yet are added to it for writing; the ones that can't be
+// connected to, or that pool doesn't write to, are reported as failed.
+func PublishOutbox(ctx context.Context, pool *nostr.RelayPool, relayList *nostr.Event, event nostr.Event) map[string]nostr.PublishStatus {
+	outbox := WriteRelays(ParseRelayList(relayList))
+
+	missing := make(map[string]*nostr.Policy)
+	for _, url := range outbox {
+		missing[url] = &nostr.Policy{Write: true}
+	}
+	for _, status := range pool.List() {
+		delete(missing, status.URL)
+	}
+	pool.AddAll(ctx, missing)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]nostr.PublishStatus, len(outbox))
+	)
+	for _, url := range outbox {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			status, err := pool.PublishTo(ctx, url, event)
+			if err != nil {
+				status = nostr.PublishStatus{Relay: url, Status: nostr.PublishStatusFailed, Message: err.Error()}
+			}
+			mu.Lock()
+			results[url] = status
+			mu.Unlock()
+		}(url)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,105 @@
+package nip65
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/relaytest"
+)
+
+func TestParseRelayList(t *testing.T) {
+	event := nostr.Event{
+		Kind: nostr.KindRelayList,
+		Tags: nostr.Tags{
+			nostr.Tag{"r", "wss://both.example.com"},
+			nostr.Tag{"r", "wss://read.example.com/", "read"},
+			nostr.Tag{"r", "WSS://Write.example.com", "write"},
+			nostr.Tag{"r", "wss://read.example.com", "write"},
+			nostr.Tag{"r", "wss://unknown.example.com", "sometimes"},
+			nostr.Tag{"r", "not a url"},
+			nostr.Tag{"p", "wss://p.example.com"},
+		},
+	}
+	want := []RelayListEntry{
+		{URL: "wss://both.example.com", Read: true, Write: true},
+		{URL: "wss://read.example.com", Read: true, Write: true},
+		{URL: "wss://write.example.com", Write: true},
+	}
+	entries := ParseRelayList(&event)
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("ParseRelayList returned %+v; want %+v", entries, want)
+	}
+
+	// and back
+	list := CreateUnsignedRelayList("abc", want)
+	if list.Kind != nostr.KindRelayList || list.PubKey != "abc" {
+		t.Errorf("relay list has kind %d and pubkey %q", list.Kind, list.PubKey)
+	}
+	if entries := ParseRelayList(&list); !reflect.DeepEqual(entries, want) {
+		t.Errorf("ParseRelayList of CreateUnsignedRelayList returned %+v; want %+v", entries, want)
+	}
+	if urls := WriteRelays(want); len(urls) != 3 {
+		t.Errorf("WriteRelays returned %v", urls)
+	}
+	if urls := ReadRelays(want); !reflect.DeepEqual(urls, []string{"wss://both.example.com", "wss://read.example.com"}) {
+		t.Errorf("ReadRelays returned %v", urls)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	outbox, inbox := relaytest.StartMockRelay(), relaytest.StartMockRelay()
+	defer outbox.Close()
+	defer inbox.Close()
+	sk := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(sk)
+	list := CreateUnsignedRelayList(author, []RelayListEntry{
+		{URL: outbox.URL, Write: true},
+		{URL: inbox.URL, Read: true},
+	})
+
+	pool := nostr.NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub, err := SubscribeOutbox(ctx, pool, &list, nostr.Filters{{Kinds: []int{1}}})
+	if err != nil {
+		t.Fatalf("SubscribeOutbox: %v", err)
+	}
+	if err := sub.WaitForEOSE(ctx); err != nil {
+		t.Fatalf("WaitForEOSE: %v", err)
+	}
+	sub.Unsub()
+
+	reqs := outbox.Received("REQ")
+	if len(reqs) != 1 {
+		t.Fatalf("outbox relay received %d REQs; want 1", len(reqs))
+	}
+	var filter nostr.Filter
+	if err := json.Unmarshal(reqs[0][1], &filter); err != nil || !reflect.DeepEqual(filter.Authors, []string{author}) {
+		t.Errorf("REQ has filter %s; want one for %s", reqs[0][1], author)
+	}
+	if reqs := inbox.Received("REQ"); len(reqs) != 0 {
+		t.Errorf("read relay received %d REQs; want none", len(reqs))
+	}
+	if relays := pool.List(); len(relays) != 1 || relays[0].Policy.Write {
+		t.Errorf("pool has relays %+v; want the outbox relay, read only", relays)
+	}
+
+	note := nostr.Event{Kind: 1, Content: "hello"}
+	if err := note.Sign(sk); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	writer := nostr.NewRelayPool()
+	defer writer.Close()
+	results := PublishOutbox(ctx, writer, &list, note)
+	if len(results) != 1 || results[outbox.URL].Status != nostr.PublishStatusSucceeded {
+		t.Errorf("PublishOutbox returned %+v; want success on %s only", results, outbox.URL)
+	}
+	if events := inbox.Received("EVENT"); len(events) != 0 {
+		t.Errorf("read relay received %d events; want none", len(events))
+	}
+}
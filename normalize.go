@@ -5,13 +5,21 @@ import (
 	"strings"
 )
 
-// NormalizeURL normalizes the url and replaces http://, https:// schemes by ws://, wss://.
+// NormalizeURL normalizes the url so the same relay always gets the same string:
+//   - http:// and https:// schemes are replaced by ws:// and wss://, and a missing scheme means wss://
+//   - surrounding whitespace is trimmed and the scheme and host are lowercased
+//   - a trailing dot in the host ("relay.example.com.") is dropped
+//   - default ports (80 for ws://, 443 for wss://) and empty ones are dropped
+//   - trailing slashes are removed from the path, and the fragment is removed
+//
+// It returns "" for an empty or unparseable url.
 func NormalizeURL(u string) string {
+	u = strings.TrimSpace(u)
 	if u == "" {
 		return ""
 	}
 
-	if !strings.HasPrefix(u, "http") && !strings.HasPrefix(u, "ws") {
+	if !strings.Contains(u, "://") {
 		u = "wss://" + u
 	}
 	p, err := url.Parse(u)
@@ -25,7 +33,21 @@ func NormalizeURL(u string) string {
 		p.Scheme = "wss"
 	}
 
+	host, port := strings.TrimSuffix(strings.ToLower(p.Hostname()), "."), p.Port()
+	if (p.Scheme == "ws" && port == "80") || (p.Scheme == "wss" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		host = "[" + host + "]"
+	}
+	p.Host = host
+	if port != "" {
+		p.Host += ":" + port
+	}
+
 	p.Path = strings.TrimRight(p.Path, "/")
+	p.Fragment, p.RawFragment, p.ForceQuery = "", "", false
 
 	return p.String()
 }
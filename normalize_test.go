@@ -1,6 +1,9 @@
 package nostr
 
-import "fmt"
+import (
+	"fmt"
+	"testing"
+)
 
 func ExampleNormalizeURL() {
 	fmt.Println(NormalizeURL(""))
@@ -30,3 +33,41 @@ func ExampleNormalizeURL() {
 	// wss://x.com
 	// wss://x.com?x=23
 }
+
+func TestNormalizeURL(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{"relay.example.com", "wss://relay.example.com"},
+		{"relay.example.com/", "wss://relay.example.com"},
+		{"wss://relay.example.com/", "wss://relay.example.com"},
+		{"wss://relay.example.com:443", "wss://relay.example.com"},
+		{"relay.example.com:443", "wss://relay.example.com"},
+		{"https://relay.example.com:443/", "wss://relay.example.com"},
+		{"ws://relay.example.com:80", "ws://relay.example.com"},
+		{"http://relay.example.com:80", "ws://relay.example.com"},
+		{"ws://relay.example.com:443", "ws://relay.example.com:443"},
+		{"wss://relay.example.com:80", "wss://relay.example.com:80"},
+		{"wss://relay.example.com:7777", "wss://relay.example.com:7777"},
+		{"WSS://Relay.Example.COM", "wss://relay.example.com"},
+		{"Relay.Example.com/Path/", "wss://relay.example.com/Path"},
+		{"ws://[::1]:80/", "ws://[::1]"},
+		{"ws://127.0.0.1:4869", "ws://127.0.0.1:4869"},
+		{"wss.example.com", "wss://wss.example.com"},
+		{"xyz2fyy6lq4ek2.onion", "wss://xyz2fyy6lq4ek2.onion"},
+		{"ws://XYZ2fyy6lq4ek2.onion:80/", "ws://xyz2fyy6lq4ek2.onion"},
+		{"http-relay.example.com", "wss://http-relay.example.com"},
+		{" wss://relay.example.com \n", "wss://relay.example.com"},
+		{"relay.example.com.", "wss://relay.example.com"},
+		{"wss://relay.example.com.:443/", "wss://relay.example.com"},
+		{"relay.example.com:", "wss://relay.example.com"},
+		{"wss://relay.example.com/#top", "wss://relay.example.com"},
+		{"wss://relay.example.com/?", "wss://relay.example.com"},
+		{"wss://relay.example.com/?key=value", "wss://relay.example.com?key=value"},
+	} {
+		if got := NormalizeURL(tc.input); got != tc.expected {
+			t.Errorf("NormalizeURL(%q) = %q; want %q", tc.input, got, tc.expected)
+		}
+	}
+}
@@ -8,4 +8,5 @@ type ProfilePointer struct {
 type EventPointer struct {
 	ID     string
 	Relays []string
+	Author string
 }
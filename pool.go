@@ -0,0 +1,1281 @@
+package nostr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"golang.org/x/exp/slices"
+)
+
+// SimplePolicy tells whether to read from and write to a relay.
+type SimplePolicy struct {
+	Read  bool
+	Write bool
+}
+
+// Policy tells a RelayPool whether to subscribe to (Read) and publish to (Write) a relay.
+// ReadSpecific overrides Read for subscriptions filtering on the authors it has entries for,
+// keyed by pubkey.
+// SkipVerify makes the pool trust the events of the relay without checking their signatures,
+// see the WARNING in Relay.SkipVerify. It only has an effect when the relay is added, not
+// in UpdatePolicy.
+type Policy struct {
+	Read         bool
+	Write        bool
+	ReadSpecific map[string]SimplePolicy
+	SkipVerify   bool
+}
+
+// readsFor tells whether a subscription with filters should read from the relay.
+// It does if any filter without authors can be read, or if any author in the filters
+// can be read considering its ReadSpecific override.
+func (policy Policy) readsFor(filters Filters) bool {
+	for _, filter := range filters {
+		if len(filter.Authors) == 0 {
+			if policy.Read {
+				return true
+			}
+			continue
+		}
+		for _, author := range filter.Authors {
+			if specific, ok := policy.ReadSpecific[author]; ok {
+				if specific.Read {
+					return true
+				}
+			} else if policy.Read {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copy returns policy with its own ReadSpecific map.
+func (policy Policy) copy() Policy {
+	if policy.ReadSpecific != nil {
+		specific := make(map[string]SimplePolicy, len(policy.ReadSpecific))
+		for author, sp := range policy.ReadSpecific {
+			specific[author] = sp
+		}
+		policy.ReadSpecific = specific
+	}
+	return policy
+}
+
+// NoticeMessage is a "NOTICE" sent by one of the relays in a RelayPool.
+type NoticeMessage struct {
+	Message string
+	Relay   string
+}
+
+// ClosedMessage is a "CLOSED" sent by one of the relays of a PoolSubscription, see
+// PoolSubscription.Closed.
+type ClosedMessage struct {
+	Reason string
+	Relay  string
+}
+
+// RelayStatus is a snapshot of one of the relays in a RelayPool, as returned by List.
+type RelayStatus struct {
+	URL       string
+	Policy    Policy
+	Connected bool
+}
+
+// SubscriptionInfo is a snapshot of one of the active subscriptions of a RelayPool, as
+// returned by Subscriptions. Relays are the URLs of the relays it is reading from.
+type SubscriptionInfo struct {
+	ID      string
+	Filters Filters
+	Relays  []string
+}
+
+// RetryPolicy tells a RelayPool how to retry publishing to relays that failed transiently,
+// i.e. that couldn't be written to or rejected the event with a "rate-limited:" or "error:"
+// message. Other rejections, like "invalid:" or "blocked:", are permanent and never retried.
+// Each retry multiplies the delay before the next one by Multiplier, up to MaxDelay.
+// Zero values mean 1 second, 30 seconds, 2 and 3 retries respectively.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	MaxRetries   int
+}
+
+// RelayPool keeps connections to many relays, sending subscriptions to the ones
+// it reads from and events to the ones it writes to.
+type RelayPool struct {
+	mutex         sync.RWMutex
+	relays        map[string]*Relay
+	policies      map[string]Policy
+	subscriptions map[string]*PoolSubscription
+
+	// relayInfo caches the NIP-11 document of each relay, see RelayInfo
+	relayInfo map[string]*nip11.RelayInformationDocument
+
+	// nip11HTTP fetches the NIP-11 documents, through ProxyURL if set, see nip11Client
+	nip11HTTP     *http.Client
+	nip11HTTPErr  error
+	nip11HTTPOnce sync.Once
+
+	// Notices receives the "NOTICE" messages of all the relays. It is buffered, but values
+	// are dropped if nobody is reading. IgnoreNotices, if set before adding relays, makes
+	// them discard notices without sending them here.
+	Notices       chan NoticeMessage
+	IgnoreNotices bool
+
+	// RawMessages receives the frames of all the relays with labels that aren't handled,
+	// see Relay.RawMessages. It is buffered, but values are dropped if nobody is reading.
+	RawMessages chan RawFrame
+
+	// Status receives the ConnectionStatus of every relay whenever its connection goes up or
+	// down, see Relay.Status, e.g. for a dashboard of the connections of the pool.
+	// It is buffered, but values are dropped if nobody is reading.
+	Status chan ConnectionStatus
+
+	// ParseErrors receives the *ParseError of every malformed frame one of the relays sent,
+	// see Relay.ParseErrors. It is buffered, but values are dropped if nobody is reading.
+	ParseErrors chan error
+
+	// VerifyErrors receives the *VerifyError of every event dropped by one of the relays
+	// because its id or signature isn't valid, see Relay.VerifyErrors, e.g. to tell a buggy
+	// relay (ErrInvalidSignature) from one handing out forged events (ErrBadSignature).
+	// It is buffered, but values are dropped if nobody is reading.
+	VerifyErrors chan error
+
+	// Logger, EventBuffer and DeliveryTimeout, if set before adding relays, are used
+	// by all of them, see the Relay fields with the same names.
+	Logger          Logger
+	EventBuffer     int
+	DeliveryTimeout time.Duration
+
+	// HandshakeTimeout and WriteTimeout, if set before adding relays, are used by all of
+	// them, see the Relay fields with the same names. Zero values mean 7 and 10 seconds.
+	HandshakeTimeout time.Duration
+	WriteTimeout     time.Duration
+
+	// PingInterval and PongTimeout, if set before adding relays, make each of them check
+	// that its connection is alive with websocket pings, see the Relay fields with the same
+	// names. Along with Reconnect, a relay that stops answering is re-dialed.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// MaxMessageSize, if set before adding relays, is the size in bytes of the largest
+	// frame accepted from any of them, see Relay.MaxMessageSize.
+	MaxMessageSize int64
+
+	// VerifyWorkers and VerifyUnordered, if set before adding relays, make each of them check
+	// signatures in that many goroutines, see the Relay fields with the same names.
+	VerifyWorkers   int
+	VerifyUnordered bool
+
+	// EnableCompression, if set before adding relays, makes the pool ask all of them for
+	// permessage-deflate compression, see Relay.EnableCompression.
+	EnableCompression bool
+
+	// Dialer and RequestHeader, if set before adding relays, are used for the websocket
+	// handshake with every one of them, see the Relay fields with the same names.
+	Dialer        *websocket.Dialer
+	RequestHeader http.Header
+
+	// ProxyURL, if set before adding relays, makes the pool connect to all of them through
+	// that proxy, see Relay.ProxyURL. The NIP-11 documents of RelayInfo are fetched through
+	// it too.
+	ProxyURL string
+
+	// RateLimit, if set before adding relays, is applied to each of them separately,
+	// see Relay.RateLimit.
+	RateLimit *RateLimit
+
+	// Reconnect, if set before adding relays, makes each of them re-dial when its
+	// connection drops and re-send the "REQ" of the subscriptions it serves, see
+	// Relay.Reconnect. Its Resume and DedupSize apply to the subscription each relay serves,
+	// so a PoolSubscription doesn't get twice the events a relay replays after reconnecting,
+	// even without a DedupSize of its own. Without it a relay whose connection breaks stays in the pool, serving
+	// nothing, until it is removed.
+	Reconnect *ReconnectPolicy
+
+	// IdleTimeout is the IdleTimeout of the subscriptions created by the pool, including the
+	// ones of QuerySync, FetchProfile and FetchContacts, see PoolSubscription.IdleTimeout.
+	IdleTimeout time.Duration
+
+	// RelayIndexSize, if set before creating subscriptions, makes the pool remember which
+	// relays delivered each of the last RelayIndexSize events received by its subscriptions,
+	// see RelaysForEvent.
+	RelayIndexSize int
+	relayIndex     *relayIndex
+	relayIndexOnce sync.Once
+
+	// PublishRetry, if set, makes PublishEvent and Publish retry relays that failed
+	// transiently, see RetryPolicy. The status reported for each relay is that of the
+	// last attempt.
+	PublishRetry *RetryPolicy
+
+	// AutoAuth, if set before adding relays, makes the pool answer the "AUTH" challenges
+	// of its relays (NIP-42) with a kind 22242 event signed with SecretKey.
+	// Without AutoAuth challenges are ignored.
+	AutoAuth  bool
+	SecretKey string
+
+	// AuthErrors receives an error whenever a relay asks for AUTH and it can't be done,
+	// e.g. because SecretKey is not set or the relay rejected the event.
+	// It is buffered, but values are dropped if nobody is reading.
+	AuthErrors chan error
+
+	// auths holds the last AUTH sent to each relay, see authenticate
+	auths map[string]*authAttempt
+
+	// dialing holds the relays Add is connecting to, so adding the same relay again in the
+	// meantime waits for that connection instead of opening another one
+	dialing map[string]*dialAttempt
+
+	// context is cancelled when the pool is closed, so the goroutines forwarding
+	// from each relay can bail out
+	context       context.Context
+	contextCancel context.CancelFunc
+	forwarders    sync.WaitGroup
+	closed        bool
+}
+
+func NewRelayPool() *RelayPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &RelayPool{
+		relays:        make(map[string]*Relay),
+		policies:      make(map[string]Policy),
+		subscriptions: make(map[string]*PoolSubscription),
+		relayInfo:     make(map[string]*nip11.RelayInformationDocument),
+		Notices:       make(chan NoticeMessage, 8),
+		RawMessages:   make(chan RawFrame, 8),
+		Status:        make(chan ConnectionStatus, 8),
+		ParseErrors:   make(chan error, 8),
+		VerifyErrors:  make(chan error, 8),
+		AuthErrors:    make(chan error, 8),
+		auths:         make(map[string]*authAttempt),
+		dialing:       make(map[string]*dialAttempt),
+		context:       ctx,
+		contextCancel: cancel,
+	}
+}
+
+// Add connects to the relay at url and adds it to the pool, also sending the "REQ"
+// of every active subscription to it if it is readable.
+// A nil policy means the relay is used for both reading and writing.
+// Adding a relay that is already in the pool, i.e. with the same NormalizeURL, does
+// nothing and returns nil: the existing connection and policy are kept. That includes
+// adding it while it is still being connected to, e.g. with two spellings of its URL in
+// AddAll, which waits for that connection and returns its outcome.
+func (p *RelayPool) Add(ctx context.Context, url string, policy *Policy) error {
+	_, err := p.tryAdd(ctx, url, policy)
+	return err
+}
+
+// tryAdd is Add, also telling whether this call is the one that added the relay, rather
+// than finding it in the pool already or waiting for another caller connecting to it.
+func (p *RelayPool) tryAdd(ctx context.Context, url string, policy *Policy) (added bool, err error) {
+	nm := NormalizeURL(url)
+	if nm == "" {
+		return false, fmt.Errorf("invalid relay URL '%s'", url)
+	}
+	if policy == nil {
+		policy = &Policy{Read: true, Write: true}
+	}
+
+	p.mutex.Lock()
+	_, exists := p.relays[nm]
+	closed := p.closed
+	attempt, dialing := p.dialing[nm]
+	if !closed && !exists && !dialing {
+		attempt = &dialAttempt{done: make(chan struct{})}
+		p.dialing[nm] = attempt
+	}
+	p.mutex.Unlock()
+	if closed {
+		return false, fmt.Errorf("can't add '%s' to a closed pool", nm)
+	}
+	if exists {
+		return false, nil
+	}
+	if dialing {
+		select {
+		case <-attempt.done:
+			return false, attempt.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	added, attempt.err = p.add(ctx, nm, policy)
+	p.mutex.Lock()
+	delete(p.dialing, nm)
+	p.mutex.Unlock()
+	close(attempt.done)
+	return added, attempt.err
+}
+
+// dialAttempt is a relay being connected to by Add; done is closed once err is set.
+type dialAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+// add connects to the relay at the normalized url nm and adds it to the pool, telling
+// whether it did, as someone may have added it first.
+func (p *RelayPool) add(ctx context.Context, nm string, policy *Policy) (bool, error) {
+	relay := &Relay{
+		URL:               nm,
+		Logger:            p.Logger,
+		EventBuffer:       p.EventBuffer,
+		DeliveryTimeout:   p.DeliveryTimeout,
+		HandshakeTimeout:  p.HandshakeTimeout,
+		WriteTimeout:      p.WriteTimeout,
+		PingInterval:      p.PingInterval,
+		PongTimeout:       p.PongTimeout,
+		MaxMessageSize:    p.MaxMessageSize,
+		VerifyWorkers:     p.VerifyWorkers,
+		VerifyUnordered:   p.VerifyUnordered,
+		RateLimit:         p.RateLimit,
+		Reconnect:         p.Reconnect,
+		IgnoreNotices:     p.IgnoreNotices,
+		EnableCompression: p.EnableCompression,
+		Dialer:            p.Dialer,
+		RequestHeader:     p.RequestHeader,
+		ProxyURL:          p.ProxyURL,
+		SkipVerify:        policy.SkipVerify,
+	}
+	if relay.HandshakeTimeout == 0 {
+		relay.HandshakeTimeout = 7 * time.Second
+	}
+	if relay.WriteTimeout == 0 {
+		relay.WriteTimeout = 10 * time.Second
+	}
+	if err := relay.Connect(ctx); err != nil {
+		return false, err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// someone may have added the same relay (or closed the pool) while we were dialing
+	if _, exists := p.relays[nm]; exists || p.closed {
+		relay.Close()
+		if p.closed {
+			return false, fmt.Errorf("can't add '%s' to a closed pool", nm)
+		}
+		return false, nil
+	}
+
+	p.relays[nm] = relay
+	p.policies[nm] = policy.copy()
+
+	p.forwarders.Add(1)
+	go p.watch(relay)
+
+	for _, ps := range p.subscriptions {
+		if ps.readsFrom(nm, *policy) {
+			ps.addRelay(relay)
+		}
+	}
+
+	return true, nil
+}
+
+// AddAll adds every relay in relays, which maps relay URLs to their policies, dialing them
+// concurrently, and returns the outcome of Add for each of them keyed by the same URLs.
+// Relays that fail to connect don't prevent the others from being added.
+func (p *RelayPool) AddAll(ctx context.Context, relays map[string]*Policy) map[string]error {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make(map[string]error, len(relays))
+	)
+	for url, policy := range relays {
+		wg.Add(1)
+		go func(url string, policy *Policy) {
+			defer wg.Done()
+			err := p.Add(ctx, url, policy)
+			mu.Lock()
+			results[url] = err
+			mu.Unlock()
+		}(url, policy)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// AddAllResult is the outcome of AddAllContext, with relays keyed by the URLs they were
+// given as. Connected and Pending are sorted.
+type AddAllResult struct {
+	Connected []string
+	Failed    map[string]error
+	Pending   []string // still dialing when the context expired
+}
+
+// AddAllContext is like AddAll, but returns as soon as ctx expires instead of waiting for
+// every dial to time out on its own, so a long list of relays can be given a single overall
+// deadline. The dials still pending then are cancelled and reported in Pending; any of them
+// that manages to connect anyway is removed again, so the pool ends up with the Connected
+// relays only, plus the ones that were in it already or that other callers added.
+func (p *RelayPool) AddAllContext(ctx context.Context, relays map[string]*Policy) AddAllResult {
+	type outcome struct {
+		url string
+		err error
+	}
+	var (
+		mu       sync.Mutex
+		expired  bool
+		outcomes = make(chan outcome, len(relays))
+		pending  = make(map[string]bool, len(relays))
+	)
+	for url, policy := range relays {
+		pending[url] = true
+		go func(url string, policy *Policy) {
+			added, err := p.tryAdd(ctx, url, policy)
+			mu.Lock()
+			late := expired
+			if !late {
+				outcomes <- outcome{url, err}
+			}
+			mu.Unlock()
+			if late && added {
+				p.Remove(url)
+			}
+		}(url, policy)
+	}
+
+	result := AddAllResult{Failed: make(map[string]error)}
+	deadline, hasDeadline := ctx.Deadline()
+	record := func(o outcome) {
+		delete(pending, o.url)
+		// the connection deadline, taken from ctx, can fire slightly before ctx itself
+		if o.err != nil && (ctx.Err() != nil || hasDeadline && !time.Now().Before(deadline)) {
+			// cut short by the deadline rather than failed on its own
+			result.Pending = append(result.Pending, o.url)
+		} else if o.err != nil {
+			result.Failed[o.url] = o.err
+		} else {
+			result.Connected = append(result.Connected, o.url)
+		}
+	}
+	for len(pending) > 0 {
+		select {
+		case o := <-outcomes:
+			record(o)
+		case <-ctx.Done():
+			mu.Lock()
+			expired = true
+			mu.Unlock()
+			// outcomes sent before that are kept, the rest are too late
+			for drained := false; !drained; {
+				select {
+				case o := <-outcomes:
+					record(o)
+				default:
+					drained = true
+				}
+			}
+			for url := range pending {
+				result.Pending = append(result.Pending, url)
+			}
+			pending = nil
+		}
+	}
+	slices.Sort(result.Connected)
+	slices.Sort(result.Pending)
+
+	return result
+}
+
+// RelaysForEvent returns the URLs of the relays that delivered the event with id to any of
+// the subscriptions of the pool, in the order they did, e.g. for the relay hints of a
+// nip19 "nevent". It returns nil if the event wasn't received, was forgotten to keep the
+// index within RelayIndexSize, or RelayIndexSize isn't set.
+func (p *RelayPool) RelaysForEvent(id string) []string {
+	if index := p.getRelayIndex(); index != nil {
+		return index.get(id)
+	}
+	return nil
+}
+
+// getRelayIndex returns the index of RelaysForEvent, creating it on first use, or nil
+// if RelayIndexSize isn't set.
+func (p *RelayPool) getRelayIndex() *relayIndex {
+	p.relayIndexOnce.Do(func() {
+		if p.RelayIndexSize > 0 {
+			p.relayIndex = newRelayIndex(p.RelayIndexSize)
+		}
+	})
+	return p.relayIndex
+}
+
+// Remove closes the connection to the relay at url and stops using it in every subscription.
+func (p *RelayPool) Remove(url string) error {
+	nm := NormalizeURL(url)
+
+	p.mutex.Lock()
+	relay, ok := p.relays[nm]
+	if !ok {
+		p.mutex.Unlock()
+		return nil
+	}
+	delete(p.relays, nm)
+	delete(p.policies, nm)
+	delete(p.relayInfo, nm)
+	delete(p.auths, nm)
+	subs := make([]*PoolSubscription, 0, len(p.subscriptions))
+	for _, ps := range p.subscriptions {
+		subs = append(subs, ps)
+	}
+	p.mutex.Unlock()
+
+	// Close waits for the reader to return before closing the relay channels, and the relay
+	// subscriptions are stopped under the lock the reader holds while delivering, so nothing
+	// is sent on them once removeRelay tears the pool subscriptions down
+	err := relay.Close()
+	for _, ps := range subs {
+		ps.removeRelay(nm)
+	}
+	return err
+}
+
+// UpdatePolicy changes the policy of a relay already in the pool without reconnecting.
+// Active subscriptions start or stop reading from the relay according to the new policy.
+func (p *RelayPool) UpdatePolicy(url string, policy Policy) error {
+	nm := NormalizeURL(url)
+
+	p.mutex.Lock()
+	relay, ok := p.relays[nm]
+	if !ok {
+		p.mutex.Unlock()
+		return fmt.Errorf("relay '%s' is not in the pool", nm)
+	}
+	old := p.policies[nm]
+	p.policies[nm] = policy.copy()
+
+	// the subscriptions change under the lock, so concurrent updates apply in order, but the
+	// "REQ" and "CLOSE" are only written once it is released, not to hold up the whole pool
+	// on a slow relay
+	var writes []func()
+	for _, ps := range p.subscriptions {
+		before, after := ps.readsFrom(nm, old), ps.readsFrom(nm, policy)
+		if after && !before {
+			if sub, filters := ps.attachRelay(relay); sub != nil {
+				ps := ps
+				writes = append(writes, func() { ps.fireRelay(relay.URL, sub, filters) })
+			}
+		} else if before && !after {
+			if sub := ps.detachRelay(nm); sub != nil {
+				writes = append(writes, sub.Unsub)
+			}
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, write := range writes {
+		write()
+	}
+	return nil
+}
+
+// List returns a snapshot of the relays in the pool with their policies.
+func (p *RelayPool) List() []RelayStatus {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	list := make([]RelayStatus, 0, len(p.relays))
+	for url, relay := range p.relays {
+		list = append(list, RelayStatus{
+			URL:       url,
+			Policy:    p.policies[url].copy(),
+			Connected: relay.IsConnected(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].URL < list[j].URL })
+	return list
+}
+
+// Stats returns the traffic counters of every relay in the pool by URL, see RelayMetrics,
+// e.g. to find and remove the relays that never deliver anything. Counters start over when
+// a relay is removed and added again.
+func (p *RelayPool) Stats() map[string]RelayMetrics {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	stats := make(map[string]RelayMetrics, len(p.relays))
+	for url, relay := range p.relays {
+		stats[url] = relay.Stats()
+	}
+	return stats
+}
+
+// Subscriptions returns a snapshot of the subscriptions that are active in the pool,
+// i.e. fired and not closed yet, sorted by id.
+func (p *RelayPool) Subscriptions() []SubscriptionInfo {
+	p.mutex.RLock()
+	subs := make([]*PoolSubscription, 0, len(p.subscriptions))
+	for _, ps := range p.subscriptions {
+		subs = append(subs, ps)
+	}
+	p.mutex.RUnlock()
+
+	infos := make([]SubscriptionInfo, 0, len(subs))
+	for _, ps := range subs {
+		ps.mutex.Lock()
+		info := SubscriptionInfo{
+			ID:      ps.id,
+			Filters: ps.Filters,
+			Relays:  make([]string, 0, len(ps.subs)),
+		}
+		for url := range ps.subs {
+			info.Relays = append(info.Relays, url)
+		}
+		ps.mutex.Unlock()
+		sort.Strings(info.Relays)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Close closes every subscription and every relay in the pool, then closes p.Notices.
+// Errors from closing each relay are combined into the returned error.
+// Calling Close again is a no-op.
+func (p *RelayPool) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	relays := p.relays
+	p.relays = make(map[string]*Relay)
+	p.policies = make(map[string]Policy)
+	subs := make([]*PoolSubscription, 0, len(p.subscriptions))
+	for _, ps := range p.subscriptions {
+		subs = append(subs, ps)
+	}
+	p.mutex.Unlock()
+
+	p.contextCancel()
+	for _, ps := range subs {
+		ps.Unsub()
+	}
+
+	var errs []string
+	for _, relay := range relays {
+		if err := relay.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	p.forwarders.Wait()
+	close(p.Notices)
+	close(p.RawMessages)
+	close(p.Status)
+	close(p.ParseErrors)
+	close(p.VerifyErrors)
+	close(p.AuthErrors)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close %d relays: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// watch forwards the notices, raw messages, connection status changes, parse errors and
+// verify errors of relay to the channels of p, answers its "AUTH" challenges and drains its
+// connection errors until it is closed.
+func (p *RelayPool) watch(relay *Relay) {
+	defer p.forwarders.Done()
+
+	notices, challenges, errors, raw := relay.Notices, relay.Challenges, relay.ConnectionError, relay.RawMessages
+	malformed, invalid, status := relay.ParseErrors, relay.VerifyErrors, relay.Status
+	for notices != nil || challenges != nil || errors != nil || raw != nil || malformed != nil || invalid != nil || status != nil {
+		select {
+		case notice, ok := <-notices:
+			if !ok {
+				notices = nil
+				continue
+			}
+			select {
+			case p.Notices <- NoticeMessage{Message: notice, Relay: relay.URL}:
+			default:
+			}
+		case challenge, ok := <-challenges:
+			if !ok {
+				challenges = nil
+				continue
+			}
+			if p.AutoAuth {
+				p.forwarders.Add(1)
+				go p.auth(relay, challenge)
+			}
+		case frame, ok := <-raw:
+			if !ok {
+				raw = nil
+				continue
+			}
+			select {
+			case p.RawMessages <- frame:
+			default:
+			}
+		case err, ok := <-malformed:
+			if !ok {
+				malformed = nil
+				continue
+			}
+			select {
+			case p.ParseErrors <- err:
+			default:
+			}
+		case err, ok := <-invalid:
+			if !ok {
+				invalid = nil
+				continue
+			}
+			select {
+			case p.VerifyErrors <- err:
+			default:
+			}
+		case change, ok := <-status:
+			if !ok {
+				status = nil
+				continue
+			}
+			select {
+			case p.Status <- change:
+			default:
+			}
+		case _, ok := <-errors:
+			if !ok {
+				errors = nil
+			}
+		}
+	}
+}
+
+// auth answers an "AUTH" challenge from relay, reporting failures on p.AuthErrors.
+func (p *RelayPool) auth(relay *Relay, challenge string) {
+	defer p.forwarders.Done()
+
+	if err := p.authenticate(p.context, relay, challenge); err != nil {
+		p.notifyAuthError(err)
+	}
+}
+
+// authAttempt is an "AUTH" sent to a relay; done is closed once err is set.
+type authAttempt struct {
+	challenge string
+	done      chan struct{}
+	err       error
+}
+
+// authenticate answers challenge from relay unless that was already done, or is being
+// done, in which case it waits for that outcome instead of sending another "AUTH".
+// Failed attempts are forgotten so the next call tries again.
+func (p *RelayPool) authenticate(ctx context.Context, relay *Relay, challenge string) error {
+	p.mutex.Lock()
+	attempt, ok := p.auths[relay.URL]
+	if !ok || attempt.challenge != challenge {
+		attempt = &authAttempt{challenge: challenge, done: make(chan struct{})}
+		p.auths[relay.URL] = attempt
+		p.mutex.Unlock()
+
+		attempt.err = p.sendAuth(ctx, relay, challenge)
+		if attempt.err != nil {
+			p.mutex.Lock()
+			if p.auths[relay.URL] == attempt {
+				delete(p.auths, relay.URL)
+			}
+			p.mutex.Unlock()
+		}
+		close(attempt.done)
+	} else {
+		p.mutex.Unlock()
+	}
+
+	select {
+	case <-attempt.done:
+		return attempt.err
+	case <-ctx.Done():
+		return fmt.Errorf("AUTH to '%s' not done: %w", relay.URL, ctx.Err())
+	}
+}
+
+// sendAuth sends relay an "AUTH" event for challenge signed with p.SecretKey and
+// waits for the relay to accept it, for up to 7 seconds.
+func (p *RelayPool) sendAuth(ctx context.Context, relay *Relay, challenge string) error {
+	if p.SecretKey == "" {
+		return fmt.Errorf("relay '%s' requested AUTH but the pool has no SecretKey", relay.URL)
+	}
+	event := Event{
+		Kind: KindClientAuthentication,
+		Tags: Tags{
+			Tag{"relay", relay.URL},
+			Tag{"challenge", challenge},
+		},
+	}
+	if err := event.Sign(p.SecretKey); err != nil {
+		return fmt.Errorf("failed to sign AUTH event for '%s': %w", relay.URL, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 7*time.Second)
+	defer cancel()
+	if status := relay.Auth(ctx, event); status == PublishStatusFailed || status == PublishStatusRejected {
+		return fmt.Errorf("AUTH to '%s' failed", relay.URL)
+	}
+	return nil
+}
+
+func (p *RelayPool) notifyAuthError(err error) {
+	select {
+	case p.AuthErrors <- err:
+	default:
+	}
+}
+
+// PrepareSubscription creates a subscription on the pool without sending anything yet,
+// so its options (like DedupSize) can be set before calling Fire.
+func (p *RelayPool) PrepareSubscription() *PoolSubscription {
+	random := make([]byte, 7)
+	rand.Read(random)
+
+	return &PoolSubscription{
+		id:                     hex.EncodeToString(random),
+		pool:                   p,
+		subs:                   make(map[string]*Subscription),
+		stops:                  make(map[string]chan struct{}),
+		eosed:                  make(map[string]bool),
+		Events:                 make(chan EventMessage),
+		EndOfStoredEvents:      make(chan struct{}, 1),
+		RelayEndOfStoredEvents: make(chan string, 8),
+		Closed:                 make(chan ClosedMessage, 8),
+		eose:                   make(chan struct{}),
+		IdleTimeout:            p.IdleTimeout,
+	}
+}
+
+// ErrNoReadRelays is returned by Subscribe and QuerySync when no relay of the pool reads
+// for the filters, so there is nothing to subscribe to.
+var ErrNoReadRelays = errors.New("no relays to read from")
+
+// Sub sends a "REQ" with filters to every relay the pool reads from.
+// Events from all of them come through sub.Events until ctx is cancelled.
+// If no relay reads for filters, the subscription is inert: nothing ever comes through
+// its channels until a relay is added. Use Subscribe to get an error instead.
+func (p *RelayPool) Sub(ctx context.Context, filters Filters) *PoolSubscription {
+	ps := p.PrepareSubscription()
+	ps.Filters = filters
+	ps.Fire(ctx)
+
+	return ps
+}
+
+// Subscribe is like Sub, but fails with ErrNoReadRelays, closing the subscription, when
+// no relay was sent the "REQ" because none reads for filters or all refused it.
+func (p *RelayPool) Subscribe(ctx context.Context, filters Filters) (*PoolSubscription, error) {
+	ps := p.Sub(ctx, filters)
+
+	ps.mutex.Lock()
+	relays := len(ps.subs)
+	ps.mutex.Unlock()
+	if relays == 0 {
+		ps.Unsub()
+		return nil, ErrNoReadRelays
+	}
+
+	return ps, nil
+}
+
+// SubOn is like Subscribe, but only sends the "REQ" to the relays with the given URLs,
+// which must be in the pool and read for filters, see PoolSubscription.Relays.
+func (p *RelayPool) SubOn(ctx context.Context, relays []string, filters Filters) (*PoolSubscription, error) {
+	p.mutex.RLock()
+	for _, url := range relays {
+		nm := NormalizeURL(url)
+		policy, exists := p.policies[nm]
+		if !exists {
+			p.mutex.RUnlock()
+			return nil, fmt.Errorf("relay '%s' is not in the pool", nm)
+		}
+		if !policy.readsFor(filters) {
+			p.mutex.RUnlock()
+			return nil, fmt.Errorf("the pool doesn't read from relay '%s'", nm)
+		}
+	}
+	p.mutex.RUnlock()
+
+	ps := p.PrepareSubscription()
+	ps.Filters = filters
+	ps.Relays = append(make([]string, 0, len(relays)), relays...)
+	ps.Fire(ctx)
+
+	ps.mutex.Lock()
+	n := len(ps.subs)
+	ps.mutex.Unlock()
+	if n == 0 {
+		ps.Unsub()
+		return nil, ErrNoReadRelays
+	}
+
+	return ps, nil
+}
+
+// QuerySync sends a "REQ" with filters to every relay the pool reads from and returns
+// the events they have stored, without duplicates and newest first, once all of them sent
+// "EOSE". The subscription is closed before returning.
+// If ctx is done first, the events received so far are returned along with ctx.Err().
+func (p *RelayPool) QuerySync(ctx context.Context, filters Filters) ([]*Event, error) {
+	ps, err := p.Subscribe(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	defer ps.Unsub()
+
+	seen := make(map[string]struct{})
+	var events []*Event
+loop:
+	for {
+		select {
+		case msg, ok := <-ps.Events:
+			if !ok {
+				err = ctx.Err()
+				break loop
+			}
+			if _, ok := seen[msg.Event.ID]; ok {
+				continue
+			}
+			seen[msg.Event.ID] = struct{}{}
+			evt := msg.Event
+			events = append(events, &evt)
+		case <-ps.EndOfStoredEvents:
+			break loop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+	return events, err
+}
+
+// FetchProfile returns the newest metadata event (kind 0) of pubkey among the ones stored by
+// the relays the pool reads from, or nil if none of them has one. ctx is used as in QuerySync:
+// if it is done before every relay sent "EOSE", the newest event so far is returned along
+// with ctx.Err().
+func (p *RelayPool) FetchProfile(ctx context.Context, pubkey string) (*Event, error) {
+	return p.fetchLatest(ctx, pubkey, KindSetMetadata)
+}
+
+// FetchContacts is like FetchProfile, but returns the contact list (kind 3) of pubkey.
+func (p *RelayPool) FetchContacts(ctx context.Context, pubkey string) (*Event, error) {
+	return p.fetchLatest(ctx, pubkey, KindContactList)
+}
+
+// fetchLatest returns the current version of the replaceable event of the given kind by pubkey.
+func (p *RelayPool) fetchLatest(ctx context.Context, pubkey string, kind int) (*Event, error) {
+	events, err := p.QuerySync(ctx, Filters{{Kinds: []int{kind}, Authors: []string{pubkey}, Limit: 1}})
+
+	var latest *Event
+	for _, evt := range events {
+		if latest == nil || isNewerVersion(evt, latest) {
+			latest = evt
+		}
+	}
+	return latest, err
+}
+
+// PublishEvent sends event to every relay the pool writes to, in parallel.
+// The outcome for each relay is sent to the returned channel, which is closed
+// once all of them have reported.
+func (p *RelayPool) PublishEvent(ctx context.Context, event Event) chan PublishStatus {
+	p.mutex.RLock()
+	relays := make([]*Relay, 0, len(p.relays))
+	for url, relay := range p.relays {
+		if p.policies[url].Write {
+			relays = append(relays, relay)
+		}
+	}
+	p.mutex.RUnlock()
+
+	statuses := make(chan PublishStatus, len(relays))
+	var wg sync.WaitGroup
+	for _, relay := range relays {
+		wg.Add(1)
+		go func(relay *Relay) {
+			defer wg.Done()
+			statuses <- p.publish(ctx, relay, event)
+		}(relay)
+	}
+	go func() {
+		wg.Wait()
+		close(statuses)
+	}()
+
+	return statuses
+}
+
+// PublishTo sends event only to the relay at url, e.g. a private relay or one the event is
+// meant to be seeded to, and waits for its "OK" as Relay.PublishWithStatus does, retrying
+// as PublishEvent does. The error is set when the relay isn't in the pool or the pool
+// doesn't write to it; how the relay answered is in the returned status.
+func (p *RelayPool) PublishTo(ctx context.Context, url string, event Event) (PublishStatus, error) {
+	nm := NormalizeURL(url)
+
+	p.mutex.RLock()
+	relay, exists := p.relays[nm]
+	writes := p.policies[nm].Write
+	p.mutex.RUnlock()
+	if !exists {
+		return PublishStatus{}, fmt.Errorf("relay '%s' is not in the pool", nm)
+	}
+	if !writes {
+		return PublishStatus{}, fmt.Errorf("the pool doesn't write to relay '%s'", nm)
+	}
+
+	return p.publish(ctx, relay, event), nil
+}
+
+// publish sends event to relay, retrying as described by p.PublishRetry until ctx is done.
+func (p *RelayPool) publish(ctx context.Context, relay *Relay, event Event) PublishStatus {
+	status := relay.PublishWithStatus(ctx, event)
+	retry := p.PublishRetry
+	if retry == nil {
+		return status
+	}
+
+	delay := retry.InitialDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	maxDelay := retry.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = 30 * time.Second
+	}
+	multiplier := retry.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	maxRetries := retry.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+
+	for attempt := 1; attempt <= maxRetries && status.transient(); attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return status
+		}
+		status = relay.PublishWithStatus(ctx, event)
+
+		delay = time.Duration(float64(delay) * multiplier)
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	return status
+}
+
+// Publish is like PublishEvent, but waits for every relay to report and returns the
+// results keyed by relay URL. The error is set when there are no relays to write to or
+// all of them failed.
+func (p *RelayPool) Publish(ctx context.Context, event Event) (map[string]PublishStatus, error) {
+	results := make(map[string]PublishStatus)
+	failed := 0
+	for status := range p.PublishEvent(ctx, event) {
+		results[status.Relay] = status
+		if status.Status == PublishStatusFailed || status.Status == PublishStatusRejected {
+			failed++
+		}
+	}
+
+	if len(results) == 0 {
+		return results, fmt.Errorf("no relays to publish to")
+	}
+	if failed == len(results) {
+		return results, fmt.Errorf("failed to publish to all %d relays", failed)
+	}
+	return results, nil
+}
+
+// Count asks every readable relay that advertises NIP-45 in its NIP-11 document how many
+// events match filters, returning the counts keyed by relay URL.
+// Relays that fail or don't reply before ctx is done are left out of the result.
+func (p *RelayPool) Count(ctx context.Context, filters Filters) (map[string]int64, error) {
+	p.mutex.RLock()
+	relays := make([]*Relay, 0, len(p.relays))
+	for url, relay := range p.relays {
+		if p.policies[url].Read {
+			relays = append(relays, relay)
+		}
+	}
+	p.mutex.RUnlock()
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		supported int
+		counts    = make(map[string]int64)
+	)
+	for _, relay := range relays {
+		wg.Add(1)
+		go func(relay *Relay) {
+			defer wg.Done()
+			if !p.supports(ctx, relay.URL, 45) {
+				return
+			}
+			mu.Lock()
+			supported++
+			mu.Unlock()
+
+			count, err := relay.Count(ctx, filters)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			counts[relay.URL] = count
+			mu.Unlock()
+		}(relay)
+	}
+	wg.Wait()
+
+	if supported == 0 {
+		return nil, fmt.Errorf("none of the %d readable relays support NIP-45", len(relays))
+	}
+	return counts, nil
+}
+
+// RelayInfo returns the NIP-11 document of the relay at url, which must be in the pool.
+// Documents are fetched once per relay and then cached until the relay is removed; a
+// document that can't be fetched is tried again next time.
+// Knowing the document lets the pool respect the relay limitations for the subscriptions
+// fired afterwards: the maximum length of subscription ids, the maximum number of
+// subscriptions and the maximum message length, see Subscription.Fire, and to only send
+// filters with a Search to the relays supporting NIP-50.
+func (p *RelayPool) RelayInfo(ctx context.Context, url string) (*nip11.RelayInformationDocument, error) {
+	nm := NormalizeURL(url)
+
+	p.mutex.RLock()
+	info, ok := p.relayInfo[nm]
+	_, exists := p.relays[nm]
+	p.mutex.RUnlock()
+	if ok {
+		return info, nil
+	}
+	if !exists {
+		return nil, fmt.Errorf("relay '%s' is not in the pool", nm)
+	}
+
+	client, err := p.nip11Client()
+	if err != nil {
+		return nil, err
+	}
+	info, err = nip11.FetchWithClient(ctx, client, nm)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	if relay, exists := p.relays[nm]; exists {
+		p.relayInfo[nm] = info
+		relay.setLimitation(info.Limitation)
+	}
+	p.mutex.Unlock()
+	return info, nil
+}
+
+// nip11Client returns the HTTP client for the NIP-11 requests, which goes through ProxyURL
+// like the websocket connections, so that the relays of a pool using Tor neither see the
+// address of the user nor are unreachable when they are .onion ones.
+func (p *RelayPool) nip11Client() (*http.Client, error) {
+	p.nip11HTTPOnce.Do(func() {
+		if p.ProxyURL == "" {
+			p.nip11HTTP = http.DefaultClient
+			return
+		}
+		proxyURL, err := url.Parse(p.ProxyURL)
+		if err != nil {
+			p.nip11HTTPErr = fmt.Errorf("invalid proxy url '%s': %w", p.ProxyURL, err)
+			return
+		}
+		p.nip11HTTP = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyURL(proxyURL),
+			IdleConnTimeout: 90 * time.Second,
+		}}
+	})
+	return p.nip11HTTP, p.nip11HTTPErr
+}
+
+// supports tells whether the NIP-11 document of the relay at url lists nip.
+// A relay whose document can't be fetched is assumed not to support anything.
+func (p *RelayPool) supports(ctx context.Context, url string, nip int) bool {
+	info, err := p.RelayInfo(ctx, url)
+	if err != nil {
+		return false
+	}
+	for _, n := range info.SupportedNIPs {
+		if n == nip {
+			return true
+		}
+	}
+	return false
+}
+
+// filtersFor returns the filters to send to the relay at url: all of them, unless its NIP-11
+// document is known (see RelayInfo) and doesn't list NIP-50, in which case the ones with a
+// Search are left out, as the relay would ignore the search and return unrelated events.
+// It must be called with p.mutex held.
+func (p *RelayPool) filtersFor(url string, filters Filters) Filters {
+	info, ok := p.relayInfo[url]
+	if !ok || slices.Contains(info.SupportedNIPs, 50) {
+		return filters
+	}
+	supported := make(Filters, 0, len(filters))
+	for _, filter := range filters {
+		if filter.Search == "" {
+			supported = append(supported, filter)
+		}
+	}
+	return supported
+}
+
+// subscriptionID returns the id to use on relay for the subscription with the given id:
+// id itself unless the relay is known to have a lower max_subid_length, in which case
+// it is truncated, or replaced by a random one if the truncated id is already in use.
+// It must be called with p.mutex held.
+func (p *RelayPool) subscriptionID(relay *Relay, id string) string {
+	info := p.relayInfo[relay.URL]
+	if info == nil || info.Limitation == nil {
+		return id
+	}
+	max := info.Limitation.MaxSubidLength
+	if max <= 0 || len(id) <= max {
+		return id
+	}
+
+	short := id[:max]
+	for attempt := 0; attempt < 10; attempt++ {
+		if _, taken := relay.subscriptions.Load(short); !taken {
+			break
+		}
+		random := make([]byte, (max+1)/2)
+		rand.Read(random)
+		short = hex.EncodeToString(random)[:max]
+	}
+	return short
+}
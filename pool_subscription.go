@@ -0,0 +1,750 @@
+package nostr
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PoolSubscription is a subscription sent to all the readable relays in a RelayPool,
+// using the same subscription id on each of them.
+type PoolSubscription struct {
+	id    string
+	pool  *RelayPool
+	mutex sync.Mutex
+
+	Filters           Filters
+	Events            chan EventMessage
+	EndOfStoredEvents chan struct{}
+
+	// RelayEndOfStoredEvents receives the URL of each relay once it is done sending stored
+	// events, because it sent "EOSE" or is treated as if it did (see IdleTimeout), ahead of
+	// ps.EndOfStoredEvents which is only signaled when the last one is. Stored events held
+	// back by LatestOnly, SortStored or LiveAfterStored are still emitted afterwards.
+	// It is buffered, but values are dropped if nobody is reading.
+	RelayEndOfStoredEvents chan string
+
+	// Closed receives the "CLOSED" messages of the relays that end the subscription on their
+	// side. With RelayPool.AutoAuth, a relay closing it with "auth-required:" is sent an
+	// "AUTH" and then the "REQ" again, and only if that fails the message shows up here.
+	// The relay is then left out of the subscription and, once every relay has closed it,
+	// ps.Events is closed as if Unsub was called.
+	// Relays that refuse the subscription before it is sent, because of the max_subscriptions
+	// in their NIP-11 document (see RelayPool.RelayInfo), show up here too, with the error as
+	// Reason, and are left out as well.
+	// It is buffered, but values are dropped if nobody is reading.
+	Closed chan ClosedMessage
+
+	// Relays, if set before calling Fire, limits the subscription to the relays with these
+	// URLs, among the ones the pool reads from for its filters, instead of using all of them,
+	// e.g. to query only the outbox relays of an author (NIP-65). Relays added to the pool
+	// later are only used if they are in the list. See RelayPool.SubOn.
+	Relays []string
+	only   map[string]bool // the normalized Relays
+
+	// DedupSize, if set before calling Fire, makes the subscription remember the ids of
+	// up to that many recent events and only emit the first copy of an event delivered by
+	// more than one relay. EventMessage.Relay is the relay that delivered it first.
+	// Deduplication is per-subscription: other subscriptions still get their own copy.
+	DedupSize int
+	seen      *idCache
+
+	// GlobalLimit, if set before calling Fire, makes the Limit of the filters apply to the
+	// subscription as a whole instead of to each relay: relays are still asked for up to
+	// Limit events each, as NIP-01 has it, but once as many unique events as the sum of the
+	// limits were emitted the subscription is closed as if Unsub was called. Deduplication
+	// is implied, with DedupSize defaulting to that sum.
+	// It has no effect unless every filter has a Limit.
+	GlobalLimit bool
+	limit       int64
+	emitted     int64 // events emitted or about to be, updated atomically
+
+	// LatestOnly, if set before calling Fire, makes the subscription emit only the newest
+	// version of replaceable events (see IsReplaceable) for each pubkey and kind, or pubkey,
+	// kind and "d" tag for parameterized replaceable ones, breaking ties by the lowest id.
+	// Stored events are held back until every relay has sent "EOSE", then only the winners
+	// are emitted; after that a version is emitted only if it is newer than everything
+	// seen before.
+	LatestOnly   bool
+	latest       map[string]EventMessage
+	storedEvents bool // still receiving stored events, i.e. before "EOSE"
+
+	// SortStored, if set before calling Fire, makes the subscription hold back the stored
+	// events until every relay has sent "EOSE" and then emit them sorted by created_at,
+	// newest first, instead of interleaved as they arrive. Live events are emitted as they
+	// arrive. The price is that nothing is emitted until the slowest relay is done and that
+	// every stored event is kept in memory until then, so at most SortBufferSize of them
+	// (1000 if zero) are held: once that many arrived they are emitted as a sorted batch and
+	// sorting starts over, trading ordering across batches for bounded memory.
+	SortStored     bool
+	SortBufferSize int
+	sorted         []EventMessage
+
+	// IdleTimeout, if set before calling Fire, makes the subscription treat a relay as done
+	// with its stored events when it sent nothing for that long before its "EOSE". It is the
+	// safety net for relays that never send "EOSE", which would otherwise keep Collect,
+	// QuerySync and everything waiting for ps.EndOfStoredEvents from completing until their
+	// context is done. A relay that sent as many events as the sum of the limits of the
+	// filters, when all of them have a Limit, is also treated as done right away.
+	IdleTimeout time.Duration
+
+	// LiveAfterStored, if set before calling Fire, makes ps.Events a single ordered stream:
+	// first the stored events of every relay, then a message with EndOfStoredEvents set once
+	// all of them have sent "EOSE", then the live events. Live events arriving from a relay
+	// before the others are done are held back until then, and events already emitted as
+	// stored are not emitted again when some relay sends them live.
+	LiveAfterStored bool
+	delivered       map[string]struct{}
+	pending         []EventMessage
+
+	context       context.Context
+	contextCancel context.CancelFunc
+
+	subs       map[string]*Subscription
+	stops      map[string]chan struct{}
+	eosed      map[string]bool
+	forwarders sync.WaitGroup
+
+	stopped  bool
+	emitEose sync.Once
+	eose     chan struct{} // closed along with the send on EndOfStoredEvents
+	flushed  chan struct{} // closed once the events held back until "EOSE" are emitted
+}
+
+// Fire sends the "REQ" command to every relay the pool reads from, considering the
+// ReadSpecific policies for the authors in ps.Filters.
+// When ctx is cancelled, ps.Unsub() is called, closing the subscription.
+func (ps *PoolSubscription) Fire(ctx context.Context) {
+	ps.context, ps.contextCancel = context.WithCancel(ctx)
+	if ps.Relays != nil {
+		ps.only = make(map[string]bool, len(ps.Relays))
+		for _, url := range ps.Relays {
+			ps.only[NormalizeURL(url)] = true
+		}
+	}
+	if ps.GlobalLimit {
+		ps.limit = int64(totalLimit(ps.Filters))
+		if ps.limit > 0 && ps.DedupSize <= 0 {
+			ps.DedupSize = int(ps.limit)
+		}
+	}
+	if ps.DedupSize > 0 {
+		ps.seen = newIDCache(ps.DedupSize)
+	}
+	if ps.LatestOnly {
+		ps.latest = make(map[string]EventMessage)
+	}
+	if ps.LiveAfterStored {
+		ps.delivered = make(map[string]struct{})
+	}
+	ps.storedEvents = ps.LatestOnly || ps.LiveAfterStored || ps.SortStored
+	if ps.storedEvents {
+		ps.flushed = make(chan struct{})
+	}
+
+	ps.pool.mutex.Lock()
+	if ps.pool.closed {
+		ps.contextCancel()
+	} else {
+		ps.pool.subscriptions[ps.id] = ps
+		for url, relay := range ps.pool.relays {
+			if ps.readsFrom(url, ps.pool.policies[url]) {
+				ps.addRelay(relay)
+			}
+		}
+	}
+	ps.pool.mutex.Unlock()
+
+	// the subscription ends once the context is canceled
+	go func() {
+		<-ps.context.Done()
+		ps.Unsub()
+	}()
+}
+
+// Unsub closes the subscription on every relay ("CLOSE" in NIP-01).
+// Unsub() also closes the channel ps.Events.
+func (ps *PoolSubscription) Unsub() {
+	// cancel first so whoever holds ps.mutex while sending on ps.Events lets go of it
+	if ps.contextCancel != nil {
+		ps.contextCancel()
+	}
+
+	ps.mutex.Lock()
+	if ps.stopped {
+		ps.mutex.Unlock()
+		return
+	}
+	ps.stopped = true
+	subs := ps.subs
+	ps.mutex.Unlock()
+
+	ps.pool.mutex.Lock()
+	delete(ps.pool.subscriptions, ps.id)
+	ps.pool.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsub()
+	}
+	ps.forwarders.Wait()
+	close(ps.Events)
+}
+
+// Collect reads events from ps.Events until every relay has sent "EOSE" or, if every
+// filter has a Limit, until as many events as the sum of the limits arrived. Then it calls
+// ps.Unsub(). DedupSize should be set for the count to not include copies of the same event,
+// or GlobalLimit, which also closes the subscription on the relays once the limit is reached.
+// If ctx is done first, the events received so far are returned along with ctx.Err().
+func (ps *PoolSubscription) Collect(ctx context.Context) ([]*Event, error) {
+	defer ps.Unsub()
+
+	limit := totalLimit(ps.Filters)
+
+	var events []*Event
+	for {
+		select {
+		case msg, ok := <-ps.Events:
+			if !ok {
+				return events, nil
+			}
+			if msg.EndOfStoredEvents {
+				return events, nil
+			}
+			evt := msg.Event
+			events = append(events, &evt)
+			if limit > 0 && len(events) >= limit {
+				return events, nil
+			}
+		case <-ps.EndOfStoredEvents:
+			return events, nil
+		case <-ctx.Done():
+			return events, ctx.Err()
+		}
+	}
+}
+
+// WaitForEOSE blocks until every relay of the subscription has sent "EOSE", or is treated as
+// if it had (see IdleTimeout), which is when ps.EndOfStoredEvents fires, e.g. to switch from
+// showing stored events to showing live ones. Unlike reading ps.EndOfStoredEvents it can be
+// called any number of times, also after the fact. It must be called after Fire, and fails
+// with ctx.Err() if ctx is done first or an error if the subscription is closed first.
+// ps.Events must be read meanwhile, e.g. from another goroutine, as relays are only done
+// once their stored events were taken from it.
+func (ps *PoolSubscription) WaitForEOSE(ctx context.Context) error {
+	select {
+	case <-ps.eose:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ps.context.Done():
+		select {
+		case <-ps.eose:
+			return nil
+		default:
+			return fmt.Errorf("subscription %s closed before EOSE", ps.id)
+		}
+	}
+}
+
+// Range calls fn for each message from ps.Events until fn returns false, ctx is done or the
+// subscription is closed (e.g. by every relay), and then calls ps.Unsub(). Stored and live
+// events are both passed to fn, as is the EndOfStoredEvents message of LiveAfterStored.
+func (ps *PoolSubscription) Range(ctx context.Context, fn func(EventMessage) bool) {
+	defer ps.Unsub()
+
+	for {
+		select {
+		case msg, ok := <-ps.Events:
+			if !ok || !fn(msg) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ID returns the subscription id, which is the same on every relay except for the ones
+// that only accept shorter ids, see RelayID.
+func (ps *PoolSubscription) ID() string {
+	return ps.id
+}
+
+// Dropped returns how many events the relays currently in the subscription dropped
+// because of RelayPool.DeliveryTimeout, see Subscription.Dropped.
+func (ps *PoolSubscription) Dropped() uint64 {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	var dropped uint64
+	for _, sub := range ps.subs {
+		dropped += sub.Dropped()
+	}
+	return dropped
+}
+
+// RelayID returns the subscription id used on the relay at url, which differs from ps.ID()
+// if the relay only accepts shorter ids, or "" if the subscription is not on that relay.
+func (ps *PoolSubscription) RelayID(url string) string {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if sub, ok := ps.subs[NormalizeURL(url)]; ok {
+		return sub.id
+	}
+	return ""
+}
+
+// readsFrom tells whether the subscription should use the relay at the normalized url,
+// which the pool uses with policy.
+func (ps *PoolSubscription) readsFrom(url string, policy Policy) bool {
+	if ps.only != nil && !ps.only[url] {
+		return false
+	}
+	return policy.readsFor(ps.Filters)
+}
+
+// addRelay sends the "REQ" to relay and starts forwarding its events.
+// It must be called with ps.pool.mutex held.
+func (ps *PoolSubscription) addRelay(relay *Relay) {
+	if sub, filters := ps.attachRelay(relay); sub != nil {
+		ps.fireRelay(relay.URL, sub, filters)
+	}
+}
+
+// attachRelay is the part of addRelay that doesn't write to the relay: it prepares the
+// subscription on relay and starts forwarding its events, returning it with the filters to
+// send in fireRelay, or nil if there is nothing to send.
+// It must be called with ps.pool.mutex held.
+func (ps *PoolSubscription) attachRelay(relay *Relay) (*Subscription, Filters) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.stopped {
+		return nil, nil
+	}
+	if _, ok := ps.subs[relay.URL]; ok {
+		return nil, nil
+	}
+	filters := ps.pool.filtersFor(relay.URL, ps.Filters)
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	sub := relay.prepareSubscription(ps.pool.subscriptionID(relay, ps.id))
+	stop := make(chan struct{})
+	ps.subs[relay.URL] = sub
+	ps.stops[relay.URL] = stop
+
+	ps.forwarders.Add(1)
+	go ps.forward(relay.URL, sub, totalLimit(filters), stop)
+	return sub, filters
+}
+
+// fireRelay sends the "REQ" of a subscription from attachRelay, forgetting it if that fails.
+func (ps *PoolSubscription) fireRelay(url string, sub *Subscription, filters Filters) {
+	err := sub.Sub(ps.context, filters)
+	if err == nil {
+		return
+	}
+
+	// sub.Events is closed, so the forwarder returns
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	if ps.subs[url] != sub {
+		// removed in the meantime
+		return
+	}
+	close(ps.stops[url])
+	delete(ps.subs, url)
+	delete(ps.stops, url)
+	select {
+	case ps.Closed <- ClosedMessage{Reason: err.Error(), Relay: url}:
+	default:
+	}
+	ps.checkEose()
+}
+
+// removeRelay closes the subscription on the relay at url, leaving the others running.
+func (ps *PoolSubscription) removeRelay(url string) {
+	if sub := ps.detachRelay(url); sub != nil {
+		sub.Unsub()
+	}
+}
+
+// detachRelay is the part of removeRelay that doesn't write to the relay: it stops
+// forwarding the events from the relay at url and returns the subscription to Unsub, or nil
+// if there is none.
+func (ps *PoolSubscription) detachRelay(url string) *Subscription {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if ps.stopped {
+		return nil
+	}
+	sub, ok := ps.subs[url]
+	if !ok {
+		return nil
+	}
+	close(ps.stops[url])
+	delete(ps.subs, url)
+	delete(ps.stops, url)
+	delete(ps.eosed, url)
+	ps.checkEose()
+	return sub
+}
+
+// forward emits the events of a single relay subscription on ps.Events.
+// It keeps draining sub.Events until it is closed, even after ps stopped caring
+// about them, so the relay reader is never stuck trying to deliver to it.
+func (ps *PoolSubscription) forward(url string, sub *Subscription, limit int, stop chan struct{}) {
+	defer ps.forwarders.Done()
+
+	eose := sub.EndOfStoredEvents
+	endOfStored := func() {
+		eose = nil
+		ps.mutex.Lock()
+		if _, ok := ps.subs[url]; ok {
+			ps.eosed[url] = true
+			select {
+			case ps.RelayEndOfStoredEvents <- url:
+			default:
+			}
+			ps.checkEose()
+		}
+		ps.mutex.Unlock()
+	}
+
+	// the fallbacks for relays that never send "EOSE", see IdleTimeout
+	stored := 0
+	var idle *time.Timer
+	var idleTimeout <-chan time.Time
+	if ps.IdleTimeout > 0 {
+		idle = time.NewTimer(ps.IdleTimeout)
+		defer idle.Stop()
+		idleTimeout = idle.C
+	}
+
+	authRetried := false
+	for {
+		select {
+		case evt, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			ps.emit(url, evt, stop)
+			if eose == nil {
+				continue
+			}
+			if stored++; limit > 0 && stored >= limit {
+				idleTimeout = nil
+				endOfStored()
+			} else if idle != nil {
+				if !idle.Stop() {
+					<-idle.C
+				}
+				idle.Reset(ps.IdleTimeout)
+			}
+		case <-idleTimeout:
+			idleTimeout = nil
+			endOfStored()
+		case <-eose:
+			idleTimeout = nil
+			// the relay queues its stored events before signaling "EOSE", so whatever is
+			// buffered now goes before the end of stored events
+			for n := len(sub.Events); n > 0; n-- {
+				evt, ok := <-sub.Events
+				if !ok {
+					return
+				}
+				ps.emit(url, evt, stop)
+			}
+			endOfStored()
+		case reason := <-sub.ClosedReason:
+			if strings.HasPrefix(reason, "auth-required:") && ps.pool.AutoAuth && !authRetried {
+				// only once, so a relay that keeps refusing doesn't get REQs forever
+				authRetried = true
+				if ps.reauthenticate(sub.Relay) {
+					sub.fire()
+					continue
+				}
+			}
+			select {
+			case ps.Closed <- ClosedMessage{Reason: reason, Relay: url}:
+			default:
+			}
+
+			// this closes sub.Events, ending the loop
+			ps.removeRelay(url)
+			ps.mutex.Lock()
+			abandoned := len(ps.subs) == 0 && !ps.stopped
+			ps.mutex.Unlock()
+			if abandoned {
+				// Unsub waits for this goroutine to return
+				go ps.Unsub()
+			}
+		}
+	}
+}
+
+// reauthenticate answers the last challenge of relay after it closed the subscription
+// asking for AUTH, reporting failures on RelayPool.AuthErrors.
+func (ps *PoolSubscription) reauthenticate(relay *Relay) bool {
+	challenge := relay.LastChallenge()
+	if challenge == "" {
+		ps.pool.notifyAuthError(fmt.Errorf("relay '%s' requires AUTH but sent no challenge", relay.URL))
+		return false
+	}
+	if err := ps.pool.authenticate(ps.context, relay, challenge); err != nil {
+		ps.pool.notifyAuthError(err)
+		return false
+	}
+	return true
+}
+
+// emit sends an event from the relay at url on ps.Events, unless one of the subscription
+// options says it should be skipped or held back.
+func (ps *PoolSubscription) emit(url string, evt *Event, stop chan struct{}) {
+	if index := ps.pool.getRelayIndex(); index != nil {
+		index.add(evt.ID, url)
+	}
+	if ps.seen != nil && !ps.seen.add(evt.ID) {
+		return
+	}
+	msg := EventMessage{Event: *evt, Relay: url}
+	if ps.latest != nil && !ps.keepLatest(msg) {
+		return
+	}
+	if ps.delivered != nil && !ps.keepOrdered(msg) {
+		return
+	}
+	if ps.SortStored && !ps.keepSorted(msg) {
+		return
+	}
+	if ps.flushed != nil {
+		// live events go after the ones held back until "EOSE", see checkEose
+		ps.mutex.Lock()
+		live := !ps.storedEvents
+		ps.mutex.Unlock()
+		if live {
+			select {
+			case <-ps.flushed:
+			case <-stop:
+				return
+			case <-ps.context.Done():
+				return
+			}
+		}
+	}
+	last, ok := ps.countEmitted()
+	if !ok {
+		return
+	}
+	select {
+	case ps.Events <- msg:
+	case <-stop:
+	case <-ps.context.Done():
+	}
+	if last {
+		go ps.Unsub()
+	}
+}
+
+// countEmitted implements GlobalLimit: it tells whether another event can be emitted and
+// whether it is the last one, after which the subscription must be closed.
+func (ps *PoolSubscription) countEmitted() (last bool, ok bool) {
+	if ps.limit == 0 {
+		return false, true
+	}
+	n := atomic.AddInt64(&ps.emitted, 1)
+	return n == ps.limit, n <= ps.limit
+}
+
+// checkEose emits on ps.EndOfStoredEvents once every relay has sent "EOSE".
+// It must be called with ps.mutex held, so the events held back until then are emitted by
+// another goroutine: sending on ps.Events blocks until they are read, and whoever reads
+// them may need ps.mutex or ps.pool.mutex in the meantime, e.g. for ps.Dropped().
+func (ps *PoolSubscription) checkEose() {
+	if ps.stopped || len(ps.subs) == 0 || len(ps.eosed) < len(ps.subs) {
+		return
+	}
+	ps.emitEose.Do(func() {
+		ps.storedEvents = false
+		// the replaceable events held back so far, along with the stored events held back
+		// for sorting
+		held := ps.sorted
+		for _, msg := range ps.latest {
+			held = append(held, msg)
+		}
+		if ps.SortStored {
+			sortNewestFirst(held)
+		}
+		ps.sorted = nil
+		var pending []EventMessage
+		for _, msg := range ps.pending {
+			if _, ok := ps.delivered[msg.Event.ID]; !ok {
+				ps.delivered[msg.Event.ID] = struct{}{}
+				pending = append(pending, msg)
+			}
+		}
+		ps.pending = nil
+
+		if len(held) == 0 && len(pending) == 0 && ps.delivered == nil {
+			ps.EndOfStoredEvents <- struct{}{}
+			close(ps.eose)
+			if ps.flushed != nil {
+				close(ps.flushed)
+			}
+			return
+		}
+		// Unsub waits for it before closing ps.Events
+		ps.forwarders.Add(1)
+		go func() {
+			defer ps.forwarders.Done()
+			for _, msg := range held {
+				ps.send(msg)
+			}
+			if ps.delivered != nil {
+				ps.send(EventMessage{EndOfStoredEvents: true})
+			}
+			ps.EndOfStoredEvents <- struct{}{}
+			close(ps.eose)
+			for _, msg := range pending {
+				ps.send(msg)
+			}
+			close(ps.flushed)
+		}()
+	})
+}
+
+// send emits msg on ps.Events unless the subscription is closed first.
+func (ps *PoolSubscription) send(msg EventMessage) {
+	last, ok := false, true
+	if !msg.EndOfStoredEvents {
+		last, ok = ps.countEmitted()
+	}
+	if !ok {
+		return
+	}
+	select {
+	case ps.Events <- msg:
+	case <-ps.context.Done():
+	}
+	if last {
+		go ps.Unsub()
+	}
+}
+
+// keepLatest records msg if it is the newest version of a replaceable event and tells
+// whether it should be emitted right away, which is never the case for stored events.
+func (ps *PoolSubscription) keepLatest(msg EventMessage) bool {
+	key, ok := replaceableKey(&msg.Event)
+	if !ok {
+		return true
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if current, ok := ps.latest[key]; ok && !isNewerVersion(&msg.Event, &current.Event) {
+		return false
+	}
+	ps.latest[key] = msg
+	return !ps.storedEvents
+}
+
+// keepOrdered implements LiveAfterStored: it tells whether msg should be emitted right
+// away, holding back the live events that arrive before every relay sent "EOSE".
+func (ps *PoolSubscription) keepOrdered(msg EventMessage) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if _, ok := ps.delivered[msg.Event.ID]; ok {
+		return false
+	}
+	if !ps.storedEvents {
+		return true
+	}
+	if ps.eosed[msg.Relay] {
+		ps.pending = append(ps.pending, msg)
+		return false
+	}
+	ps.delivered[msg.Event.ID] = struct{}{}
+	return true
+}
+
+// keepSorted implements SortStored: it tells whether msg should be emitted right away,
+// holding back the stored events that arrive before every relay sent "EOSE" and emitting
+// them as a sorted batch when there are SortBufferSize of them.
+func (ps *PoolSubscription) keepSorted(msg EventMessage) bool {
+	size := ps.SortBufferSize
+	if size <= 0 {
+		size = 1000
+	}
+
+	ps.mutex.Lock()
+	if !ps.storedEvents || ps.eosed[msg.Relay] {
+		ps.mutex.Unlock()
+		return true
+	}
+	ps.sorted = append(ps.sorted, msg)
+	var batch []EventMessage
+	if len(ps.sorted) >= size {
+		batch = ps.sorted
+		ps.sorted = nil
+	}
+	ps.mutex.Unlock()
+
+	sortNewestFirst(batch)
+	for _, held := range batch {
+		ps.send(held)
+	}
+	return false
+}
+
+func sortNewestFirst(msgs []EventMessage) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Event.CreatedAt.After(msgs[j].Event.CreatedAt)
+	})
+}
+
+// totalLimit returns the sum of the limits of filters, or 0 if any of them has no Limit.
+func totalLimit(filters Filters) int {
+	limit := 0
+	for _, filter := range filters {
+		if filter.Limit <= 0 {
+			return 0
+		}
+		limit += filter.Limit
+	}
+	return limit
+}
+
+// replaceableKey identifies the versions of a replaceable event.
+// A parameterized replaceable event without a "d" tag counts as having an empty one.
+func replaceableKey(evt *Event) (string, bool) {
+	if IsReplaceable(evt.Kind) {
+		return fmt.Sprintf("%s:%d", evt.PubKey, evt.Kind), true
+	}
+	if IsParameterizedReplaceable(evt.Kind) {
+		d := ""
+		if tag := evt.Tags.GetFirst([]string{"d", ""}); tag != nil {
+			d = tag.Value()
+		}
+		return fmt.Sprintf("%s:%d:%s", evt.PubKey, evt.Kind, d), true
+	}
+	return "", false
+}
+
+// isNewerVersion tells whether a supersedes b: newer events win and, among events
+// created at the same time, the lowest id does.
+func isNewerVersion(a *Event, b *Event) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,2746 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr/relaytest"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/websocket"
+)
+
+func TestPoolSubscriptionDedup(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	// two fake relays holding the same event
+	ws1 := newStoredEventsServer(t, textNote)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t, textNote)
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+
+	for _, tc := range []struct {
+		dedup int
+		want  int
+	}{
+		{0, 2},
+		{10, 1},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		sub := pool.PrepareSubscription()
+		sub.Filters = Filters{{Kinds: []int{1}}}
+		sub.DedupSize = tc.dedup
+		sub.Fire(ctx)
+
+		got := 0
+	loop:
+		for {
+			select {
+			case evt := <-sub.Events:
+				if evt.Event.ID != textNote.ID {
+					t.Errorf("received event %s; want %s", evt.Event.ID, textNote.ID)
+				}
+				if evt.Relay != NormalizeURL(ws1.URL) && evt.Relay != NormalizeURL(ws2.URL) {
+					t.Errorf("event delivered by unknown relay %s", evt.Relay)
+				}
+				got++
+			case <-sub.EndOfStoredEvents:
+				break loop
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for EOSE from all relays")
+			}
+		}
+		cancel()
+
+		if got != tc.want {
+			t.Errorf("with DedupSize %d got %d copies of the event; want %d", tc.dedup, got, tc.want)
+		}
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	ws := newStoredEventsServer(t)
+	defer ws.Close()
+
+	pool := mustPoolWith(t, ws.URL)
+	sub := pool.Sub(context.Background(), Filters{{Kinds: []int{1}}})
+
+	if err := pool.Close(); err != nil {
+		t.Fatalf("pool.Close: %v", err)
+	}
+	if err := pool.Close(); err != nil {
+		t.Errorf("second pool.Close returned %v; want nil", err)
+	}
+
+	if _, ok := <-sub.Events; ok {
+		t.Error("sub.Events still open after Close")
+	}
+	if _, ok := <-pool.Notices; ok {
+		t.Error("pool.Notices still open after Close")
+	}
+}
+
+func TestPoolNoticesNotRead(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	note := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &note)
+
+	// fake relay sending more notices than fit in any buffer before the event
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			return
+		}
+		var subid string
+		json.Unmarshal(raw[1], &subid)
+		for i := 0; i < 50; i++ {
+			websocket.JSON.Send(conn, []any{"NOTICE", fmt.Sprintf("notice %d", i)})
+		}
+		websocket.JSON.Send(conn, []any{"EVENT", subid, note})
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	// nobody reads pool.Notices
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+	sub := pool.Sub(context.Background(), Filters{{Kinds: []int{1}}})
+
+	select {
+	case evt := <-sub.Events:
+		if evt.Event.ID != note.ID {
+			t.Errorf("got event %s; want %s", evt.Event.ID, note.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("unread notices stalled the connection")
+	}
+}
+
+func TestPoolRawMessages(t *testing.T) {
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		websocket.JSON.Send(conn, []any{"NEG-MSG", "sub1", "abcd"})
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+
+	select {
+	case frame := <-pool.RawMessages:
+		if frame.Relay != NormalizeURL(ws.URL) || frame.Type != "NEG-MSG" || len(frame.Payload) != 2 {
+			t.Fatalf("got frame %+v; want the NEG-MSG frame", frame)
+		}
+		var subid, message string
+		json.Unmarshal(frame.Payload[0], &subid)
+		json.Unmarshal(frame.Payload[1], &message)
+		if subid != "sub1" || message != "abcd" {
+			t.Errorf("got payload %q, %q; want sub1, abcd", subid, message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("unknown frame was not forwarded")
+	}
+}
+
+// newStoredEventsServer is a fake relay that answers every REQ with the given events
+// followed by an EOSE.
+func newStoredEventsServer(t *testing.T, events ...Event) *httptest.Server {
+	t.Helper()
+	return newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ, subid string
+			json.Unmarshal(raw[0], &typ)
+			json.Unmarshal(raw[1], &subid)
+			if typ != "REQ" {
+				continue
+			}
+			for _, evt := range events {
+				websocket.JSON.Send(conn, []any{"EVENT", subid, evt})
+			}
+			websocket.JSON.Send(conn, []any{"EOSE", subid})
+		}
+	})
+}
+
+func mustPoolWith(t *testing.T, urls ...string) *RelayPool {
+	t.Helper()
+	pool := NewRelayPool()
+	for _, url := range urls {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := pool.Add(ctx, url, nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("pool.Add(%s): %v", url, err)
+		}
+	}
+	return pool
+}
+
+func TestPoolList(t *testing.T) {
+	ws1 := newStoredEventsServer(t)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t)
+	defer ws2.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws1.URL, &Policy{Read: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if err := pool.Add(ctx, ws2.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	list := pool.List()
+	if len(list) != 2 {
+		t.Fatalf("List returned %d relays; want 2", len(list))
+	}
+	for _, status := range list {
+		if !status.Connected {
+			t.Errorf("%s is not connected", status.URL)
+		}
+		want := SimplePolicy{Read: true, Write: true}
+		if status.URL == NormalizeURL(ws1.URL) {
+			want = SimplePolicy{Read: true}
+		}
+		if (SimplePolicy{status.Policy.Read, status.Policy.Write}) != want {
+			t.Errorf("%s has policy %+v; want %+v", status.URL, status.Policy, want)
+		}
+	}
+
+	// the snapshot is a copy
+	list[0].Policy.Write = !list[0].Policy.Write
+	if pool.List()[0].Policy.Write == list[0].Policy.Write {
+		t.Error("modifying the List result changed the pool")
+	}
+}
+
+func TestPoolAddExisting(t *testing.T) {
+	var connections int32
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		atomic.AddInt32(&connections, 1)
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws.URL, &Policy{Read: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	first := pool.relays[NormalizeURL(ws.URL)]
+
+	// the same relay, written differently
+	if err := pool.Add(ctx, ws.URL+"/", nil); err != nil {
+		t.Fatalf("second pool.Add returned %v; want nil", err)
+	}
+
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("relay got %d connections; want 1", n)
+	}
+	list := pool.List()
+	if len(list) != 1 {
+		t.Fatalf("List returned %d relays; want 1", len(list))
+	}
+	if list[0].Policy.Write {
+		t.Error("second Add replaced the policy of the relay")
+	}
+	if pool.relays[list[0].URL] != first || !first.IsConnected() {
+		t.Error("second Add replaced the first connection")
+	}
+}
+
+func TestPoolAddAfterSub(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 2; i++ {
+		note := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+	first := newStoredEventsServer(t, notes[0])
+	defer first.Close()
+	second := newStoredEventsServer(t, notes[1])
+	defer second.Close()
+
+	pool := mustPoolWith(t, first.URL)
+	defer pool.Close()
+	sub := pool.Sub(context.Background(), Filters{{Kinds: []int{1}}})
+
+	receive := func(want Event) {
+		t.Helper()
+		select {
+		case msg := <-sub.Events:
+			if msg.Event.ID != want.ID {
+				t.Errorf("got event %s; want %s", msg.Event.ID, want.ID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for event %s", want.ID)
+		}
+	}
+	receive(notes[0])
+
+	// the subscription is sent to relays added after it was created
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, second.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	receive(notes[1])
+}
+
+func TestPoolAddAll(t *testing.T) {
+	ws1 := newStoredEventsServer(t)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t)
+	defer ws2.Close()
+	down := newStoredEventsServer(t)
+	down.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	results := pool.AddAll(ctx, map[string]*Policy{
+		ws1.URL:  nil,
+		ws2.URL:  {Read: true},
+		down.URL: nil,
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("AddAll returned %d results; want 3", len(results))
+	}
+	for _, url := range []string{ws1.URL, ws2.URL} {
+		if err := results[url]; err != nil {
+			t.Errorf("adding %s failed: %v", url, err)
+		}
+	}
+	if results[down.URL] == nil {
+		t.Errorf("adding unreachable %s succeeded", down.URL)
+	}
+
+	list := pool.List()
+	if len(list) != 2 {
+		t.Fatalf("List returned %d relays; want 2", len(list))
+	}
+	for _, status := range list {
+		if status.URL == NormalizeURL(ws2.URL) && status.Policy.Write {
+			t.Errorf("%s got write policy; want read only", status.URL)
+		}
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	stored := Event{Kind: 1, Content: "stored", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &stored)
+	live := Event{Kind: 1, Content: "live", CreatedAt: time.Unix(1672068600, 0), PubKey: pub}
+	mustSignEvent(t, priv, &live)
+
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.Store(stored)
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.Reconnect = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 20}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	receive := func(want Event) {
+		t.Helper()
+		for {
+			select {
+			case msg := <-sub.Events:
+				if msg.Event.ID == want.ID {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %q", want.Content)
+			}
+		}
+	}
+	receive(stored)
+
+	// the subscription is sent again once the relay is back
+	relay.Restart()
+	for len(relay.Subscriptions()) == 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	relay.Broadcast(live)
+	receive(live)
+
+	if reconnects := pool.Stats()[NormalizeURL(relay.URL)].Reconnects; reconnects != 1 {
+		t.Errorf("relay reconnected %d times; want 1", reconnects)
+	}
+}
+
+func TestPoolStatus(t *testing.T) {
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	relay.Disconnect()
+	for _, want := range []string{ConnectionStateConnected, ConnectionStateDisconnected} {
+		select {
+		case status := <-pool.Status:
+			if status.State != want || status.Relay != NormalizeURL(relay.URL) {
+				t.Errorf("got status %s of %s; want %s of %s", status.State, status.Relay, want, relay.URL)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for status %s", want)
+		}
+	}
+}
+
+func TestPoolParseErrors(t *testing.T) {
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	relay.Send("EVENT", 1, map[string]any{})
+	select {
+	case err := <-pool.ParseErrors:
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Relay != NormalizeURL(relay.URL) {
+			t.Errorf("unexpected parse error %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for a parse error")
+	}
+}
+
+func TestPoolAddAllContext(t *testing.T) {
+	ws := newStoredEventsServer(t)
+	defer ws.Close()
+	down := newStoredEventsServer(t)
+	down.Close()
+	// accepts TCP connections but never answers the websocket handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	stuck := "ws://" + ln.Addr().String()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.HandshakeTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := pool.AddAllContext(ctx, map[string]*Policy{ws.URL: nil, down.URL: nil, stuck: nil})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("AddAllContext took %v; want about 300ms", elapsed)
+	}
+
+	if len(result.Connected) != 1 || result.Connected[0] != ws.URL {
+		t.Errorf("connected to %v; want %s", result.Connected, ws.URL)
+	}
+	if len(result.Failed) != 1 || result.Failed[down.URL] == nil {
+		t.Errorf("failed %v; want %s", result.Failed, down.URL)
+	}
+	if len(result.Pending) != 1 || result.Pending[0] != stuck {
+		t.Errorf("pending %v; want %s", result.Pending, stuck)
+	}
+	if list := pool.List(); len(list) != 1 {
+		t.Errorf("pool has %d relays; want 1", len(list))
+	}
+
+	// relays this call didn't add are kept even if Add returns after the deadline, which it
+	// can for one already in the pool
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 20; i++ {
+		pool.AddAllContext(expired, map[string]*Policy{ws.URL: nil})
+		time.Sleep(time.Millisecond)
+		if list := pool.List(); len(list) != 1 {
+			t.Fatalf("pool has %d relays after AddAllContext expired; want the one it had", len(list))
+		}
+	}
+}
+
+func TestPoolHandshakeTimeout(t *testing.T) {
+	// accepts TCP connections but never answers the websocket handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.HandshakeTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	if err := pool.Add(context.Background(), "ws://"+ln.Addr().String(), nil); err == nil {
+		t.Fatal("pool.Add succeeded without a handshake")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("pool.Add took %v to give up; want about %v", elapsed, pool.HandshakeTimeout)
+	}
+	if len(pool.List()) != 0 {
+		t.Error("relay that failed the handshake was added to the pool")
+	}
+}
+
+func TestPoolReconnectResume(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.Store(textNote)
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.Reconnect = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, Resume: true, ResumeOverlap: 30 * time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	select {
+	case <-sub.Events:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the stored event")
+	}
+
+	// the REQ sent again after the relay comes back asks only for events since the one
+	// received, minus the overlap
+	relay.Restart()
+	var reqs [][]json.RawMessage
+	for len(reqs) < 2 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		reqs = relay.Received("REQ")
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("relay received %d REQs; want 2", len(reqs))
+	}
+	var filter Filter
+	if err := json.Unmarshal(reqs[1][1], &filter); err != nil {
+		t.Fatalf("invalid filter in the second REQ: %v", err)
+	}
+	want := textNote.CreatedAt.Add(-30 * time.Second)
+	if filter.Since == nil || !filter.Since.Equal(want) {
+		t.Errorf("second REQ has since %v; want %v", filter.Since, want)
+	}
+}
+
+func TestPoolReconnectDedup(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var stored []Event
+	for i := 0; i < 3; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("stored %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		stored = append(stored, note)
+	}
+	live := Event{Kind: 1, Content: "live", CreatedAt: time.Unix(1672068600, 0), PubKey: pub}
+	mustSignEvent(t, priv, &live)
+
+	// the mock relay ignores since, so it replays every stored event after each restart
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	for _, note := range stored {
+		relay.Store(note)
+	}
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.EventBuffer = 100 // so nothing waits for the consumer
+	pool.Reconnect = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, Resume: true}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+
+	received := make(map[string]int)
+	receive := func(content string) {
+		t.Helper()
+		for {
+			select {
+			case msg := <-sub.Events:
+				received[msg.Event.ID]++
+				if msg.Event.Content == content {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %q", content)
+			}
+		}
+	}
+	receive("stored 2")
+
+	for i := 0; i < 2; i++ {
+		relay.Restart()
+		for len(relay.Received("REQ")) < i+2 && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	relay.Broadcast(live)
+	receive("live")
+	// anything replayed after the live event would show up by now
+	time.Sleep(100 * time.Millisecond)
+	for empty := false; !empty; {
+		select {
+		case msg := <-sub.Events:
+			received[msg.Event.ID]++
+		default:
+			empty = true
+		}
+	}
+
+	if len(received) != 4 {
+		t.Errorf("received %d different events; want 4", len(received))
+	}
+	for id, n := range received {
+		if n > 1 {
+			t.Errorf("received %s %d times", id, n)
+		}
+	}
+}
+
+func TestPoolReconnectDropped(t *testing.T) {
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.Reconnect = &ReconnectPolicy{InitialDelay: 200 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	<-pool.Status // connected
+
+	// the connection has been up for longer than the initial delay, so dropping it without a
+	// close frame is retried right away
+	time.Sleep(300 * time.Millisecond)
+	relay.Disconnect()
+	select {
+	case status := <-pool.Status:
+		if status.State != ConnectionStateReconnecting || status.CloseCode != gorilla.CloseAbnormalClosure {
+			t.Errorf("got status %+v; want reconnecting with close code %d", status, gorilla.CloseAbnormalClosure)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the connection to drop")
+	}
+	select {
+	case status := <-pool.Status:
+		if status.State != ConnectionStateConnected {
+			t.Errorf("got status %+v; want connected", status)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("relay dropping the connection wasn't re-dialed right away")
+	}
+}
+
+func TestPoolPingInterval(t *testing.T) {
+	// fake relay reporting the pings it gets
+	pinged := make(chan struct{}, 1)
+	ws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		socket, err := (&gorilla.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer socket.Close()
+		socket.SetPingHandler(func(string) error {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		for {
+			if _, _, err := socket.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer ws.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.PingInterval = 50 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	select {
+	case <-pinged:
+	case <-ctx.Done():
+		t.Fatal("relay was never pinged")
+	}
+}
+
+func TestPoolDialerAndHeaders(t *testing.T) {
+	// fake relay server recording the handshake headers
+	headers := make(chan http.Header, 1)
+	ws := httptest.NewServer(&websocket.Server{
+		Handshake: func(conf *websocket.Config, r *http.Request) error {
+			headers <- r.Header
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			io.ReadAll(conn) // discard all input
+		},
+	})
+	defer ws.Close()
+
+	var dialed int32
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.Dialer = &gorilla.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			return net.Dial(network, addr)
+		},
+	}
+	pool.RequestHeader = http.Header{"Authorization": {"Bearer xyz"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	if atomic.LoadInt32(&dialed) != 1 {
+		t.Error("custom dialer was not used")
+	}
+	if auth := (<-headers).Get("Authorization"); auth != "Bearer xyz" {
+		t.Errorf("handshake Authorization header is %q; want %q", auth, "Bearer xyz")
+	}
+}
+
+func TestPoolEnableCompression(t *testing.T) {
+	// fake relays with and without compression, reporting the extensions offered to them
+	offered := make(chan string, 2)
+	newServer := func(compress bool) *httptest.Server {
+		upgrader := gorilla.Upgrader{EnableCompression: compress}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			offered <- r.Header.Get("Sec-WebSocket-Extensions")
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.WriteJSON([]any{"NOTICE", strings.Repeat("hello ", 100)})
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}))
+	}
+	compressed := newServer(true)
+	defer compressed.Close()
+	plain := newServer(false)
+	defer plain.Close()
+
+	pool := NewRelayPool()
+	pool.EnableCompression = true
+	defer pool.Close()
+	for _, url := range []string{compressed.URL, plain.URL} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := pool.Add(ctx, url, nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("pool.Add(%s): %v", url, err)
+		}
+		if extensions := <-offered; !strings.Contains(extensions, "permessage-deflate") {
+			t.Errorf("%s was offered extensions %q; want permessage-deflate", url, extensions)
+		}
+	}
+
+	// both relays work, whether they compress or not
+	for i := 0; i < 2; i++ {
+		select {
+		case notice := <-pool.Notices:
+			if len(notice.Message) != 600 {
+				t.Errorf("got notice of %d bytes from %s; want 600", len(notice.Message), notice.Relay)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the notices")
+		}
+	}
+}
+
+func TestPoolRelayEndOfStoredEvents(t *testing.T) {
+	fast := relaytest.StartMockRelay()
+	defer fast.Close()
+	slow := relaytest.StartMockRelay()
+	defer slow.Close()
+	slow.WithholdEOSE(true)
+
+	pool := mustPoolWith(t, fast.URL, slow.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+
+	// the relay done with its stored events is reported while the other one isn't
+	select {
+	case url := <-sub.RelayEndOfStoredEvents:
+		if url != NormalizeURL(fast.URL) {
+			t.Errorf("got EOSE from %s; want %s", url, fast.URL)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the EOSE of a relay")
+	}
+	select {
+	case <-sub.EndOfStoredEvents:
+		t.Error("got EndOfStoredEvents before every relay sent EOSE")
+	case url := <-sub.RelayEndOfStoredEvents:
+		t.Errorf("got EOSE from %s, which withholds it", url)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPoolUpdatePolicy(t *testing.T) {
+	reqs := make(chan string, 10)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ string
+			json.Unmarshal(raw[0], &typ)
+			reqs <- typ
+		}
+	})
+	defer ws.Close()
+
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+	relay := pool.relays[NormalizeURL(ws.URL)]
+
+	sub := pool.Sub(context.Background(), Filters{{Kinds: []int{1}}})
+	defer sub.Unsub()
+	expectMessage := func(want string) {
+		t.Helper()
+		select {
+		case typ := <-reqs:
+			if typ != want {
+				t.Errorf("relay received %s; want %s", typ, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("relay did not receive %s", want)
+		}
+	}
+	expectMessage("REQ")
+
+	if err := pool.UpdatePolicy(ws.URL, Policy{Write: true}); err != nil {
+		t.Fatalf("UpdatePolicy: %v", err)
+	}
+	expectMessage("CLOSE")
+
+	if err := pool.UpdatePolicy(ws.URL, Policy{Read: true, Write: true}); err != nil {
+		t.Fatalf("UpdatePolicy: %v", err)
+	}
+	expectMessage("REQ")
+
+	if pool.relays[NormalizeURL(ws.URL)] != relay {
+		t.Error("UpdatePolicy replaced the relay connection")
+	}
+
+	// the "CLOSE" is written without holding the pool lock, so a relay that is slow to take
+	// it doesn't block the rest of the pool
+	relay.Connection.mutex.Lock()
+	updated := make(chan error, 1)
+	go func() { updated <- pool.UpdatePolicy(ws.URL, Policy{Write: true}) }()
+	time.Sleep(50 * time.Millisecond)
+	listed := make(chan struct{})
+	go func() {
+		pool.List()
+		close(listed)
+	}()
+	select {
+	case <-listed:
+	case <-time.After(time.Second):
+		t.Error("List blocked while UpdatePolicy was writing to the relay")
+	}
+	relay.Connection.mutex.Unlock()
+	if err := <-updated; err != nil {
+		t.Fatalf("UpdatePolicy: %v", err)
+	}
+	expectMessage("CLOSE")
+
+	if err := pool.UpdatePolicy("wss://unknown.example.com", Policy{}); err == nil {
+		t.Error("UpdatePolicy on an unknown relay returned no error")
+	}
+}
+
+func TestPoolAutoAuth(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	authed := make(chan *Event, 1)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		websocket.JSON.Send(conn, []any{"AUTH", "chachacha"})
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			return
+		}
+		var typ string
+		json.Unmarshal(raw[0], &typ)
+		if typ != "AUTH" || len(raw) != 2 {
+			t.Errorf("relay received %s; want AUTH", typ)
+			return
+		}
+		var event Event
+		json.Unmarshal(raw[1], &event)
+		websocket.JSON.Send(conn, []any{"OK", event.ID, true, ""})
+		authed <- &event
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	pool := NewRelayPool()
+	pool.AutoAuth = true
+	pool.SecretKey = priv
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	select {
+	case event := <-authed:
+		if event.Kind != KindClientAuthentication || event.PubKey != pub {
+			t.Errorf("unexpected auth event %+v", event)
+		}
+		if ok, _ := event.CheckSignature(); !ok {
+			t.Error("auth event has a bad signature")
+		}
+		if event.Tags.GetFirst([]string{"challenge", "chachacha"}) == nil {
+			t.Error("auth event is missing the challenge tag")
+		}
+		if event.Tags.GetFirst([]string{"relay", NormalizeURL(ws.URL)}) == nil {
+			t.Error("auth event is missing the relay tag")
+		}
+	case err := <-pool.AuthErrors:
+		t.Fatalf("auth failed: %v", err)
+	case <-ctx.Done():
+		t.Fatal("relay did not receive AUTH")
+	}
+}
+
+func TestPoolAuthRequired(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "members only", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	// closes REQs until the client authenticates
+	private := newWebsocketServer(func(conn *websocket.Conn) {
+		authed := false
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ, subid string
+			json.Unmarshal(raw[0], &typ)
+			switch typ {
+			case "AUTH":
+				var event Event
+				json.Unmarshal(raw[1], &event)
+				authed = true
+				websocket.JSON.Send(conn, []any{"OK", event.ID, true, ""})
+			case "REQ":
+				json.Unmarshal(raw[1], &subid)
+				if !authed {
+					websocket.JSON.Send(conn, []any{"AUTH", "chachacha"})
+					websocket.JSON.Send(conn, []any{"CLOSED", subid, "auth-required: members only"})
+					continue
+				}
+				websocket.JSON.Send(conn, []any{"EVENT", subid, textNote})
+			}
+		}
+	})
+	defer private.Close()
+	// closes every REQ for some other reason
+	closing := newClosingServer(t, "error: shutting down")
+	defer closing.Close()
+
+	pool := NewRelayPool()
+	pool.AutoAuth = true
+	pool.SecretKey = priv
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, url := range []string{private.URL, closing.URL} {
+		if err := pool.Add(ctx, url, nil); err != nil {
+			t.Fatalf("pool.Add(%s): %v", url, err)
+		}
+	}
+
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	var gotEvent, gotClosed bool
+	for !gotEvent || !gotClosed {
+		select {
+		case msg := <-sub.Events:
+			if msg.Event.ID != textNote.ID || msg.Relay != NormalizeURL(private.URL) {
+				t.Errorf("received event %s from %s; want %s from %s", msg.Event.ID, msg.Relay, textNote.ID, NormalizeURL(private.URL))
+			}
+			gotEvent = true
+		case closed := <-sub.Closed:
+			if closed.Relay != NormalizeURL(closing.URL) || closed.Reason != "error: shutting down" {
+				t.Errorf("got CLOSED %+v; want only the one from %s", closed, NormalizeURL(closing.URL))
+			}
+			gotClosed = true
+		case err := <-pool.AuthErrors:
+			t.Fatalf("auth failed: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("timed out; got event: %t, got CLOSED: %t", gotEvent, gotClosed)
+		}
+	}
+}
+
+// newClosingServer is a fake relay that answers every REQ with a "CLOSED".
+func newClosingServer(t *testing.T, reason string) *httptest.Server {
+	t.Helper()
+	return newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ, subid string
+			json.Unmarshal(raw[0], &typ)
+			json.Unmarshal(raw[1], &subid)
+			if typ == "REQ" {
+				websocket.JSON.Send(conn, []any{"CLOSED", subid, reason})
+			}
+		}
+	})
+}
+
+func TestPoolSubscriptionClosed(t *testing.T) {
+	closing := newClosingServer(t, "error: shutting down")
+	defer closing.Close()
+	open := newStoredEventsServer(t)
+	defer open.Close()
+
+	t.Run("single relay", func(t *testing.T) {
+		pool := mustPoolWith(t, closing.URL)
+		defer pool.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+
+		select {
+		case closed := <-sub.Closed:
+			if closed.Relay != NormalizeURL(closing.URL) || closed.Reason != "error: shutting down" {
+				t.Errorf("got CLOSED %+v", closed)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for CLOSED")
+		}
+		select {
+		case _, ok := <-sub.Events:
+			if ok {
+				t.Error("received an event from a closed subscription")
+			}
+		case <-ctx.Done():
+			t.Fatal("sub.Events still open after its only relay closed it")
+		}
+		if subs := pool.Subscriptions(); len(subs) != 0 {
+			t.Errorf("pool still has %d subscriptions", len(subs))
+		}
+	})
+
+	t.Run("multiple relays", func(t *testing.T) {
+		pool := mustPoolWith(t, closing.URL, open.URL)
+		defer pool.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+
+		select {
+		case <-sub.Closed:
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for CLOSED")
+		}
+		// the relay still serving the subscription sends EOSE
+		select {
+		case <-sub.EndOfStoredEvents:
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for EOSE from the remaining relay")
+		}
+		subs := pool.Subscriptions()
+		if len(subs) != 1 || len(subs[0].Relays) != 1 || subs[0].Relays[0] != NormalizeURL(open.URL) {
+			t.Errorf("got subscriptions %+v; want one reading only from %s", subs, NormalizeURL(open.URL))
+		}
+	})
+}
+
+func TestPoolAutoAuthWithoutSecretKey(t *testing.T) {
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		websocket.JSON.Send(conn, []any{"AUTH", "chachacha"})
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	pool := NewRelayPool()
+	pool.AutoAuth = true
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	select {
+	case err := <-pool.AuthErrors:
+		if err == nil {
+			t.Error("got a nil auth error")
+		}
+	case <-ctx.Done():
+		t.Fatal("no auth error reported")
+	}
+}
+
+func TestPoolCount(t *testing.T) {
+	counter := func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ, id string
+			json.Unmarshal(raw[0], &typ)
+			json.Unmarshal(raw[1], &id)
+			if typ == "COUNT" {
+				websocket.JSON.Send(conn, []any{"COUNT", id, map[string]any{"count": 7}})
+			}
+		}
+	}
+	ws1 := newNIP11Server(`{"supported_nips":[1,11,45]}`, counter)
+	defer ws1.Close()
+	ws2 := newNIP11Server(`{"supported_nips":[1,11]}`, counter)
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	counts, err := pool.Count(ctx, Filters{{Kinds: []int{7}}})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if len(counts) != 1 || counts[NormalizeURL(ws1.URL)] != 7 {
+		t.Errorf("Count returned %v; want only %s with 7", counts, NormalizeURL(ws1.URL))
+	}
+}
+
+func TestPoolSubscriptionIDLimit(t *testing.T) {
+	var mu sync.Mutex // guards ids to satisfy go test -race
+	// REQ and CLOSE ids
+	ids := make(map[string][]string)
+	recorder := func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ, id string
+			json.Unmarshal(raw[0], &typ)
+			json.Unmarshal(raw[1], &id)
+			mu.Lock()
+			ids[typ] = append(ids[typ], id)
+			mu.Unlock()
+		}
+	}
+	ws := newNIP11Server(`{"limitation":{"max_subid_length":8}}`, recorder)
+	defer ws.Close()
+
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := pool.RelayInfo(ctx, ws.URL); err != nil {
+		t.Fatalf("RelayInfo: %v", err)
+	}
+
+	subs := make([]*PoolSubscription, 3)
+	seen := make(map[string]bool)
+	for i := range subs {
+		subs[i] = pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+		id := subs[i].RelayID(ws.URL)
+		if len(id) != 8 || seen[id] {
+			t.Errorf("got id %q on the relay; want a new one of 8 characters", id)
+		}
+		seen[id] = true
+	}
+	for _, sub := range subs {
+		sub.Unsub()
+	}
+
+	// CLOSE uses the same ids as REQ
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids["REQ"]) != 3 || len(ids["CLOSE"]) != 3 {
+		t.Fatalf("relay got REQs %v and CLOSEs %v; want 3 of each", ids["REQ"], ids["CLOSE"])
+	}
+	for i, id := range ids["REQ"] {
+		if !seen[id] || !seen[ids["CLOSE"][i]] {
+			t.Errorf("relay got REQ %s and CLOSE %s; want ids in %v", id, ids["CLOSE"][i], seen)
+		}
+	}
+}
+
+func TestPoolSearchFilters(t *testing.T) {
+	// fake relays recording how many filters each REQ has
+	var mu sync.Mutex
+	filters := make(map[string][]int)
+	recorder := func(name string) func(*websocket.Conn) {
+		return func(conn *websocket.Conn) {
+			for {
+				var raw []json.RawMessage
+				if err := websocket.JSON.Receive(conn, &raw); err != nil {
+					return
+				}
+				var typ string
+				json.Unmarshal(raw[0], &typ)
+				if typ == "REQ" {
+					mu.Lock()
+					filters[name] = append(filters[name], len(raw)-2)
+					mu.Unlock()
+				}
+			}
+		}
+	}
+	search := newNIP11Server(`{"supported_nips":[1,11,50]}`, recorder("search"))
+	defer search.Close()
+	plain := newNIP11Server(`{"supported_nips":[1,11]}`, recorder("plain"))
+	defer plain.Close()
+	unknown := newNIP11Server(`{}`, recorder("unknown"))
+	defer unknown.Close()
+
+	pool := mustPoolWith(t, search.URL, plain.URL, unknown.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for _, url := range []string{search.URL, plain.URL} {
+		if _, err := pool.RelayInfo(ctx, url); err != nil {
+			t.Fatalf("RelayInfo: %v", err)
+		}
+	}
+
+	pool.Sub(ctx, Filters{{Search: "nostr"}, {Kinds: []int{1}}})
+	pool.Sub(ctx, Filters{{Search: "nostr"}})
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for name, want := range map[string][]int{
+		"search":  {2, 1},
+		"plain":   {1},
+		"unknown": {2, 1},
+	} {
+		if !slices.Equal(filters[name], want) {
+			t.Errorf("%s relay got REQs with %v filters; want %v", name, filters[name], want)
+		}
+	}
+}
+
+func TestPoolSubscriptionLimits(t *testing.T) {
+	var reqs int32
+	recorder := func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ string
+			json.Unmarshal(raw[0], &typ)
+			if typ == "REQ" {
+				atomic.AddInt32(&reqs, 1)
+			}
+		}
+	}
+	ws := newNIP11Server(`{"limitation":{"max_subscriptions":2,"max_message_length":200}}`, recorder)
+	defer ws.Close()
+
+	var buf safeBuffer
+	pool := NewRelayPool()
+	pool.Logger = log.New(&buf, "", 0)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if _, err := pool.RelayInfo(ctx, ws.URL); err != nil {
+		t.Fatalf("RelayInfo: %v", err)
+	}
+
+	first := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	third := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	if id := third.RelayID(ws.URL); id != "" {
+		t.Errorf("third subscription was opened on the relay as %s", id)
+	}
+	select {
+	case msg := <-third.Closed:
+		if !strings.Contains(msg.Reason, ErrTooManySubscriptions.Error()) {
+			t.Errorf("third subscription closed with %q", msg.Reason)
+		}
+	default:
+		t.Error("third subscription wasn't reported as closed")
+	}
+
+	// closing one makes room for another, which is sent even if it is too long
+	first.Unsub()
+	authors := make([]string, 5)
+	for i := range authors {
+		authors[i] = strings.Repeat("a", 64)
+	}
+	fourth := pool.Sub(ctx, Filters{{Authors: authors}})
+	if id := fourth.RelayID(ws.URL); id == "" {
+		t.Error("fourth subscription wasn't opened on the relay")
+	}
+	if !strings.Contains(buf.String(), "more than the 200 allowed") {
+		t.Errorf("no warning about the long REQ in log %q", buf.String())
+	}
+
+	for atomic.LoadInt32(&reqs) < 3 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&reqs); n != 3 {
+		t.Errorf("relay got %d REQs; want 3", n)
+	}
+}
+
+// newNIP11Server is a fake relay that serves info as its NIP-11 document
+// and hands websocket connections to handler.
+func newNIP11Server(info string, handler func(*websocket.Conn)) *httptest.Server {
+	ws := &websocket.Server{Handshake: anyOriginHandshake, Handler: handler}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "application/nostr+json" {
+			w.Header().Set("Content-Type", "application/nostr+json")
+			w.Write([]byte(info))
+			return
+		}
+		ws.ServeHTTP(w, r)
+	}))
+}
+
+func TestPoolRelayInfoThroughProxy(t *testing.T) {
+	ws := newNIP11Server(`{"name":"hidden","supported_nips":[1,11,45]}`, func(conn *websocket.Conn) {
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+	proxy, destinations := startSOCKS5Proxy(t, ws.URL)
+	defer proxy.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.ProxyURL = "socks5://" + proxy.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, "ws://xyz2fyy6lq4ek2.onion", nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	info, err := pool.RelayInfo(ctx, "ws://xyz2fyy6lq4ek2.onion")
+	if err != nil {
+		t.Fatalf("RelayInfo: %v", err)
+	}
+	if info.Name != "hidden" {
+		t.Errorf("got document %+v; want the one of the relay", info)
+	}
+	// one connection for the websocket, one for the document
+	for i := 0; i < 2; i++ {
+		if destination := <-destinations; destination != "xyz2fyy6lq4ek2.onion:80" {
+			t.Errorf("proxy was asked for %s; want xyz2fyy6lq4ek2.onion:80", destination)
+		}
+	}
+}
+
+func TestPoolAddSpellings(t *testing.T) {
+	var connections int32
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		atomic.AddInt32(&connections, 1)
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	host := strings.TrimPrefix(ws.URL, "http://")
+	spellings := map[string]*Policy{
+		ws.URL:                     nil,
+		"ws://" + host + "/":       nil,
+		"WS://" + host:             nil,
+		" ws://" + host + " ":      nil,
+		"ws://" + host + "/#relay": nil,
+		"ws://" + host + "//":      nil,
+		"http://" + host + "/?":    nil,
+	}
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for url, err := range pool.AddAll(ctx, spellings) {
+		if err != nil {
+			t.Errorf("adding %q: %v", url, err)
+		}
+	}
+	if err := pool.Add(ctx, strings.Replace(ws.URL, "http", "ws", 1)+"/", nil); err != nil {
+		t.Errorf("pool.Add: %v", err)
+	}
+
+	if relays := pool.List(); len(relays) != 1 {
+		t.Errorf("pool has %d relays; want 1", len(relays))
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Errorf("relay got %d connections; want 1", n)
+	}
+}
+
+func TestPoolRemoveWhileDelivering(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	for i := 0; i < 20; i++ {
+		relay := relaytest.StartMockRelay()
+		pool := mustPoolWith(t, relay.URL)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+		slow := pool.Sub(ctx, Filters{{Kinds: []int{1}}}) // never read
+
+		// flood the relay's subscriptions and the notices while it is removed
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 200; j++ {
+				relay.Broadcast(textNote)
+				relay.Send("NOTICE", "flood")
+			}
+		}()
+		time.Sleep(time.Duration(i) * time.Millisecond)
+		if err := pool.Remove(relay.URL); err != nil {
+			t.Errorf("Remove: %v", err)
+		}
+		<-done
+
+		slow.Unsub()
+		cancel()
+		pool.Close()
+		relay.Close()
+	}
+}
+
+func TestPoolSubscriptions(t *testing.T) {
+	ws1 := newStoredEventsServer(t)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t)
+	defer ws2.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws1.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if err := pool.Add(ctx, ws2.URL, &Policy{Write: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	if subs := pool.Subscriptions(); len(subs) != 0 {
+		t.Fatalf("got %d subscriptions before subscribing; want 0", len(subs))
+	}
+
+	filters := Filters{{Kinds: []int{1}}}
+	sub := pool.Sub(ctx, filters)
+	subs := pool.Subscriptions()
+	if len(subs) != 1 {
+		t.Fatalf("got %d subscriptions; want 1", len(subs))
+	}
+	if subs[0].ID != sub.ID() {
+		t.Errorf("subscription has id %s; want %s", subs[0].ID, sub.ID())
+	}
+	if len(subs[0].Filters) != 1 || !FilterEqual(subs[0].Filters[0], filters[0]) {
+		t.Errorf("subscription has filters %v; want %v", subs[0].Filters, filters)
+	}
+	if len(subs[0].Relays) != 1 || subs[0].Relays[0] != NormalizeURL(ws1.URL) {
+		t.Errorf("subscription reads from %v; want only %s", subs[0].Relays, NormalizeURL(ws1.URL))
+	}
+
+	sub.Unsub()
+	if subs := pool.Subscriptions(); len(subs) != 0 {
+		t.Errorf("got %d subscriptions after Unsub; want 0", len(subs))
+	}
+}
+
+func TestPoolSubscriptionContext(t *testing.T) {
+	closed := make(chan string, 1)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ, subid string
+			json.Unmarshal(raw[0], &typ)
+			json.Unmarshal(raw[1], &subid)
+			if typ == "CLOSE" {
+				closed <- subid
+			}
+		}
+	})
+	defer ws.Close()
+
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	cancel()
+
+	select {
+	case subid := <-closed:
+		if subid != sub.ID() {
+			t.Errorf("relay got CLOSE for %s; want %s", subid, sub.ID())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay got no CLOSE after the context was cancelled")
+	}
+	if _, ok := <-sub.Events; ok {
+		t.Error("sub.Events still open after the context was cancelled")
+	}
+	if subs := pool.Subscriptions(); len(subs) != 0 {
+		t.Errorf("pool still has %d subscriptions", len(subs))
+	}
+}
+
+func TestPoolSubscriptionCollect(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 5; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+
+	ws1 := newStoredEventsServer(t, notes...)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t, notes...)
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+
+	for _, tc := range []struct {
+		limit int
+		want  int
+	}{
+		{0, 5},
+		{3, 3},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		sub := pool.PrepareSubscription()
+		sub.Filters = Filters{{Kinds: []int{1}, Limit: tc.limit}}
+		sub.DedupSize = 100
+		sub.Fire(ctx)
+
+		events, err := sub.Collect(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Collect with limit %d: %v", tc.limit, err)
+		}
+		if len(events) != tc.want {
+			t.Errorf("Collect with limit %d returned %d events; want %d", tc.limit, len(events), tc.want)
+		}
+		if _, ok := <-sub.Events; ok {
+			t.Error("Collect did not close the subscription")
+		}
+	}
+}
+
+func TestPoolSubscriptionRange(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 3; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+	ws := newStoredEventsServer(t, notes...)
+	defer ws.Close()
+
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// stop after the second event
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	var got int
+	sub.Range(ctx, func(msg EventMessage) bool {
+		got++
+		return got < 2
+	})
+	if got != 2 {
+		t.Errorf("Range called fn %d times; want 2", got)
+	}
+	if _, ok := <-sub.Events; ok {
+		t.Error("Range did not close the subscription")
+	}
+
+	// run until ctx is done, after all the stored events
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	sub = pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	got = 0
+	sub.Range(short, func(msg EventMessage) bool {
+		got++
+		return true
+	})
+	if got != len(notes) {
+		t.Errorf("Range called fn %d times; want %d", got, len(notes))
+	}
+	if _, ok := <-sub.Events; ok {
+		t.Error("Range did not close the subscription when ctx was done")
+	}
+}
+
+func TestPoolSubscriptionWaitForEOSE(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 3; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+	ws1 := newStoredEventsServer(t, notes...)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t, notes[:1]...)
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// WaitForEOSE can be called repeatedly, even after EndOfStoredEvents was read
+	sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	go func() {
+		for range sub.Events {
+		}
+	}()
+	<-sub.EndOfStoredEvents
+	for i := 0; i < 2; i++ {
+		if err := sub.WaitForEOSE(ctx); err != nil {
+			t.Fatalf("WaitForEOSE: %v", err)
+		}
+	}
+	sub.Unsub()
+
+	// a relay that never sends EOSE
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.WithholdEOSE(true)
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	sub = pool.Sub(ctx, Filters{{Kinds: []int{1}}})
+	go func() {
+		for range sub.Events {
+		}
+	}()
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if err := sub.WaitForEOSE(short); err != context.DeadlineExceeded {
+		t.Errorf("WaitForEOSE returned %v; want context.DeadlineExceeded", err)
+	}
+	sub.Unsub()
+	if err := sub.WaitForEOSE(ctx); err == nil {
+		t.Error("WaitForEOSE on a closed subscription returned no error")
+	}
+}
+
+func TestPoolQuerySync(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 4; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+
+	// the relays share some of the events
+	ws1 := newStoredEventsServer(t, notes[0], notes[2], notes[1])
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t, notes[3], notes[1])
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	events, err := pool.QuerySync(ctx, Filters{{Kinds: []int{1}}})
+	if err != nil {
+		t.Fatalf("QuerySync: %v", err)
+	}
+	if len(events) != len(notes) {
+		t.Fatalf("QuerySync returned %d events; want %d", len(events), len(notes))
+	}
+	for i, evt := range events {
+		if want := notes[len(notes)-1-i].ID; evt.ID != want {
+			t.Errorf("event %d is %s; want %s", i, evt.ID, want)
+		}
+	}
+
+	empty := NewRelayPool()
+	defer empty.Close()
+	if _, err := empty.QuerySync(ctx, Filters{{Kinds: []int{1}}}); err == nil {
+		t.Error("QuerySync on a pool without relays returned no error")
+	}
+}
+
+func TestQuerySyncEventBuffer(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 50; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+	ws := newStoredEventsServer(t, notes...)
+	defer ws.Close()
+
+	// the stored events wait in sub.Events when the "EOSE" arrives; skipping the signatures
+	// lets the reader get ahead of the subscription sooner
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.EventBuffer = 100
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws.URL, &Policy{Read: true, SkipVerify: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	rl := &Relay{URL: NormalizeURL(ws.URL), EventBuffer: 100, SkipVerify: true}
+	if err := rl.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer rl.Close()
+
+	for i := 0; i < 10; i++ {
+		events, err := pool.QuerySync(ctx, Filters{{Kinds: []int{1}}})
+		if err != nil {
+			t.Fatalf("QuerySync: %v", err)
+		}
+		if len(events) != len(notes) {
+			t.Fatalf("pool.QuerySync returned %d events; want %d", len(events), len(notes))
+		}
+		if events := rl.QuerySync(ctx, Filter{Kinds: []int{1}}); len(events) != len(notes) {
+			t.Fatalf("rl.QuerySync returned %d events; want %d", len(events), len(notes))
+		}
+	}
+}
+
+func TestPoolSubscribeNoReadRelays(t *testing.T) {
+	ws := newStoredEventsServer(t)
+	defer ws.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	if _, err := pool.Subscribe(ctx, Filters{{Kinds: []int{1}}}); err != ErrNoReadRelays {
+		t.Errorf("Subscribe on a pool without relays returned %v; want ErrNoReadRelays", err)
+	}
+
+	if err := pool.Add(ctx, ws.URL, &Policy{Write: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if _, err := pool.Subscribe(ctx, Filters{{Kinds: []int{1}}}); err != ErrNoReadRelays {
+		t.Errorf("Subscribe on a write-only pool returned %v; want ErrNoReadRelays", err)
+	}
+	if sub := pool.Sub(ctx, Filters{{Kinds: []int{1}}}); sub == nil {
+		t.Error("Sub on a write-only pool returned nil")
+	} else {
+		sub.Unsub()
+	}
+
+	if err := pool.UpdatePolicy(ws.URL, Policy{Read: true, Write: true}); err != nil {
+		t.Fatalf("UpdatePolicy: %v", err)
+	}
+	sub, err := pool.Subscribe(ctx, Filters{{Kinds: []int{1}}})
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	sub.Unsub()
+}
+
+func TestPoolWithoutEOSE(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 2; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+	relays := make([]*relaytest.MockRelay, 2)
+	for i := range relays {
+		relays[i] = relaytest.StartMockRelay()
+		defer relays[i].Close()
+		relays[i].Store(notes[0], notes[1])
+		relays[i].WithholdEOSE(true)
+	}
+
+	pool := mustPoolWith(t, relays[0].URL, relays[1].URL)
+	defer pool.Close()
+
+	for _, tc := range []struct {
+		name        string
+		idleTimeout time.Duration
+		limit       int
+	}{
+		{"idle timeout", 100 * time.Millisecond, 0},
+		{"limit", 0, 2},
+	} {
+		pool.IdleTimeout = tc.idleTimeout
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		events, err := pool.QuerySync(ctx, Filters{{Kinds: []int{1}, Limit: tc.limit}})
+		cancel()
+		if err != nil {
+			t.Errorf("QuerySync with %s: %v", tc.name, err)
+		}
+		if len(events) != len(notes) {
+			t.Errorf("QuerySync with %s returned %d events; want %d", tc.name, len(events), len(notes))
+		}
+	}
+}
+
+func TestPoolFetchProfile(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var profiles []Event
+	for i, name := range []string{"old", "new"} {
+		profile := Event{Kind: KindSetMetadata, Content: `{"name":"` + name + `"}`, CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &profile)
+		profiles = append(profiles, profile)
+	}
+	note := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068600, 0), PubKey: pub}
+	mustSignEvent(t, priv, &note)
+
+	// each relay has a different version of the profile
+	ws1 := newStoredEventsServer(t, profiles[1], note)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t, profiles[0], note)
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	profile, err := pool.FetchProfile(ctx, pub)
+	if err != nil {
+		t.Fatalf("FetchProfile: %v", err)
+	}
+	if profile == nil || profile.ID != profiles[1].ID {
+		t.Errorf("got profile %v; want the newest one", profile)
+	}
+
+	contacts, err := pool.FetchContacts(ctx, pub)
+	if err != nil {
+		t.Fatalf("FetchContacts: %v", err)
+	}
+	if contacts != nil {
+		t.Errorf("got contact list %v; want none", contacts)
+	}
+}
+
+func TestPoolSubscriptionLiveAfterStored(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	notes := make(map[string]Event)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		note := Event{Kind: 1, Content: name, CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes[name] = note
+	}
+
+	// script is a fake relay that sends its stored events and "EOSE" after a delay, then
+	// waits before sending each of its live events
+	script := func(delay time.Duration, stored []string, live ...string) *httptest.Server {
+		return newWebsocketServer(func(conn *websocket.Conn) {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var subid string
+			json.Unmarshal(raw[1], &subid)
+
+			time.Sleep(delay)
+			for _, name := range stored {
+				websocket.JSON.Send(conn, []any{"EVENT", subid, notes[name]})
+			}
+			websocket.JSON.Send(conn, []any{"EOSE", subid})
+			for _, name := range live {
+				time.Sleep(100 * time.Millisecond)
+				websocket.JSON.Send(conn, []any{"EVENT", subid, notes[name]})
+			}
+			io.ReadAll(conn)
+		})
+	}
+	// relay 1 is done early and sends "c" live while relay 2 hasn't sent it as stored
+	ws1 := script(0, []string{"a", "b"}, "c", "d")
+	defer ws1.Close()
+	ws2 := script(50*time.Millisecond, []string{"b", "c"})
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub := pool.PrepareSubscription()
+	sub.Filters = Filters{{Kinds: []int{1}}}
+	sub.LiveAfterStored = true
+	sub.Fire(ctx)
+
+	var got []string
+	timeout := time.After(500 * time.Millisecond)
+loop:
+	for {
+		select {
+		case msg := <-sub.Events:
+			if msg.EndOfStoredEvents {
+				got = append(got, "EOSE")
+			} else {
+				got = append(got, msg.Event.Content)
+			}
+		case <-timeout:
+			break loop
+		}
+	}
+
+	if len(got) != 5 || got[3] != "EOSE" || got[4] != "d" {
+		t.Fatalf("got %v; want a, b and c in any order, then EOSE and d", got)
+	}
+	stored := got[:3]
+	sort.Strings(stored)
+	if strings.Join(stored, "") != "abc" {
+		t.Errorf("got stored events %v; want a, b and c", stored)
+	}
+}
+
+func TestPoolSubscriptionSortStored(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	notes := make(map[string]Event)
+	for i, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		note := Event{Kind: 1, Content: name, CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes[name] = note
+	}
+
+	// script is a fake relay that sends its stored events and "EOSE" after a delay, then
+	// its live events
+	script := func(delay time.Duration, stored []string, live ...string) *httptest.Server {
+		return newWebsocketServer(func(conn *websocket.Conn) {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var subid string
+			json.Unmarshal(raw[1], &subid)
+
+			time.Sleep(delay)
+			for _, name := range stored {
+				websocket.JSON.Send(conn, []any{"EVENT", subid, notes[name]})
+			}
+			websocket.JSON.Send(conn, []any{"EOSE", subid})
+			for _, name := range live {
+				time.Sleep(100 * time.Millisecond)
+				websocket.JSON.Send(conn, []any{"EVENT", subid, notes[name]})
+			}
+			io.ReadAll(conn)
+		})
+	}
+
+	receive := func(sub *PoolSubscription, n int) string {
+		t.Helper()
+		var got string
+		for len(got) < n {
+			select {
+			case msg := <-sub.Events:
+				got += msg.Event.Content
+			case <-time.After(time.Second):
+				t.Fatalf("got %q; timed out waiting for %d events", got, n)
+			}
+		}
+		return got
+	}
+
+	ws1 := script(0, []string{"a", "e", "c"}, "f")
+	defer ws1.Close()
+	ws2 := script(50*time.Millisecond, []string{"d", "b"})
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub := pool.PrepareSubscription()
+	sub.Filters = Filters{{Kinds: []int{1}}}
+	sub.SortStored = true
+	sub.Fire(ctx)
+
+	// stored events come newest first, live ones as they arrive
+	if got := receive(sub, 6); got != "edcbaf" {
+		t.Errorf("got %q; want the stored events edcba, then f", got)
+	}
+
+	// with a small buffer the stored events are sorted in batches
+	ws3 := script(0, []string{"a", "c", "b", "d"})
+	defer ws3.Close()
+	batched := mustPoolWith(t, ws3.URL)
+	defer batched.Close()
+
+	sub = batched.PrepareSubscription()
+	sub.Filters = Filters{{Kinds: []int{1}}}
+	sub.SortStored = true
+	sub.SortBufferSize = 2
+	sub.Fire(ctx)
+
+	if got := receive(sub, 4); got != "cadb" {
+		t.Errorf("got %q; want the batches ca and db", got)
+	}
+}
+
+func TestPoolSubscriptionLatestOnly(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	older := Event{Kind: KindSetMetadata, Content: `{"name":"old"}`, CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &older)
+	newer := Event{Kind: KindSetMetadata, Content: `{"name":"new"}`, CreatedAt: time.Unix(1672068600, 0), PubKey: pub}
+	mustSignEvent(t, priv, &newer)
+	note := Event{Kind: KindTextNote, Content: "hello", CreatedAt: time.Unix(1672068500, 0), PubKey: pub}
+	mustSignEvent(t, priv, &note)
+
+	// the newer profile comes first, from the relay that doesn't have the older one
+	ws1 := newStoredEventsServer(t, newer)
+	defer ws1.Close()
+	ws2 := newStoredEventsServer(t, note, older)
+	defer ws2.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+
+	for _, latestOnly := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		sub := pool.PrepareSubscription()
+		sub.Filters = Filters{{Kinds: []int{KindSetMetadata, KindTextNote}}}
+		sub.LatestOnly = latestOnly
+		sub.Fire(ctx)
+
+		events, err := sub.Collect(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("Collect: %v", err)
+		}
+
+		var profiles []string
+		notes := 0
+		for _, evt := range events {
+			switch evt.Kind {
+			case KindSetMetadata:
+				profiles = append(profiles, evt.Content)
+			case KindTextNote:
+				notes++
+			}
+		}
+		if notes != 1 {
+			t.Errorf("LatestOnly %v: got %d notes; want 1", latestOnly, notes)
+		}
+		if latestOnly {
+			if len(profiles) != 1 || profiles[0] != newer.Content {
+				t.Errorf("LatestOnly: got profiles %v; want only %s", profiles, newer.Content)
+			}
+		} else if len(profiles) != 2 {
+			t.Errorf("got profiles %v; want both versions", profiles)
+		}
+	}
+
+	if !isNewerVersion(&Event{ID: "aa", CreatedAt: newer.CreatedAt}, &Event{ID: "bb", CreatedAt: newer.CreatedAt}) {
+		t.Error("the lowest id should win among events created at the same time")
+	}
+}
+
+func TestPoolSubscriptionLatestOnlyParameterized(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	article := func(d string, content string, createdAt int64) Event {
+		evt := Event{Kind: 30023, Content: content, CreatedAt: time.Unix(createdAt, 0), PubKey: pub}
+		if d != "" {
+			evt.Tags = Tags{{"d", d}}
+		}
+		mustSignEvent(t, priv, &evt)
+		return evt
+	}
+
+	ws := newStoredEventsServer(t,
+		article("one", "first draft", 1672068500),
+		article("one", "final", 1672068600),
+		article("two", "other article", 1672068400),
+		article("", "untagged", 1672068400),
+		article("", "untagged, newer", 1672068700),
+	)
+	defer ws.Close()
+
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub := pool.PrepareSubscription()
+	sub.Filters = Filters{{Kinds: []int{30023}}}
+	sub.LatestOnly = true
+	sub.Fire(ctx)
+
+	events, err := sub.Collect(ctx)
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	got := make(map[string]bool)
+	for _, evt := range events {
+		got[evt.Content] = true
+	}
+	if len(events) != 3 || !got["final"] || !got["other article"] || !got["untagged, newer"] {
+		t.Errorf("got %v; want the latest version of each d tag", got)
+	}
+}
+
+func TestPoolSubscriptionHeldEventsDontHoldLocks(t *testing.T) {
+	var stored []Event
+	for _, d := range []string{"one", "two"} {
+		priv, pub := makeKeyPair(t)
+		evt := Event{Kind: 30023, Content: d, CreatedAt: time.Unix(1672068500, 0), PubKey: pub, Tags: Tags{{"d", d}}}
+		mustSignEvent(t, priv, &evt)
+		stored = append(stored, evt)
+	}
+	ws := newStoredEventsServer(t, stored...)
+	defer ws.Close()
+	pool := mustPoolWith(t, ws.URL)
+	defer pool.Close()
+
+	for name, set := range map[string]func(*PoolSubscription){
+		"LatestOnly":      func(sub *PoolSubscription) { sub.LatestOnly = true },
+		"SortStored":      func(sub *PoolSubscription) { sub.SortStored = true },
+		"LiveAfterStored": func(sub *PoolSubscription) { sub.LiveAfterStored = true },
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		sub := pool.PrepareSubscription()
+		sub.Filters = Filters{{Kinds: []int{30023}}}
+		set(sub)
+		sub.Fire(ctx)
+
+		// the consumer looks at the subscription and the pool between reads
+		received := 0
+		for received < len(stored) {
+			select {
+			case msg := <-sub.Events:
+				if !msg.EndOfStoredEvents {
+					received++
+				}
+				sub.Dropped()
+				pool.List()
+			case <-ctx.Done():
+				t.Fatalf("%s: got %d events before timing out; want %d", name, received, len(stored))
+			}
+		}
+		cancel()
+	}
+}
+
+func TestPoolPublish(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	// fake relays accepting or rejecting every event
+	okServer := func(accept bool, reason string) func(*websocket.Conn) {
+		return func(conn *websocket.Conn) {
+			for {
+				var raw []json.RawMessage
+				if err := websocket.JSON.Receive(conn, &raw); err != nil {
+					return
+				}
+				var typ string
+				json.Unmarshal(raw[0], &typ)
+				if typ == "EVENT" {
+					websocket.JSON.Send(conn, []any{"OK", textNote.ID, accept, reason})
+				}
+			}
+		}
+	}
+	ws1 := newWebsocketServer(okServer(true, ""))
+	defer ws1.Close()
+	ws2 := newWebsocketServer(okServer(false, "blocked: no"))
+	defer ws2.Close()
+	ws3 := newWebsocketServer(okServer(true, ""))
+	defer ws3.Close()
+
+	pool := mustPoolWith(t, ws1.URL, ws2.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, ws3.URL, &Policy{Read: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	results, err := pool.Publish(ctx, textNote)
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results; want one per writable relay", len(results))
+	}
+	if status := results[NormalizeURL(ws1.URL)]; status.Status != PublishStatusSucceeded {
+		t.Errorf("%s status is %s; want success", ws1.URL, status.Status)
+	}
+	if status := results[NormalizeURL(ws2.URL)]; status.Status != PublishStatusRejected || status.Message != "blocked: no" {
+		t.Errorf("%s status is %s (%q); want failure", ws2.URL, status.Status, status.Message)
+	}
+
+	if err := pool.Remove(ws1.URL); err != nil {
+		t.Fatalf("pool.Remove: %v", err)
+	}
+	if _, err := pool.Publish(ctx, textNote); err == nil {
+		t.Error("Publish should fail when every relay rejects the event")
+	}
+}
+
+func TestPoolPublishTo(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	target, other, readOnly := relaytest.StartMockRelay(), relaytest.StartMockRelay(), relaytest.StartMockRelay()
+	defer target.Close()
+	defer other.Close()
+	defer readOnly.Close()
+
+	pool := mustPoolWith(t, target.URL, other.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, readOnly.URL, &Policy{Read: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	status, err := pool.PublishTo(ctx, target.URL, textNote)
+	if err != nil {
+		t.Fatalf("PublishTo: %v", err)
+	}
+	if status.Status != PublishStatusSucceeded || status.Relay != target.URL {
+		t.Errorf("got status %+v; want success from %s", status, target.URL)
+	}
+	if n := len(other.Received("EVENT")); n != 0 {
+		t.Errorf("another relay received %d events", n)
+	}
+
+	if _, err := pool.PublishTo(ctx, readOnly.URL, textNote); err == nil {
+		t.Error("PublishTo a relay the pool doesn't write to returned no error")
+	}
+	if _, err := pool.PublishTo(ctx, "wss://elsewhere.example.com", textNote); err == nil {
+		t.Error("PublishTo a relay not in the pool returned no error")
+	}
+	if n := len(readOnly.Received("EVENT")); n != 0 {
+		t.Errorf("read-only relay received %d events", n)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 3; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.Store(notes[0], notes[1])
+
+	pool := mustPoolWith(t, relay.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if stats := pool.Stats()[relay.URL]; stats != (RelayMetrics{}) {
+		t.Errorf("stats of a new relay are %+v; want zero", stats)
+	}
+	if _, err := pool.QuerySync(ctx, Filters{{Kinds: []int{1}}}); err != nil {
+		t.Fatalf("QuerySync: %v", err)
+	}
+	pool.Publish(ctx, notes[2])
+	relay.RejectEvents("blocked: no")
+	pool.Publish(ctx, notes[2])
+
+	stats := pool.Stats()[relay.URL]
+	want := RelayMetrics{EventsReceived: 2, EventsPublished: 2, Accepted: 1, Rejected: 1, LastMessage: stats.LastMessage}
+	if stats != want {
+		t.Errorf("stats are %+v; want %+v", stats, want)
+	}
+	if time.Since(stats.LastMessage) > 2*time.Second {
+		t.Errorf("last message at %v", stats.LastMessage)
+	}
+}
+
+func TestPoolPublishRetry(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	// fake relay rejecting events with reason failures times, then accepting them
+	retryServer := func(failures int, reason string, attempts *int32) *httptest.Server {
+		return newWebsocketServer(func(conn *websocket.Conn) {
+			for {
+				var raw []json.RawMessage
+				if err := websocket.JSON.Receive(conn, &raw); err != nil {
+					return
+				}
+				var typ string
+				json.Unmarshal(raw[0], &typ)
+				if typ != "EVENT" {
+					continue
+				}
+				if n := atomic.AddInt32(attempts, 1); int(n) <= failures {
+					websocket.JSON.Send(conn, []any{"OK", textNote.ID, false, reason})
+				} else {
+					websocket.JSON.Send(conn, []any{"OK", textNote.ID, true, ""})
+				}
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name     string
+		failures int
+		reason   string
+		status   Status
+		attempts int32
+	}{
+		{"rate limited", 2, "rate-limited: slow down", PublishStatusSucceeded, 3},
+		{"error", 1, "error: try again", PublishStatusSucceeded, 2},
+		{"out of retries", 10, "rate-limited: slow down", PublishStatusRejected, 4},
+		{"invalid", 10, "invalid: bad signature", PublishStatusRejected, 1},
+		{"blocked", 10, "blocked: go away", PublishStatusRejected, 1},
+	} {
+		var attempts int32
+		ws := retryServer(tc.failures, tc.reason, &attempts)
+		pool := mustPoolWith(t, ws.URL)
+		pool.PublishRetry = &RetryPolicy{InitialDelay: 10 * time.Millisecond}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		results, _ := pool.Publish(ctx, textNote)
+		cancel()
+		if status := results[NormalizeURL(ws.URL)]; status.Status != tc.status {
+			t.Errorf("%s: status is %s (%q); want %s", tc.name, status.Status, status.Message, tc.status)
+		}
+		if n := atomic.LoadInt32(&attempts); n != tc.attempts {
+			t.Errorf("%s: relay got %d attempts; want %d", tc.name, n, tc.attempts)
+		}
+
+		pool.Close()
+		ws.Close()
+	}
+}
+
+func TestPoolPublishOnlyToWritable(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	// fake relays reporting every EVENT they get
+	published := make(chan string, 10)
+	recorder := func(name string) func(*websocket.Conn) {
+		return func(conn *websocket.Conn) {
+			for {
+				var raw []json.RawMessage
+				if err := websocket.JSON.Receive(conn, &raw); err != nil {
+					return
+				}
+				var typ string
+				json.Unmarshal(raw[0], &typ)
+				if typ == "EVENT" {
+					published <- name
+					websocket.JSON.Send(conn, []any{"OK", textNote.ID, true, ""})
+				}
+			}
+		}
+	}
+	readWrite := newWebsocketServer(recorder("read-write"))
+	defer readWrite.Close()
+	readOnly := newWebsocketServer(recorder("read-only"))
+	defer readOnly.Close()
+	writeOnly := newWebsocketServer(recorder("write-only"))
+	defer writeOnly.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	for url, policy := range map[string]*Policy{
+		readWrite.URL: {Read: true, Write: true},
+		readOnly.URL:  {Read: true},
+		writeOnly.URL: {Write: true},
+	} {
+		if err := pool.Add(ctx, url, policy); err != nil {
+			t.Fatalf("pool.Add: %v", err)
+		}
+	}
+
+	if _, err := pool.Publish(ctx, textNote); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	close(published)
+	got := make(map[string]bool)
+	for name := range published {
+		got[name] = true
+	}
+	if len(got) != 2 || !got["read-write"] || !got["write-only"] {
+		t.Errorf("event published to %v; want only the writable relays", got)
+	}
+}
+
+func TestPoolReadSpecific(t *testing.T) {
+	const alice = "3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"
+	const bob = "46d0dfd3a724a302ca9175163bdf788f3606b3fd1bb12d5fe055d1e418cb60ea"
+
+	// fake relays reporting every REQ they get
+	reqs := make(chan string, 10)
+	recorder := func(name string) func(*websocket.Conn) {
+		return func(conn *websocket.Conn) {
+			for {
+				var raw []json.RawMessage
+				if err := websocket.JSON.Receive(conn, &raw); err != nil {
+					return
+				}
+				var typ, subid string
+				json.Unmarshal(raw[0], &typ)
+				json.Unmarshal(raw[1], &subid)
+				if typ == "REQ" {
+					reqs <- name
+					websocket.JSON.Send(conn, []any{"EOSE", subid})
+				}
+			}
+		}
+	}
+	general := newWebsocketServer(recorder("general"))
+	defer general.Close()
+	alicesOnly := newWebsocketServer(recorder("alice's"))
+	defer alicesOnly.Close()
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, general.URL, &Policy{
+		Read: true, Write: true,
+		ReadSpecific: map[string]SimplePolicy{alice: {Read: false}},
+	}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if err := pool.Add(ctx, alicesOnly.URL, &Policy{
+		ReadSpecific: map[string]SimplePolicy{alice: {Read: true}},
+	}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	for _, tc := range []struct {
+		filters Filters
+		want    []string
+	}{
+		{Filters{{Authors: []string{alice}}}, []string{"alice's"}},
+		{Filters{{Authors: []string{bob}}}, []string{"general"}},
+		{Filters{{Authors: []string{alice, bob}}}, []string{"alice's", "general"}},
+		{Filters{{Kinds: []int{1}}}, []string{"general"}},
+	} {
+		sub := pool.Sub(ctx, tc.filters)
+		select {
+		case <-sub.EndOfStoredEvents:
+		case <-ctx.Done():
+			t.Fatal("no EOSE")
+		}
+		sub.Unsub()
+
+		var got []string
+		for len(reqs) > 0 {
+			got = append(got, <-reqs)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("subscription %s sent to %v; want %v", tc.filters, got, tc.want)
+		}
+	}
+}
+
+func TestPoolRelaysForEvent(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 3; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+	relay1, relay2 := relaytest.StartMockRelay(), relaytest.StartMockRelay()
+	defer relay1.Close()
+	defer relay2.Close()
+	relay1.Store(notes[0], notes[1], notes[2])
+	relay2.Store(notes[0])
+
+	for _, size := range []int{10, 2} {
+		pool := mustPoolWith(t, relay1.URL, relay2.URL)
+		pool.RelayIndexSize = size
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if _, err := pool.QuerySync(ctx, Filters{{Kinds: []int{1}}}); err != nil {
+			t.Fatalf("QuerySync: %v", err)
+		}
+		cancel()
+
+		var remembered int
+		for _, note := range notes {
+			relays := pool.RelaysForEvent(note.ID)
+			if relays == nil {
+				continue
+			}
+			remembered++
+			if size < len(notes) {
+				// which relays are remembered depends on what was evicted when
+				continue
+			}
+			slices.Sort(relays)
+			want := []string{relay1.URL}
+			if note.ID == notes[0].ID {
+				want = append(want, relay2.URL)
+				slices.Sort(want)
+			}
+			if !slices.Equal(relays, want) {
+				t.Errorf("RelaysForEvent(%q) = %v; want %v", note.Content, relays, want)
+			}
+		}
+		want := len(notes)
+		if size < want {
+			want = size
+		}
+		if remembered != want {
+			t.Errorf("pool remembers the relays of %d events; want %d", remembered, want)
+		}
+		if relays := pool.RelaysForEvent("unknown"); relays != nil {
+			t.Errorf("RelaysForEvent of an unknown event = %v", relays)
+		}
+		pool.Close()
+	}
+}
+
+func TestPoolSubscriptionGlobalLimit(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	relay1, relay2 := relaytest.StartMockRelay(), relaytest.StartMockRelay()
+	defer relay1.Close()
+	defer relay2.Close()
+	for i := 0; i < 4; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		relay1.Store(note)
+		relay2.Store(note)
+	}
+
+	pool := mustPoolWith(t, relay1.URL, relay2.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub := pool.PrepareSubscription()
+	sub.Filters = Filters{{Kinds: []int{1}, Limit: 3}}
+	sub.GlobalLimit = true
+	sub.Fire(ctx)
+
+	// each relay would send 3 events, up to 6 in total: the pool stops at 3 unique ones
+	ids := make(map[string]int)
+loop:
+	for {
+		select {
+		case msg, ok := <-sub.Events:
+			if !ok {
+				break loop
+			}
+			ids[msg.Event.ID]++
+		case <-sub.EndOfStoredEvents:
+		case <-ctx.Done():
+			t.Fatal("the subscription wasn't closed after reaching the limit")
+		}
+	}
+	if len(ids) != 3 {
+		t.Errorf("got %d unique events; want 3", len(ids))
+	}
+	for id, n := range ids {
+		if n > 1 {
+			t.Errorf("got %d copies of %s", n, id)
+		}
+	}
+	if subs := relay1.Subscriptions(); len(subs) != 0 {
+		// CLOSE may still be on its way
+		time.Sleep(100 * time.Millisecond)
+		if subs := relay1.Subscriptions(); len(subs) != 0 {
+			t.Errorf("relay still has subscriptions %v", subs)
+		}
+	}
+}
+
+func TestPoolSubOn(t *testing.T) {
+	relay1, relay2, writeOnly, later := relaytest.StartMockRelay(), relaytest.StartMockRelay(), relaytest.StartMockRelay(), relaytest.StartMockRelay()
+	for _, relay := range []*relaytest.MockRelay{relay1, relay2, writeOnly, later} {
+		defer relay.Close()
+	}
+	pool := mustPoolWith(t, relay1.URL, relay2.URL)
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, writeOnly.URL, &Policy{Write: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+
+	filters := Filters{{Kinds: []int{1}}}
+	if _, err := pool.SubOn(ctx, []string{relay1.URL, "wss://unknown.example.com"}, filters); err == nil {
+		t.Error("SubOn accepted a relay that isn't in the pool")
+	}
+	if _, err := pool.SubOn(ctx, []string{writeOnly.URL}, filters); err == nil {
+		t.Error("SubOn accepted a relay the pool doesn't read from")
+	}
+	if _, err := pool.SubOn(ctx, nil, filters); !errors.Is(err, ErrNoReadRelays) {
+		t.Errorf("SubOn without relays returned %v; want ErrNoReadRelays", err)
+	}
+
+	sub, err := pool.SubOn(ctx, []string{relay1.URL + "/"}, filters)
+	if err != nil {
+		t.Fatalf("SubOn: %v", err)
+	}
+	defer sub.Unsub()
+	if err := pool.Add(ctx, later.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if err := sub.WaitForEOSE(ctx); err != nil {
+		t.Fatalf("WaitForEOSE: %v", err)
+	}
+	for relay, want := range map[*relaytest.MockRelay]int{relay1: 1, relay2: 0, writeOnly: 0, later: 0} {
+		if reqs := relay.Received("REQ"); len(reqs) != want {
+			t.Errorf("%s received %d REQs; want %d", relay.URL, len(reqs), want)
+		}
+	}
+}
+
+func TestPoolVerifyErrors(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	forged := Event{Kind: 1, Content: "forged", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &forged)
+	other := Event{Kind: 1, Content: "other", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &other)
+	forged.Sig = other.Sig
+
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.Store(forged)
+
+	pool := NewRelayPool()
+	defer pool.Close()
+	pool.Logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if events, err := pool.QuerySync(ctx, Filters{{Kinds: []int{1}}}); err != nil || len(events) != 0 {
+		t.Fatalf("QuerySync returned %d events, %v; want none", len(events), err)
+	}
+
+	select {
+	case err := <-pool.VerifyErrors:
+		var verr *VerifyError
+		if !errors.As(err, &verr) || verr.Relay != relay.URL || verr.Event.ID != forged.ID {
+			t.Errorf("got %v; want a *VerifyError for the forged event from %s", err, relay.URL)
+		}
+		if !errors.Is(err, ErrBadSignature) {
+			t.Errorf("got %v; want ErrBadSignature", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the verify error")
+	}
+}
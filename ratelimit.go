@@ -0,0 +1,81 @@
+package nostr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a message can't be sent to a relay before the context
+// is done without going over Relay.RateLimit.
+var ErrRateLimited = errors.New("rate limit would be exceeded")
+
+// RateLimit is a token bucket: up to Burst messages can be sent at once, then PerSecond
+// messages per second. A zero Burst means 1.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// limiter enforces a RateLimit.
+type limiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rl RateLimit) *limiter {
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rl.PerSecond,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a message can be sent. If that would take longer than the deadline of
+// ctx it returns ErrRateLimited right away; if ctx is done while waiting it returns ctx.Err().
+func (l *limiter) wait(ctx context.Context) error {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	var delay time.Duration
+	if l.tokens < 1 {
+		delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		l.mutex.Unlock()
+		return ErrRateLimited
+	}
+	// take the token now, so concurrent callers line up behind this one
+	l.tokens--
+	l.mutex.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give the token back
+		l.mutex.Lock()
+		l.tokens++
+		l.mutex.Unlock()
+		return ctx.Err()
+	}
+}
@@ -5,21 +5,32 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	s "github.com/SaveTheRbtz/generic-sync-map-go"
 	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr/nip11"
 )
 
+// Status is the outcome of sending an event to a relay: PublishStatusSucceeded and
+// PublishStatusRejected when the relay answered with an "OK" true or false (NIP-20),
+// PublishStatusSent when it didn't answer in time and PublishStatusFailed when the event
+// couldn't be sent at all, e.g. because the connection is broken.
 type Status int
 
 const (
 	PublishStatusSent      Status = 0
 	PublishStatusFailed    Status = -1
 	PublishStatusSucceeded Status = 1
+	PublishStatusRejected  Status = -2
 )
 
 func (s Status) String() string {
@@ -30,22 +41,304 @@ func (s Status) String() string {
 		return "failed"
 	case PublishStatusSucceeded:
 		return "success"
+	case PublishStatusRejected:
+		return "rejected"
 	}
 
 	return "unknown"
 }
 
+// PublishStatus is the outcome of publishing an event to a relay, along with the
+// human-readable message the relay sent in its "OK" command result (NIP-20), if any, or
+// the error that made it fail.
+type PublishStatus struct {
+	Relay   string
+	Status  Status
+	Message string
+}
+
+// transient tells whether publishing failed in a way that may succeed if tried again: a
+// relay that couldn't be written to or that rejected the event with one of the NIP-20
+// "rate-limited:" and "error:" prefixes. Rejections with other prefixes are permanent.
+func (s PublishStatus) transient() bool {
+	switch s.Status {
+	case PublishStatusFailed:
+		return true
+	case PublishStatusRejected:
+		return strings.HasPrefix(s.Message, "rate-limited:") || strings.HasPrefix(s.Message, "error:")
+	}
+	return false
+}
+
+// DefaultMaxMessageSize is the size of the largest frame accepted from a relay when
+// Relay.MaxMessageSize isn't set.
+const DefaultMaxMessageSize = 512 * 1024
+
+const (
+	ConnectionStateConnected    = "connected"
+	ConnectionStateDisconnected = "disconnected"
+	ConnectionStateReconnecting = "reconnecting"
+)
+
+// ConnectionStatus describes a change in the health of the connection to a relay.
+// Err is the read error that caused a disconnection, if any, and CloseCode its websocket
+// close code: websocket.CloseNormalClosure (1000) or websocket.CloseGoingAway (1001) when
+// the relay shut the connection down cleanly, websocket.CloseAbnormalClosure (1006) when
+// it broke without a close frame, and 0 when it failed for another reason, e.g. a ping
+// that never got a pong.
+type ConnectionStatus struct {
+	Relay     string
+	State     string
+	Err       error
+	CloseCode int
+}
+
+// RelayMetrics are counters of the traffic with a relay since it was connected, as returned
+// by Relay.Stats and RelayPool.Stats. EventsReceived counts the events with a valid id
+// and signature delivered to one of its subscriptions; Accepted and Rejected count the
+// "OK" answers to the events published; Reconnects counts the connections re-established
+// after one broke, which only happens with Relay.Reconnect, or RelayPool.Reconnect for the
+// relays of a pool; LastMessage is when the last frame arrived, zero if none did.
+type RelayMetrics struct {
+	EventsReceived  uint64
+	EventsPublished uint64
+	Accepted        uint64
+	Rejected        uint64
+	Reconnects      uint64
+	LastMessage     time.Time
+}
+
+// RawFrame is a frame from a relay with a label the package doesn't handle, e.g. one from
+// an experimental NIP, sent on Relay.RawMessages. Payload are the elements after the label.
+type RawFrame struct {
+	Relay   string
+	Type    string
+	Payload []json.RawMessage
+}
+
+// ParseError is sent on Relay.ParseErrors when a frame from the relay can't be parsed.
+type ParseError struct {
+	Relay   string
+	Message []byte
+	Err     error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("failed to parse message from '%s': %s: %s", e.Relay, e.Err, e.Message)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyError is sent on Relay.VerifyErrors for every event from the relay that is dropped
+// because its id or signature isn't valid. Err wraps one of the errors of Event.Verify,
+// e.g. ErrBadSignature.
+type VerifyError struct {
+	Relay string
+	Event *Event
+	Err   error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("invalid event %s from '%s': %s", e.Event.ID, e.Relay, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Logger is where a Relay logs events it drops, e.g. for bad signatures.
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// ReconnectPolicy tells a Relay how to re-dial after its connection breaks.
+// Each failed attempt multiplies the delay before the next one by Multiplier, up to MaxDelay.
+// Zero values mean 1 second, 1 minute, 2 and unlimited attempts respectively.
+// When the connection broke without a close frame, after being up for longer than the
+// initial delay, the first attempt is made right away, as that is usually a network hiccup
+// rather than the relay going down.
+//
+// Resume makes the "REQ" of each subscription, when re-sent, ask only for the events created
+// after the newest one it received, instead of everything again. ResumeOverlap (1 minute if
+// zero) is subtracted from that time to allow for clocks that are off and events that reach
+// relays late, so a few events would be delivered twice.
+//
+// DedupSize makes each subscription remember the ids of the last DedupSize events it
+// delivered, for as long as it is open and across any number of reconnections, and skip
+// the ones it already delivered when the relay sends them again, as it does for the
+// overlap of Resume, or for every stored event without it. It defaults to 1000 when Resume
+// is set, a negative value turns it off. Each id takes about 200 bytes, so the default
+// costs up to 200KB per subscription; subscriptions that get many events that aren't
+// replaceable may need more to be covered until the end of the overlap.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	MaxAttempts  int
+
+	Resume        bool
+	ResumeOverlap time.Duration
+	DedupSize     int
+}
+
+// dedupSize returns the DedupSize in effect, or 0 if there is no deduplication.
+func (rp *ReconnectPolicy) dedupSize() int {
+	if rp == nil || rp.DedupSize < 0 {
+		return 0
+	}
+	if rp.DedupSize == 0 && rp.Resume {
+		return 1000
+	}
+	return rp.DedupSize
+}
+
 type Relay struct {
 	URL string
 
+	// Logger receives the relay's log messages. A nil Logger means the standard logger
+	// from the log package.
+	Logger Logger
+
+	// Dialer and RequestHeader, if set before calling Connect, are used for the websocket
+	// handshake, e.g. to go through a proxy or send an Authorization header.
+	// A nil Dialer means websocket.DefaultDialer.
+	Dialer        *websocket.Dialer
+	RequestHeader http.Header
+
+	// ProxyURL, if set before calling Connect, makes the connection go through the proxy at
+	// that URL, overriding the Proxy of Dialer. It can be a SOCKS5 proxy, like the one of
+	// Tor for .onion relays ("socks5://127.0.0.1:9050"), which resolves the relay hostname
+	// itself, or an HTTP one ("http://proxy.example.com:3128").
+	ProxyURL string
+
+	// EnableCompression, if set before calling Connect, offers the relay permessage-deflate
+	// compression (RFC 7692) during the handshake, overriding the setting of Dialer.
+	// Relays that don't support it are still connected to, without compression.
+	EnableCompression bool
+
+	// HandshakeTimeout, if set, overrides the HandshakeTimeout of Dialer, limiting how long
+	// dialing and completing the websocket handshake can take.
+	// WriteTimeout, if set, makes every write to the relay fail if it doesn't complete
+	// within that time, instead of blocking on a stuck connection.
+	HandshakeTimeout time.Duration
+	WriteTimeout     time.Duration
+
+	// SkipVerify, if set before calling Connect, makes the relay deliver events without
+	// checking their signatures, which is the most expensive part of reading events.
+	// WARNING: this trusts the relay completely, as it can then hand out events that their
+	// alleged authors never signed. Only use it for relays under your control that already
+	// verify what they store, e.g. a local relay fed by this same program.
+	// Ids are still checked.
+	SkipVerify bool
+
+	// VerifyWorkers, if set before calling Connect, makes the relay check ids and signatures
+	// of events in that many goroutines instead of in the one reading from the connection,
+	// for subscriptions getting more events than a single core can verify.
+	// Events are still delivered in the order the relay sent them unless VerifyUnordered is
+	// set, in which case each is delivered as soon as it is verified, which is faster when
+	// consumers don't care about order. "EOSE" always comes after the stored events either way.
+	VerifyWorkers   int
+	VerifyUnordered bool
+
+	// MaxMessageSize, if set before calling Connect, is the size in bytes of the largest
+	// frame accepted from the relay; a bigger one breaks the connection, just like any other
+	// read error. Zero means DefaultMaxMessageSize, or the max_message_length of the relay
+	// if RelayPool.RelayInfo found a bigger one, for the connections made after that.
+	MaxMessageSize int64
+
+	// RateLimit, if set before calling Connect, caps how fast the relay sends "EVENT", "AUTH"
+	// and "COUNT" messages: Publish, Auth and Count wait for their turn, failing with
+	// ErrRateLimited if it wouldn't come before their context is done.
+	RateLimit *RateLimit
+	limiter   *limiter
+
+	// Reconnect, if set before calling Connect, makes the relay re-dial on read errors
+	// and re-send the "REQ" of every active subscription over the new connection, keeping
+	// the subscription ids so the relay sees the same subscriptions as before.
+	Reconnect *ReconnectPolicy
+
+	// PingInterval, if set before calling Connect, makes the relay send a websocket ping at
+	// this interval. If no pong arrives within PongTimeout (which defaults to PingInterval)
+	// the connection is treated as broken, just like on any other read error.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// EventBuffer, if set, is the buffer size of the Events channel of new subscriptions.
+	// DeliveryTimeout, if set, makes the reader drop an event (or notice) that isn't taken
+	// from its channel within that time, instead of waiting for a slow consumer and stalling
+	// everything else on the connection. Dropped events are counted by Subscription.Dropped.
+	EventBuffer     int
+	DeliveryTimeout time.Duration
+
 	Connection    *Connection
 	subscriptions s.MapOf[string, *Subscription]
 
 	Challenges      chan string // NIP-42 Challenges
-	Notices         chan string
+	challengeMutex  sync.Mutex
+	challenge       string // the last one received, see LastChallenge
 	ConnectionError chan error
 
-	okCallbacks s.MapOf[string, func(bool)]
+	// limitation is the limitation object of the relay's NIP-11 document, once
+	// RelayPool.RelayInfo fetched it, see Subscription.Fire
+	limitationMutex sync.Mutex
+	limitation      *nip11.RelayLimitationDocument
+
+	// Notices receives the "NOTICE" messages of the relay. It is buffered, but once it is
+	// full the reader waits for it to be drained (or for DeliveryTimeout), stalling the
+	// connection, so it must be read unless IgnoreNotices is set before calling Connect,
+	// in which case notices are discarded.
+	Notices       chan string
+	IgnoreNotices bool
+
+	// Reconnections gets nil every time the connection is re-established and the last dial
+	// error when Reconnect.MaxAttempts is exhausted. Values are dropped if nobody is reading.
+	Reconnections chan error
+
+	// Status receives a ConnectionStatus whenever the connection goes up or down.
+	// It is buffered, but values are dropped if nobody is reading.
+	Status chan ConnectionStatus
+
+	// ParseErrors receives a *ParseError for every malformed frame the relay sends,
+	// which is otherwise skipped. It is buffered, but values are dropped if nobody is reading.
+	ParseErrors chan error
+
+	// VerifyErrors receives a *VerifyError for every event the relay sends with an invalid
+	// id or signature, which is otherwise only logged and dropped.
+	// It is buffered, but values are dropped if nobody is reading.
+	VerifyErrors chan error
+
+	// RawMessages receives the frames with labels that aren't handled, which are otherwise
+	// ignored, so new kinds of messages can be dealt with outside of the package.
+	// It is buffered, but values are dropped if nobody is reading.
+	RawMessages chan RawFrame
+
+	okCallbacks    s.MapOf[string, func(bool, string)]
+	countCallbacks s.MapOf[string, func(int64)]
+
+	// connectionContext is cancelled when the relay is closed, so the reader
+	// goroutine and any pending channel sends can bail out
+	connectionContext       context.Context
+	connectionContextCancel context.CancelFunc
+	readers                 sync.WaitGroup
+
+	closeMutex sync.Mutex
+	closed     bool
+
+	// connected is 1 while the websocket is up, see IsConnected
+	connected int32
+	// connectedAt is when the websocket last came up, only used by the reader
+	connectedAt time.Time
+
+	// counters returned by Stats, updated atomically
+	eventsReceived  uint64
+	eventsPublished uint64
+	accepted        uint64
+	rejected        uint64
+	reconnects      uint64
+	lastMessage     int64 // unix nanoseconds
 }
 
 // RelayConnect returns a relay object connected to url.
@@ -77,26 +370,86 @@ func (r *Relay) Connect(ctx context.Context) error {
 		defer cancel()
 	}
 
-	socket, _, err := websocket.DefaultDialer.DialContext(ctx, r.URL, nil)
+	socket, err := r.dial(ctx)
 	if err != nil {
-		return fmt.Errorf("error opening websocket to '%s': %w", r.URL, err)
+		return err
 	}
+	r.prepareSocket(socket)
 
 	r.Challenges = make(chan string)
-	r.Notices = make(chan string)
+	r.Notices = make(chan string, 8)
 	r.ConnectionError = make(chan error)
+	r.Reconnections = make(chan error, 1)
+	r.Status = make(chan ConnectionStatus, 8)
+	r.ParseErrors = make(chan error, 8)
+	r.VerifyErrors = make(chan error, 8)
+	r.RawMessages = make(chan RawFrame, 8)
+	r.connectionContext, r.connectionContextCancel = context.WithCancel(context.Background())
+
+	if r.RateLimit != nil && r.RateLimit.PerSecond > 0 {
+		r.limiter = newLimiter(*r.RateLimit)
+	}
 
 	conn := NewConnection(socket)
+	conn.writeTimeout = r.WriteTimeout
 	r.Connection = conn
+	r.notifyStatus(ConnectionStateConnected, nil)
+
+	if r.PingInterval > 0 {
+		r.readers.Add(1)
+		go func() {
+			defer r.readers.Done()
+
+			ticker := time.NewTicker(r.PingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					conn.Ping(time.Now().Add(r.PingInterval))
+				case <-r.connectionContext.Done():
+					return
+				}
+			}
+		}()
+	}
 
+	var submit func(*verifyJob)
+	if r.VerifyWorkers > 0 {
+		submit = r.startVerifiers()
+	}
+
+	r.readers.Add(1)
 	go func() {
+		defer r.readers.Done()
+
 		for {
 			typ, message, err := conn.socket.ReadMessage()
 			if err != nil {
-				r.ConnectionError <- err
-				break
+				if r.connectionContext.Err() != nil {
+					// we were closed
+					return
+				}
+				code := closeCode(err)
+				if code == websocket.CloseNormalClosure || code == websocket.CloseGoingAway {
+					r.logf("%s closed the connection: %v", r.URL, err)
+				} else {
+					r.logf("read error from %s: %v", r.URL, err)
+				}
+				if r.Reconnect != nil {
+					r.notifyStatus(ConnectionStateReconnecting, err)
+					if r.reconnect(code == websocket.CloseAbnormalClosure) {
+						continue
+					}
+				}
+				r.notifyStatus(ConnectionStateDisconnected, err)
+				select {
+				case r.ConnectionError <- err:
+				case <-r.connectionContext.Done():
+				}
+				return
 			}
 
+			atomic.StoreInt64(&r.lastMessage, time.Now().UnixNano())
 			if typ == websocket.PingMessage {
 				conn.WriteMessage(websocket.PongMessage, nil)
 				continue
@@ -109,83 +462,164 @@ func (r *Relay) Connect(ctx context.Context) error {
 			var jsonMessage []json.RawMessage
 			err = json.Unmarshal(message, &jsonMessage)
 			if err != nil {
+				r.notifyParseError(message, err)
 				continue
 			}
 
 			if len(jsonMessage) < 2 {
+				r.notifyParseError(message, fmt.Errorf("expected at least 2 elements, got %d", len(jsonMessage)))
 				continue
 			}
 
 			var label string
-			json.Unmarshal(jsonMessage[0], &label)
+			if err := json.Unmarshal(jsonMessage[0], &label); err != nil {
+				r.notifyParseError(message, fmt.Errorf("invalid label: %w", err))
+				continue
+			}
 
 			switch label {
 			case "NOTICE":
 				var content string
-				json.Unmarshal(jsonMessage[1], &content)
-				r.Notices <- content
+				if err := json.Unmarshal(jsonMessage[1], &content); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid notice: %w", err))
+					continue
+				}
+				if r.IgnoreNotices {
+					continue
+				}
+				if !r.deliver(func(timeout <-chan time.Time) bool {
+					select {
+					case r.Notices <- content:
+					case <-timeout:
+						return false
+					case <-r.connectionContext.Done():
+					}
+					return true
+				}) {
+					r.logf("dropped notice from %s: %s", r.URL, content)
+				}
 			case "AUTH":
 				var challenge string
-				json.Unmarshal(jsonMessage[1], &challenge)
+				if err := json.Unmarshal(jsonMessage[1], &challenge); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid challenge: %w", err))
+					continue
+				}
+				r.challengeMutex.Lock()
+				r.challenge = challenge
+				r.challengeMutex.Unlock()
+				r.readers.Add(1)
 				go func() {
-					r.Challenges <- challenge
+					defer r.readers.Done()
+					select {
+					case r.Challenges <- challenge:
+					case <-r.connectionContext.Done():
+					}
 				}()
 			case "EVENT":
 				if len(jsonMessage) < 3 {
+					r.notifyParseError(message, fmt.Errorf("EVENT without an event"))
 					continue
 				}
 
 				var channel string
-				json.Unmarshal(jsonMessage[1], &channel)
+				if err := json.Unmarshal(jsonMessage[1], &channel); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid subscription id: %w", err))
+					continue
+				}
 				if subscription, ok := r.subscriptions.Load(channel); ok {
 					var event Event
-					json.Unmarshal(jsonMessage[2], &event)
-
-					// check signature of all received events, ignore invalid
-					ok, err := event.CheckSignature()
-					if !ok {
-						errmsg := ""
-						if err != nil {
-							errmsg = err.Error()
-						}
-						log.Printf("bad signature: %s", errmsg)
+					if err := json.Unmarshal(jsonMessage[2], &event); err != nil {
+						r.notifyParseError(message, fmt.Errorf("invalid event: %w", err))
 						continue
 					}
 
-					// check if the event matches the desired filter, ignore otherwise
-					func() {
-						subscription.mutex.Lock()
-						defer subscription.mutex.Unlock()
-						if !subscription.Filters.Match(&event) || subscription.stopped {
-							return
-						}
-						subscription.Events <- &event
-					}()
+					// check id and signature of all received events, ignore invalid
+					if submit != nil {
+						submit(&verifyJob{sub: subscription, event: &event})
+					} else if r.checkEvent(&event) {
+						r.deliverEvent(subscription, &event)
+					}
 				}
 			case "EOSE":
-				if len(jsonMessage) < 2 {
+				var channel string
+				if err := json.Unmarshal(jsonMessage[1], &channel); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid subscription id: %w", err))
 					continue
 				}
-				var channel string
-				json.Unmarshal(jsonMessage[1], &channel)
 				if subscription, ok := r.subscriptions.Load(channel); ok {
-					subscription.emitEose.Do(func() {
-						subscription.EndOfStoredEvents <- struct{}{}
-					})
+					if submit != nil {
+						submit(&verifyJob{sub: subscription})
+					} else {
+						r.endOfStoredEvents(subscription)
+					}
+				}
+			case "CLOSED":
+				var channel, reason string
+				if err := json.Unmarshal(jsonMessage[1], &channel); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid subscription id: %w", err))
+					continue
+				}
+				if len(jsonMessage) > 2 {
+					if err := json.Unmarshal(jsonMessage[2], &reason); err != nil {
+						r.notifyParseError(message, fmt.Errorf("invalid CLOSED message: %w", err))
+						continue
+					}
+				}
+				if subscription, ok := r.subscriptions.Load(channel); ok {
+					select {
+					case subscription.ClosedReason <- reason:
+					default:
+					}
 				}
 			case "OK":
 				if len(jsonMessage) < 3 {
+					r.notifyParseError(message, fmt.Errorf("OK without a result"))
 					continue
 				}
 				var (
 					eventId string
 					ok      bool
+					reason  string
 				)
-				json.Unmarshal(jsonMessage[1], &eventId)
-				json.Unmarshal(jsonMessage[2], &ok)
+				if err := json.Unmarshal(jsonMessage[1], &eventId); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid event id: %w", err))
+					continue
+				}
+				if err := json.Unmarshal(jsonMessage[2], &ok); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid OK result: %w", err))
+					continue
+				}
+				if len(jsonMessage) > 3 {
+					json.Unmarshal(jsonMessage[3], &reason)
+				}
 
 				if okCallback, exist := r.okCallbacks.Load(eventId); exist {
-					okCallback(ok)
+					okCallback(ok, reason)
+				}
+			case "COUNT":
+				if len(jsonMessage) < 3 {
+					r.notifyParseError(message, fmt.Errorf("COUNT without a count"))
+					continue
+				}
+				var (
+					channel string
+					result  struct {
+						Count int64 `json:"count"`
+					}
+				)
+				json.Unmarshal(jsonMessage[1], &channel)
+				if err := json.Unmarshal(jsonMessage[2], &result); err != nil {
+					r.notifyParseError(message, fmt.Errorf("invalid count: %w", err))
+					continue
+				}
+
+				if countCallback, exist := r.countCallbacks.Load(channel); exist {
+					countCallback(result.Count)
+				}
+			default:
+				select {
+				case r.RawMessages <- RawFrame{Relay: r.URL, Type: label, Payload: jsonMessage[1:]}:
+				default:
 				}
 			}
 		}
@@ -194,10 +628,283 @@ func (r *Relay) Connect(ctx context.Context) error {
 	return nil
 }
 
-// Publish sends an "EVENT" command to the relay r as in NIP-01.
-// Status can be: success, failed, or sent (no response from relay before ctx times out).
+func (r *Relay) dial(ctx context.Context) (*websocket.Conn, error) {
+	dialer := r.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	if r.HandshakeTimeout > 0 || r.EnableCompression || r.ProxyURL != "" {
+		d := *dialer
+		if r.HandshakeTimeout > 0 {
+			d.HandshakeTimeout = r.HandshakeTimeout
+		}
+		if r.EnableCompression {
+			d.EnableCompression = true
+		}
+		if r.ProxyURL != "" {
+			proxyURL, err := url.Parse(r.ProxyURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy url '%s': %w", r.ProxyURL, err)
+			}
+			d.Proxy = http.ProxyURL(proxyURL)
+		}
+		dialer = &d
+	}
+
+	socket, _, err := dialer.DialContext(ctx, r.URL, r.RequestHeader)
+	if err != nil {
+		// the dialer reports an expired context as a plain i/o timeout (sometimes slightly
+		// before ctx itself is done), so wrap the context error to let callers tell
+		// cancellation apart from a genuine connection failure
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("error opening websocket to '%s': %w (%s)", r.URL, ctx.Err(), err)
+		}
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("error opening websocket to '%s': %w (%s)", r.URL, context.DeadlineExceeded, err)
+		}
+		return nil, fmt.Errorf("error opening websocket to '%s': %w", r.URL, err)
+	}
+	return socket, nil
+}
+
+// prepareSocket applies the relay settings to a freshly dialed socket.
+func (r *Relay) prepareSocket(socket *websocket.Conn) {
+	socket.SetReadLimit(r.readLimit())
+	if r.PingInterval > 0 {
+		timeout := r.PongTimeout
+		if timeout == 0 {
+			timeout = r.PingInterval
+		}
+		socket.SetReadDeadline(time.Now().Add(r.PingInterval + timeout))
+		socket.SetPongHandler(func(string) error {
+			return socket.SetReadDeadline(time.Now().Add(r.PingInterval + timeout))
+		})
+	}
+}
+
+// reconnect keeps re-dialing r.URL as described by r.Reconnect and, once connected, swaps
+// the socket under r.Connection and re-sends the "REQ" of every active subscription.
+// If immediately is set the first attempt isn't delayed, unless the connection that broke
+// was up for less than the initial delay, so a relay dropping every connection doesn't
+// get re-dialed in a loop.
+// It returns false if it gave up or if the relay was closed in the meantime.
+func (r *Relay) reconnect(immediately bool) bool {
+	delay := r.Reconnect.InitialDelay
+	if delay == 0 {
+		delay = time.Second
+	}
+	maxDelay := r.Reconnect.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = time.Minute
+	}
+	multiplier := r.Reconnect.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	overlap := r.Reconnect.ResumeOverlap
+	if overlap == 0 {
+		overlap = time.Minute
+	}
+
+	var err error
+	for attempt := 1; r.Reconnect.MaxAttempts == 0 || attempt <= r.Reconnect.MaxAttempts; attempt++ {
+		wait := delay
+		if attempt == 1 && immediately && time.Since(r.connectedAt) > delay {
+			wait = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-r.connectionContext.Done():
+			return false
+		}
+
+		ctx, cancel := context.WithTimeout(r.connectionContext, 7*time.Second)
+		var socket *websocket.Conn
+		socket, err = r.dial(ctx)
+		cancel()
+		if err != nil {
+			delay = time.Duration(float64(delay) * multiplier)
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+			continue
+		}
+		r.prepareSocket(socket)
+
+		// Close() takes closeMutex before closing the current socket, so holding it here
+		// guarantees we never install a socket nobody is going to close
+		r.closeMutex.Lock()
+		if r.closed {
+			r.closeMutex.Unlock()
+			socket.Close()
+			return false
+		}
+		r.Connection.mutex.Lock()
+		previous := r.Connection.socket
+		r.Connection.socket = socket
+		r.Connection.mutex.Unlock()
+		r.closeMutex.Unlock()
+		// it is broken or, after a ping timeout, still open but not answering
+		previous.Close()
+
+		r.subscriptions.Range(func(_ string, sub *Subscription) bool {
+			if r.Reconnect.Resume {
+				sub.resume(overlap)
+			} else {
+				sub.fire()
+			}
+			return true
+		})
+
+		atomic.AddUint64(&r.reconnects, 1)
+		r.notifyStatus(ConnectionStateConnected, nil)
+		r.notifyReconnection(nil)
+		return true
+	}
+
+	r.notifyReconnection(err)
+	return false
+}
+
+func (r *Relay) notifyStatus(state string, err error) {
+	if state == ConnectionStateConnected {
+		atomic.StoreInt32(&r.connected, 1)
+		r.connectedAt = time.Now()
+	} else {
+		atomic.StoreInt32(&r.connected, 0)
+	}
+
+	select {
+	case r.Status <- ConnectionStatus{Relay: r.URL, State: state, Err: err, CloseCode: closeCode(err)}:
+	default:
+	}
+}
+
+// closeCode returns the websocket close code carried by err, or 0 if it has none.
+func closeCode(err error) int {
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code
+	}
+	return 0
+}
+
+// Stats returns the traffic counters of r, see RelayMetrics.
+func (r *Relay) Stats() RelayMetrics {
+	metrics := RelayMetrics{
+		EventsReceived:  atomic.LoadUint64(&r.eventsReceived),
+		EventsPublished: atomic.LoadUint64(&r.eventsPublished),
+		Accepted:        atomic.LoadUint64(&r.accepted),
+		Rejected:        atomic.LoadUint64(&r.rejected),
+		Reconnects:      atomic.LoadUint64(&r.reconnects),
+	}
+	if last := atomic.LoadInt64(&r.lastMessage); last != 0 {
+		metrics.LastMessage = time.Unix(0, last)
+	}
+	return metrics
+}
+
+// IsConnected tells whether the websocket to the relay is currently up.
+// It is false before Connect, while reconnecting and after Close.
+func (r *Relay) IsConnected() bool {
+	return atomic.LoadInt32(&r.connected) == 1
+}
+
+// deliverEvent sends event to sub if it matches its filters, counting it as dropped if it
+// isn't taken within r.DeliveryTimeout.
+func (r *Relay) deliverEvent(sub *Subscription, event *Event) {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	if !sub.Filters.Match(event) || sub.stopped {
+		return
+	}
+	if sub.seen != nil && !sub.seen.add(event.ID) {
+		return
+	}
+	if event.CreatedAt.After(sub.newest) {
+		sub.newest = event.CreatedAt
+	}
+	if !r.deliver(func(timeout <-chan time.Time) bool {
+		select {
+		case sub.Events <- event:
+		case <-timeout:
+			return false
+		case <-sub.unsubscribed:
+		case <-r.connectionContext.Done():
+		}
+		return true
+	}) {
+		atomic.AddUint64(&sub.dropped, 1)
+	}
+}
+
+// endOfStoredEvents signals sub.EndOfStoredEvents, only the first time.
+func (r *Relay) endOfStoredEvents(sub *Subscription) {
+	sub.emitEose.Do(func() {
+		sub.EndOfStoredEvents <- struct{}{}
+	})
+}
+
+// deliver runs send with a channel that fires after r.DeliveryTimeout, or never if it
+// isn't set. send returns false if it gave up because of the timeout.
+func (r *Relay) deliver(send func(timeout <-chan time.Time) bool) bool {
+	if r.DeliveryTimeout == 0 {
+		return send(nil)
+	}
+	timer := time.NewTimer(r.DeliveryTimeout)
+	defer timer.Stop()
+	return send(timer.C)
+}
+
+func (r *Relay) logf(format string, v ...any) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// LastChallenge returns the last NIP-42 challenge sent by the relay, or "" if there was none.
+func (r *Relay) LastChallenge() string {
+	r.challengeMutex.Lock()
+	defer r.challengeMutex.Unlock()
+	return r.challenge
+}
+
+// waitRateLimit waits until r.RateLimit allows sending one more message.
+func (r *Relay) waitRateLimit(ctx context.Context) error {
+	if r.limiter == nil {
+		return nil
+	}
+	return r.limiter.wait(ctx)
+}
+
+func (r *Relay) notifyParseError(message []byte, err error) {
+	select {
+	case r.ParseErrors <- &ParseError{Relay: r.URL, Message: message, Err: err}:
+	default:
+	}
+}
+
+func (r *Relay) notifyReconnection(err error) {
+	select {
+	case r.Reconnections <- err:
+	default:
+	}
+}
+
+// Publish sends an "EVENT" command to the relay r as in NIP-01 and waits for its "OK"
+// command result (NIP-20) until ctx is done, or for 3 seconds if ctx has no deadline.
+// Status can be: success, rejected, failed, or sent (no response from relay before ctx
+// times out).
 func (r *Relay) Publish(ctx context.Context, event Event) Status {
-	status := PublishStatusSent
+	return r.PublishWithStatus(ctx, event).Status
+}
+
+// PublishWithStatus is like [Relay.Publish], but also returns the message the relay
+// sent along with its "OK" command result, explaining why an event was rejected.
+func (r *Relay) PublishWithStatus(ctx context.Context, event Event) PublishStatus {
+	status := PublishStatus{Relay: r.URL, Status: PublishStatusSent}
 
 	// data races on status variable without this mutex
 	var mu sync.Mutex
@@ -215,48 +922,46 @@ func (r *Relay) Publish(ctx context.Context, event Event) Status {
 	defer cancel()
 
 	// listen for an OK callback
-	okCallback := func(ok bool) {
+	okCallback := func(ok bool, message string) {
 		mu.Lock()
 		defer mu.Unlock()
 		if ok {
-			status = PublishStatusSucceeded
+			status.Status = PublishStatusSucceeded
+			atomic.AddUint64(&r.accepted, 1)
 		} else {
-			status = PublishStatusFailed
+			status.Status = PublishStatusRejected
+			atomic.AddUint64(&r.rejected, 1)
 		}
+		status.Message = message
 		cancel()
 	}
 	r.okCallbacks.Store(event.ID, okCallback)
 	defer r.okCallbacks.Delete(event.ID)
 
 	// publish event
+	if err := r.waitRateLimit(ctx); err != nil {
+		status.Status = PublishStatusFailed
+		status.Message = err.Error()
+		return status
+	}
 	if err := r.Connection.WriteJSON([]interface{}{"EVENT", event}); err != nil {
+		status.Status = PublishStatusFailed
+		status.Message = err.Error()
 		return status
 	}
+	atomic.AddUint64(&r.eventsPublished, 1)
 
-	sub := r.Subscribe(ctx, Filters{Filter{IDs: []string{event.ID}}})
-	for {
-		select {
-		case receivedEvent := <-sub.Events:
-			if receivedEvent.ID == event.ID {
-				// we got a success, so update our status and proceed to return
-				mu.Lock()
-				status = PublishStatusSucceeded
-				mu.Unlock()
-				return status
-			}
-		case <-ctx.Done():
-			// return status as it was
-			// will proceed to return status as it is
-			// e.g. if this happens because of the timeout then status will probably be "failed"
-			//      but if it happens because okCallback was called then it might be "succeeded"
-			// do not return if okCallback is in process
-			return status
-		}
-	}
+	// the context either times out, and the status is "sent"
+	// or the okCallback is called and the status is set to "succeeded" or "failed"
+	<-ctx.Done()
+	mu.Lock()
+	defer mu.Unlock()
+	return status
 }
 
 // Auth sends an "AUTH" command client -> relay as in NIP-42.
-// Status can be: success, failed, or sent (no response from relay before ctx times out).
+// Status can be: success, rejected, failed, or sent (no response from relay before ctx
+// times out).
 func (r *Relay) Auth(ctx context.Context, event Event) Status {
 	status := PublishStatusFailed
 
@@ -276,12 +981,12 @@ func (r *Relay) Auth(ctx context.Context, event Event) Status {
 	defer cancel()
 
 	// listen for an OK callback
-	okCallback := func(ok bool) {
+	okCallback := func(ok bool, _ string) {
 		mu.Lock()
 		if ok {
 			status = PublishStatusSucceeded
 		} else {
-			status = PublishStatusFailed
+			status = PublishStatusRejected
 		}
 		mu.Unlock()
 		cancel()
@@ -290,6 +995,10 @@ func (r *Relay) Auth(ctx context.Context, event Event) Status {
 	defer r.okCallbacks.Delete(event.ID)
 
 	// send AUTH
+	if err := r.waitRateLimit(ctx); err != nil {
+		// status will be "failed"
+		return status
+	}
 	if err := r.Connection.WriteJSON([]interface{}{"AUTH", event}); err != nil {
 		// status will be "failed"
 		return status
@@ -311,18 +1020,79 @@ func (r *Relay) Auth(ctx context.Context, event Event) Status {
 // Subscribe sends a "REQ" command to the relay r as in NIP-01.
 // Events are returned through the channel sub.Events.
 // The subscription is closed when context ctx is cancelled ("CLOSE" in NIP-01).
+// If the relay is known not to allow any more subscriptions (see Subscription.Fire),
+// sub.Events is closed without sending anything.
 func (r *Relay) Subscribe(ctx context.Context, filters Filters) *Subscription {
 	if r.Connection == nil {
 		panic(fmt.Errorf("must call .Connect() first before calling .Subscribe()"))
 	}
 
 	sub := r.PrepareSubscription()
-	sub.Filters = filters
-	sub.Fire(ctx)
+	sub.Sub(ctx, filters)
 
 	return sub
 }
 
+// setLimitation makes r enforce limitation, see Subscription.Fire.
+func (r *Relay) setLimitation(limitation *nip11.RelayLimitationDocument) {
+	r.limitationMutex.Lock()
+	defer r.limitationMutex.Unlock()
+	r.limitation = limitation
+}
+
+// readLimit returns the size of the largest frame accepted from r, see MaxMessageSize.
+func (r *Relay) readLimit() int64 {
+	if r.MaxMessageSize > 0 {
+		return r.MaxMessageSize
+	}
+	r.limitationMutex.Lock()
+	defer r.limitationMutex.Unlock()
+	if r.limitation != nil && r.limitation.MaxMessageLength > DefaultMaxMessageSize {
+		return int64(r.limitation.MaxMessageLength)
+	}
+	return DefaultMaxMessageSize
+}
+
+// checkLimitation tells whether sub can be opened without going over the limits of r.
+func (r *Relay) checkLimitation(sub *Subscription) error {
+	r.limitationMutex.Lock()
+	limitation := r.limitation
+	r.limitationMutex.Unlock()
+	if limitation == nil {
+		return nil
+	}
+
+	if limitation.MaxSubscriptions > 0 {
+		// only those the relay was sent a "REQ" for and not closed count, not those prepared
+		// and never fired
+		open := 0
+		r.subscriptions.Range(func(_ string, other *Subscription) bool {
+			if other == sub {
+				return true
+			}
+			other.mutex.Lock()
+			if other.fired && !other.stopped {
+				open++
+			}
+			other.mutex.Unlock()
+			return true
+		})
+		if open >= limitation.MaxSubscriptions {
+			return fmt.Errorf("%w: '%s' allows %d", ErrTooManySubscriptions, r.URL, limitation.MaxSubscriptions)
+		}
+	}
+
+	if limitation.MaxMessageLength > 0 {
+		sub.mutex.Lock()
+		message, err := json.Marshal(sub.request())
+		sub.mutex.Unlock()
+		if err == nil && len(message) > limitation.MaxMessageLength {
+			r.logf("REQ %s has %d bytes, more than the %d allowed by %s", sub.id, len(message), limitation.MaxMessageLength, r.URL)
+		}
+	}
+	return nil
+}
+
 func (r *Relay) QuerySync(ctx context.Context, filter Filter) []*Event {
 	sub := r.Subscribe(ctx, Filters{filter})
 	defer sub.Unsub()
@@ -340,6 +1110,14 @@ func (r *Relay) QuerySync(ctx context.Context, filter Filter) []*Event {
 		case evt := <-sub.Events:
 			events = append(events, evt)
 		case <-sub.EndOfStoredEvents:
+			// the stored events buffered in sub.Events were queued before the "EOSE"
+			for n := len(sub.Events); n > 0; n-- {
+				evt, ok := <-sub.Events
+				if !ok {
+					break
+				}
+				events = append(events, evt)
+			}
 			return events
 		case <-ctx.Done():
 			return events
@@ -347,6 +1125,49 @@ func (r *Relay) QuerySync(ctx context.Context, filter Filter) []*Event {
 	}
 }
 
+// Count sends a "COUNT" command to the relay as in NIP-45 and returns the number
+// of events matching filters, without fetching them.
+// It fails if the relay doesn't reply before ctx is done.
+func (r *Relay) Count(ctx context.Context, filters Filters) (int64, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		// if no timeout is set, force it to 3 seconds
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+	}
+
+	random := make([]byte, 7)
+	rand.Read(random)
+	id := hex.EncodeToString(random)
+
+	result := make(chan int64, 1)
+	r.countCallbacks.Store(id, func(count int64) {
+		select {
+		case result <- count:
+		default:
+		}
+	})
+	defer r.countCallbacks.Delete(id)
+
+	message := []interface{}{"COUNT", id}
+	for _, filter := range filters {
+		message = append(message, filter)
+	}
+	if err := r.waitRateLimit(ctx); err != nil {
+		return 0, fmt.Errorf("failed to send COUNT to '%s': %w", r.URL, err)
+	}
+	if err := r.Connection.WriteJSON(message); err != nil {
+		return 0, fmt.Errorf("failed to send COUNT to '%s': %w", r.URL, err)
+	}
+
+	select {
+	case count := <-result:
+		return count, nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("no COUNT reply from '%s': %w", r.URL, ctx.Err())
+	}
+}
+
 func (r *Relay) PrepareSubscription() *Subscription {
 	random := make([]byte, 7)
 	rand.Read(random)
@@ -360,14 +1181,55 @@ func (r *Relay) prepareSubscription(id string) *Subscription {
 		Relay:             r,
 		conn:              r.Connection,
 		id:                id,
-		Events:            make(chan *Event),
+		Events:            make(chan *Event, r.EventBuffer),
 		EndOfStoredEvents: make(chan struct{}, 1),
+		ClosedReason:      make(chan string, 1),
+		unsubscribed:      make(chan struct{}),
+	}
+	if size := r.Reconnect.dedupSize(); size > 0 {
+		sub.seen = newIDCache(size)
 	}
 
 	r.subscriptions.Store(sub.id, sub)
 	return sub
 }
 
+// Close closes the websocket connection, stops every active subscription and waits
+// for the reader goroutine to return before closing the Notices, Challenges,
+// ConnectionError, Status and Reconnections channels. Calling Close again is a no-op.
 func (r *Relay) Close() error {
-	return r.Connection.Close()
+	r.closeMutex.Lock()
+	if r.closed {
+		r.closeMutex.Unlock()
+		return nil
+	}
+	if r.Connection == nil {
+		r.closeMutex.Unlock()
+		return fmt.Errorf("relay '%s' was never connected", r.URL)
+	}
+	r.closed = true
+	atomic.StoreInt32(&r.connected, 0)
+
+	r.connectionContextCancel()
+	err := r.Connection.Close()
+
+	// let a pending reconnect() see r.closed before we wait for the reader to return
+	r.closeMutex.Unlock()
+	r.readers.Wait()
+
+	r.subscriptions.Range(func(_ string, sub *Subscription) bool {
+		sub.Unsub()
+		return true
+	})
+
+	close(r.Notices)
+	close(r.Challenges)
+	close(r.ConnectionError)
+	close(r.Status)
+	close(r.Reconnections)
+	close(r.ParseErrors)
+	close(r.VerifyErrors)
+	close(r.RawMessages)
+
+	return err
 }
@@ -5,13 +5,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	gorilla "github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr/nip11"
+	"github.com/nbd-wtf/go-nostr/relaytest"
 	"golang.org/x/net/websocket"
 )
 
@@ -86,8 +95,414 @@ func TestPublishBlocked(t *testing.T) {
 	// connect a client and send a text note
 	rl := mustRelayConnect(ws.URL)
 	status := rl.Publish(context.Background(), textNote)
-	if status != PublishStatusFailed {
-		t.Errorf("published status is %d, not %d", status, PublishStatusSucceeded)
+	if status != PublishStatusRejected {
+		t.Errorf("published status is %d, not %d", status, PublishStatusRejected)
+	}
+}
+
+func TestPublishWithoutOK(t *testing.T) {
+	textNote := Event{Kind: 1, Content: "hello"}
+	textNote.ID = textNote.GetID()
+
+	// fake relay server that never answers
+	received := make(chan string, 10)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		defer close(received)
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ string
+			json.Unmarshal(raw[0], &typ)
+			received <- typ
+		}
+	})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	status := rl.Publish(ctx, textNote)
+	if status != PublishStatusSent {
+		t.Errorf("published status is %d, not %d", status, PublishStatusSent)
+	}
+
+	// the server closes received once the connection is gone
+	rl.Close()
+	var types []string
+	for typ := range received {
+		types = append(types, typ)
+	}
+	if len(types) != 1 || types[0] != "EVENT" {
+		t.Errorf("relay received %v; want only the EVENT", types)
+	}
+}
+
+func TestPublishWithStatus(t *testing.T) {
+	// test note to be sent over websocket
+	textNote := Event{Kind: 1, Content: "hello"}
+	textNote.ID = textNote.GetID()
+
+	// fake relay server
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		// discard received message; not interested
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			t.Errorf("websocket.JSON.Receive: %v", err)
+		}
+		// send back a not ok nip-20 command result with a reason
+		res := []any{"OK", textNote.ID, false, "rate-limited: slow down"}
+		websocket.JSON.Send(conn, res)
+	})
+	defer ws.Close()
+
+	// connect a client and send a text note
+	rl := mustRelayConnect(ws.URL)
+	status := rl.PublishWithStatus(context.Background(), textNote)
+	if status.Status != PublishStatusRejected || status.Status.String() != "rejected" {
+		t.Errorf("published status is %s, not %s", status.Status, PublishStatusRejected)
+	}
+	if status.Message != "rate-limited: slow down" {
+		t.Errorf("published status message is %q, not the relay reason", status.Message)
+	}
+	if status.Relay != rl.URL {
+		t.Errorf("published status relay is %q, not %q", status.Relay, rl.URL)
+	}
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	priv, _ := makeKeyPair(t)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			event := parseEventMessage(t, raw)
+			websocket.JSON.Send(conn, []any{"OK", event.ID, true, ""})
+		}
+	})
+	defer ws.Close()
+
+	rl := &Relay{URL: NormalizeURL(ws.URL), RateLimit: &RateLimit{PerSecond: 10, Burst: 2}}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer rl.Close()
+
+	// the first two go out right away, the other three 100ms apart
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("note %d", i)}
+		mustSignEvent(t, priv, &note)
+		if status := rl.Publish(context.Background(), note); status != PublishStatusSucceeded {
+			t.Fatalf("published status is %d, not %d", status, PublishStatusSucceeded)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("published 5 events in %v; want at least 300ms", elapsed)
+	}
+
+	// the bucket is empty now and the next slot is too far away
+	note := Event{Kind: 1, Content: "too fast"}
+	mustSignEvent(t, priv, &note)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	status := rl.PublishWithStatus(ctx, note)
+	if status.Status != PublishStatusFailed || status.Message != ErrRateLimited.Error() {
+		t.Errorf("got status %+v; want failed with %q", status, ErrRateLimited)
+	}
+}
+
+func TestSubscribeMultipleFilters(t *testing.T) {
+	filters := Filters{
+		{Kinds: []int{1}, Authors: []string{"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d"}},
+		{Kinds: []int{7}, Tags: TagMap{"e": {"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962"}}},
+	}
+
+	// fake relay server
+	received := make(chan []Filter, 1)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			t.Errorf("websocket.JSON.Receive: %v", err)
+		}
+		_, ff := parseSubscriptionMessage(t, raw)
+		received <- ff
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+	rl.Subscribe(context.Background(), filters)
+
+	ff := <-received
+	if len(ff) != len(filters) {
+		t.Fatalf("REQ carried %d filters; want %d", len(ff), len(filters))
+	}
+	for i := range filters {
+		if !FilterEqual(ff[i], filters[i]) {
+			t.Errorf("filter %d sent as %s; want %s", i, ff[i], filters[i])
+		}
+	}
+}
+
+func TestUnsubSendsClose(t *testing.T) {
+	// fake relay server
+	closed := make(chan [2]string, 1)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			t.Errorf("websocket.JSON.Receive: %v", err)
+		}
+		subid, _ := parseSubscriptionMessage(t, raw)
+
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			t.Errorf("websocket.JSON.Receive: %v", err)
+		}
+		var typ, id string
+		json.Unmarshal(raw[0], &typ)
+		json.Unmarshal(raw[1], &id)
+		if id != subid {
+			t.Errorf("CLOSE for subscription %q; want %q", id, subid)
+		}
+		closed <- [2]string{typ, id}
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+	sub := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+	sub.Unsub()
+	sub.Unsub()
+
+	if msg := <-closed; msg[0] != "CLOSE" {
+		t.Errorf("got %q after REQ; want CLOSE", msg[0])
+	}
+	if _, ok := <-sub.Events; ok {
+		t.Error("sub.Events still open after Unsub")
+	}
+	if _, ok := rl.subscriptions.Load(sub.id); ok {
+		t.Error("relay still holds the subscription after Unsub")
+	}
+}
+
+func TestCount(t *testing.T) {
+	// fake relay server
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			t.Errorf("websocket.JSON.Receive: %v", err)
+		}
+		var typ, id string
+		json.Unmarshal(raw[0], &typ)
+		json.Unmarshal(raw[1], &id)
+		if typ != "COUNT" || len(raw) != 3 {
+			t.Errorf("relay received %s with %d filters; want COUNT with 1", typ, len(raw)-2)
+		}
+		websocket.JSON.Send(conn, []any{"COUNT", id, map[string]any{"count": 42}})
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+
+	count, err := rl.Count(context.Background(), Filters{{Kinds: []int{7}}})
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if count != 42 {
+		t.Errorf("Count returned %d; want 42", count)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	// fake relay server sending garbage
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			t.Errorf("websocket.JSON.Receive: %v", err)
+		}
+		_, _ = parseSubscriptionMessage(t, raw)
+		var subid string
+		json.Unmarshal(raw[1], &subid)
+		websocket.Message.Send(conn, `["NOTICE", "trunc`)
+		websocket.Message.Send(conn, `[1, 2]`)
+		websocket.Message.Send(conn, `["EVENT", "`+subid+`", {"kind": "one"}]`)
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+	rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-rl.ParseErrors:
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.Relay != rl.URL || len(perr.Message) == 0 {
+				t.Errorf("unexpected parse error %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d parse errors; want 3", i)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	// valid event with a tampered content
+	var textNote Event
+	json.Unmarshal([]byte(`{"id":"dc90c95f09947507c1044e8f48bcf6350aa6bff1507dd4acfc755b9239b5c962","pubkey":"3bf0c63fcb93463407af97a5e5ee64fa883d107ef9e558472c4eb9aaaefa459d","created_at":1644271588,"kind":1,"tags":[],"content":"now that https://blueskyweb.org/blog/2-7-2022-overview was announced we can stop working on nostr?","sig":"230e9d8f0ddaf7eb70b5f7741ccfa37e87a455c9a469282e3464e2052d3192cd63a167e196e381ef9d7e69e9ea43af2443b839974dc85d8aaab9efe1d9296524"}`), &textNote)
+	textNote.Content = "tampered"
+
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			t.Errorf("websocket.JSON.Receive: %v", err)
+		}
+		var subid string
+		json.Unmarshal(raw[1], &subid)
+		websocket.JSON.Send(conn, []any{"EVENT", subid, textNote})
+		websocket.JSON.Send(conn, []any{"EOSE", subid})
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	var buf safeBuffer
+	rl := &Relay{URL: NormalizeURL(ws.URL), Logger: log.New(&buf, "", 0)}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer rl.Close()
+
+	sub := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+	select {
+	case <-sub.EndOfStoredEvents:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no EOSE")
+	}
+	if !strings.HasPrefix(buf.String(), "bad id") {
+		t.Errorf("logged %q; want a bad id message", buf.String())
+	}
+}
+
+// safeBuffer is a bytes.Buffer that can be written from a relay goroutine and read from the test.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDeliveryTimeout(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var notes []Event
+	for i := 0; i < 4; i++ {
+		note := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		notes = append(notes, note)
+	}
+
+	// fake relay server sending 3 events to the first subscription and 1 to the second
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var subids []string
+		for len(subids) < 2 {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				t.Errorf("websocket.JSON.Receive: %v", err)
+				return
+			}
+			var subid string
+			json.Unmarshal(raw[1], &subid)
+			subids = append(subids, subid)
+		}
+		for _, note := range notes[:3] {
+			websocket.JSON.Send(conn, []any{"EVENT", subids[0], note})
+		}
+		websocket.JSON.Send(conn, []any{"EVENT", subids[1], notes[3]})
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	rl := &Relay{URL: NormalizeURL(ws.URL), EventBuffer: 1, DeliveryTimeout: 50 * time.Millisecond}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer rl.Close()
+
+	// nobody reads from slow
+	slow := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+	fast := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+
+	select {
+	case evt := <-fast.Events:
+		if evt.ID != notes[3].ID {
+			t.Errorf("got event %s; want %s", evt.ID, notes[3].ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("a slow subscription stalled the connection")
+	}
+	// one event fits in the buffer, the other two are dropped
+	if dropped := slow.Dropped(); dropped != 2 {
+		t.Errorf("slow subscription dropped %d events; want 2", dropped)
+	}
+}
+
+func TestIgnoreNotices(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	note := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &note)
+
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			return
+		}
+		var subid string
+		json.Unmarshal(raw[1], &subid)
+		for i := 0; i < 50; i++ {
+			websocket.JSON.Send(conn, []any{"NOTICE", fmt.Sprintf("notice %d", i)})
+		}
+		websocket.JSON.Send(conn, []any{"EVENT", subid, note})
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	rl := &Relay{URL: NormalizeURL(ws.URL), IgnoreNotices: true}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer rl.Close()
+	sub := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+
+	select {
+	case evt := <-sub.Events:
+		if evt.ID != note.ID {
+			t.Errorf("got event %s; want %s", evt.ID, note.ID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ignored notices stalled the connection")
+	}
+	select {
+	case notice := <-rl.Notices:
+		t.Errorf("got notice %q; want none", notice)
+	default:
 	}
 }
 
@@ -135,6 +550,807 @@ func TestConnectContextCanceled(t *testing.T) {
 	}
 }
 
+func TestConnectContextTimeoutDuringHandshake(t *testing.T) {
+	// fake relay server that accepts tcp connections but never completes the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// relay client
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = RelayConnect(ctx, "ws://"+ln.Addr().String())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RelayConnectContext returned %v error; want context.DeadlineExceeded", err)
+	}
+}
+
+func TestConnectWithDialerAndHeaders(t *testing.T) {
+	// fake relay server recording the handshake headers
+	headers := make(chan http.Header, 1)
+	ws := httptest.NewServer(&websocket.Server{
+		Handshake: func(conf *websocket.Config, r *http.Request) error {
+			headers <- r.Header
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			io.ReadAll(conn) // discard all input
+		},
+	})
+	defer ws.Close()
+
+	var dialed bool
+	rl := &Relay{
+		URL: NormalizeURL(ws.URL),
+		Dialer: &gorilla.Dialer{
+			NetDial: func(network, addr string) (net.Conn, error) {
+				dialed = true
+				return net.Dial(network, addr)
+			},
+		},
+		RequestHeader: http.Header{"Authorization": {"Bearer xyz"}},
+	}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("rl.Connect: %v", err)
+	}
+	defer rl.Close()
+
+	if !dialed {
+		t.Error("custom dialer was not used")
+	}
+	if auth := (<-headers).Get("Authorization"); auth != "Bearer xyz" {
+		t.Errorf("handshake Authorization header is %q; want %q", auth, "Bearer xyz")
+	}
+}
+
+func TestConnectThroughProxy(t *testing.T) {
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	proxy, destinations := startSOCKS5Proxy(t, ws.URL)
+	defer proxy.Close()
+
+	rl := &Relay{URL: "ws://xyz2fyy6lq4ek2.onion", ProxyURL: "socks5://" + proxy.Addr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := rl.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer rl.Close()
+
+	if destination := <-destinations; destination != "xyz2fyy6lq4ek2.onion:80" {
+		t.Errorf("proxy was asked for %s; want xyz2fyy6lq4ek2.onion:80", destination)
+	}
+}
+
+// startSOCKS5Proxy starts a stub SOCKS5 proxy (RFC 1928) without authentication, which
+// records the destination requested by each client and connects all of them to the server
+// at upstream whatever they asked for.
+func startSOCKS5Proxy(t *testing.T, upstream string) (net.Listener, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	destinations := make(chan string, 8)
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer client.Close()
+				buf := make([]byte, 262)
+				// greeting: version, number of methods, methods
+				if _, err := io.ReadFull(client, buf[:2]); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(client, buf[:buf[1]]); err != nil {
+					return
+				}
+				client.Write([]byte{5, 0})
+				// request: version, CONNECT, reserved, domain name type, length, name, port
+				if _, err := io.ReadFull(client, buf[:5]); err != nil || buf[3] != 3 {
+					return
+				}
+				name := make([]byte, int(buf[4])+2)
+				if _, err := io.ReadFull(client, name); err != nil {
+					return
+				}
+				destinations <- fmt.Sprintf("%s:%d", name[:len(name)-2], int(name[len(name)-2])<<8|int(name[len(name)-1]))
+
+				upstream, err := net.Dial("tcp", strings.TrimPrefix(upstream, "http://"))
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				client.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(upstream, client)
+				io.Copy(client, upstream)
+			}()
+		}
+	}()
+
+	return listener, destinations
+}
+
+func TestRelayClose(t *testing.T) {
+	// fake relay server
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		io.ReadAll(conn) // discard all input
+	})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	sub := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+
+	if err := rl.Close(); err != nil {
+		t.Fatalf("rl.Close: %v", err)
+	}
+	if err := rl.Close(); err != nil {
+		t.Errorf("second rl.Close returned %v; want nil", err)
+	}
+
+	if _, ok := <-sub.Events; ok {
+		t.Error("sub.Events still open after Close")
+	}
+	if _, ok := <-rl.Notices; ok {
+		t.Error("rl.Notices still open after Close")
+	}
+	if _, ok := <-rl.ConnectionError; ok {
+		t.Error("rl.ConnectionError still open after Close")
+	}
+}
+
+func TestConnectionStatus(t *testing.T) {
+	// fake relay server hanging up as soon as the client connects
+	ws := newWebsocketServer(func(conn *websocket.Conn) {})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+
+	for _, want := range []string{ConnectionStateConnected, ConnectionStateDisconnected} {
+		select {
+		case status := <-rl.Status:
+			if status.State != want || status.Relay != rl.URL {
+				t.Errorf("got status %+v; want %s from %s", status, want, rl.URL)
+			}
+			if want == ConnectionStateDisconnected && status.Err == nil {
+				t.Error("disconnected status carries no error")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %s status", want)
+		}
+	}
+}
+
+func TestConnectionCloseCode(t *testing.T) {
+	// fake relay servers dropping the first connection after a while, with a close frame
+	// or without one
+	newDroppingServer := func(clean bool) *httptest.Server {
+		var connections int32
+		upgrader := gorilla.Upgrader{}
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if atomic.AddInt32(&connections, 1) == 1 {
+				time.Sleep(300 * time.Millisecond)
+				if clean {
+					conn.WriteMessage(gorilla.CloseMessage, gorilla.FormatCloseMessage(gorilla.CloseGoingAway, "restarting"))
+				}
+				return
+			}
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}))
+	}
+
+	for _, tc := range []struct {
+		clean bool
+		code  int
+	}{
+		{true, gorilla.CloseGoingAway},
+		{false, gorilla.CloseAbnormalClosure},
+	} {
+		ws := newDroppingServer(tc.clean)
+		rl := &Relay{URL: NormalizeURL(ws.URL), Reconnect: &ReconnectPolicy{InitialDelay: 200 * time.Millisecond}}
+		if err := rl.Connect(context.Background()); err != nil {
+			t.Fatalf("rl.Connect: %v", err)
+		}
+		<-rl.Status // connected
+
+		select {
+		case status := <-rl.Status:
+			if status.State != ConnectionStateReconnecting || status.CloseCode != tc.code {
+				t.Errorf("got status %+v; want reconnecting with close code %d", status, tc.code)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the connection to drop")
+		}
+
+		// only the abnormal closure is retried before the initial delay
+		select {
+		case status := <-rl.Status:
+			if status.State != ConnectionStateConnected {
+				t.Errorf("got status %+v; want connected", status)
+			}
+			if tc.clean {
+				t.Error("relay closing the connection cleanly was re-dialed right away")
+			}
+		case <-time.After(100 * time.Millisecond):
+			if !tc.clean {
+				t.Error("relay dropping the connection wasn't re-dialed right away")
+			}
+		}
+		rl.Close()
+		ws.Close()
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	// fake relay server sending a notice bigger than DefaultMaxMessageSize
+	huge := strings.Repeat("x", DefaultMaxMessageSize+1)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		websocket.JSON.Send(conn, []any{"NOTICE", huge})
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	for _, size := range []int64{0, 2 * DefaultMaxMessageSize} {
+		rl := &Relay{URL: NormalizeURL(ws.URL), MaxMessageSize: size, Logger: log.New(io.Discard, "", 0)}
+		if err := rl.Connect(context.Background()); err != nil {
+			t.Fatalf("rl.Connect: %v", err)
+		}
+		select {
+		case notice := <-rl.Notices:
+			if size == 0 {
+				t.Error("got a notice bigger than the default limit")
+			} else if notice != huge {
+				t.Error("got a truncated notice")
+			}
+		case err := <-rl.ConnectionError:
+			if size != 0 {
+				t.Errorf("connection with a %d bytes limit broke: %v", size, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the notice")
+		}
+		rl.Close()
+	}
+
+	// the relay information document can raise the default
+	rl := &Relay{URL: "wss://relay.example.com"}
+	rl.setLimitation(&nip11.RelayLimitationDocument{MaxMessageLength: 2 * DefaultMaxMessageSize})
+	if limit := rl.readLimit(); limit != 2*DefaultMaxMessageSize {
+		t.Errorf("read limit is %d; want max_message_length %d", limit, 2*DefaultMaxMessageSize)
+	}
+	rl.MaxMessageSize = 1024
+	if limit := rl.readLimit(); limit != 1024 {
+		t.Errorf("read limit is %d; want MaxMessageSize 1024", limit)
+	}
+}
+
+func TestSubscriptionFireErrors(t *testing.T) {
+	labels := make(chan string, 16)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var label string
+			json.Unmarshal(raw[0], &label)
+			labels <- label
+		}
+	})
+	defer ws.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	receive := func(want string) {
+		t.Helper()
+		select {
+		case label := <-labels:
+			if label != want {
+				t.Errorf("relay got %s; want %s", label, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+
+	// re-firing a subscription over max_subscriptions closes it on the relay
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+	rl.setLimitation(&nip11.RelayLimitationDocument{MaxSubscriptions: 1})
+	// subscriptions prepared and never fired don't count
+	rl.PrepareSubscription()
+	sub := rl.PrepareSubscription()
+	if err := sub.Sub(ctx, Filters{{Kinds: []int{1}}}); err != nil {
+		t.Fatalf("Sub: %v", err)
+	}
+	receive("REQ")
+	rl.setLimitation(&nip11.RelayLimitationDocument{MaxSubscriptions: 2})
+	rl.Subscribe(ctx, Filters{{Kinds: []int{3}}})
+	receive("REQ")
+	rl.setLimitation(&nip11.RelayLimitationDocument{MaxSubscriptions: 1})
+	if err := sub.Sub(ctx, Filters{{Kinds: []int{7}}}); !errors.Is(err, ErrTooManySubscriptions) {
+		t.Errorf("re-firing returned %v; want ErrTooManySubscriptions", err)
+	}
+	receive("CLOSE")
+	if _, ok := <-sub.Events; ok {
+		t.Error("sub.Events is still open")
+	}
+
+	// a "REQ" that can't be written is reported
+	broken := mustRelayConnect(ws.URL)
+	defer broken.Close()
+	sub = broken.PrepareSubscription()
+	broken.Connection.socket.Close()
+	if err := sub.Sub(ctx, Filters{{Kinds: []int{1}}}); err == nil {
+		t.Error("Sub returned nil on a closed connection")
+	}
+	if _, ok := <-sub.Events; ok {
+		t.Error("sub.Events is still open")
+	}
+}
+
+func TestKeepalivePings(t *testing.T) {
+	// fake relay servers: one reads (and so answers pings), the other is stuck
+	alive := newWebsocketServer(func(conn *websocket.Conn) {
+		io.ReadAll(conn) // discard all input
+	})
+	defer alive.Close()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	dead := newWebsocketServer(func(conn *websocket.Conn) {
+		<-stuck
+	})
+	defer dead.Close()
+
+	for _, tc := range []struct {
+		url          string
+		disconnected bool
+	}{
+		{alive.URL, false},
+		{dead.URL, true},
+	} {
+		rl := &Relay{URL: NormalizeURL(tc.url), PingInterval: 50 * time.Millisecond}
+		if err := rl.Connect(context.Background()); err != nil {
+			t.Fatalf("rl.Connect: %v", err)
+		}
+		<-rl.Status // connected
+
+		select {
+		case status := <-rl.Status:
+			if !tc.disconnected {
+				t.Errorf("got status %+v from a relay answering pings", status)
+			}
+		case <-time.After(400 * time.Millisecond):
+			if tc.disconnected {
+				t.Error("relay not answering pings was never disconnected")
+			}
+		}
+		rl.Close()
+	}
+}
+
+func TestConcurrentSubscriptions(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	// fake relay server replying to every REQ with the same event
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		for {
+			var raw []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &raw); err != nil {
+				return
+			}
+			var typ, id string
+			json.Unmarshal(raw[0], &typ)
+			json.Unmarshal(raw[1], &id)
+			if typ == "REQ" {
+				websocket.JSON.Send(conn, []any{"EVENT", id, textNote})
+			}
+		}
+	})
+	defer ws.Close()
+
+	rl := mustRelayConnect(ws.URL)
+	defer rl.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			sub := rl.Subscribe(ctx, Filters{{Kinds: []int{1}}})
+			for j := 0; j < 2; j++ {
+				select {
+				case <-sub.Events:
+				case <-ctx.Done():
+					t.Error("timed out waiting for event")
+				}
+				// replace the filters while the reader may be matching against them
+				sub.Sub(ctx, Filters{{Kinds: []int{1}, Authors: []string{pub}}})
+			}
+			sub.Unsub()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReconnect(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	// fake relay server dropping the first connection right after the REQ
+	// and answering the REQ with an event on the next one
+	var mu sync.Mutex // guards connections and subids to satisfy go test -race
+	var connections int
+	var subids []string
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		mu.Lock()
+		connections++
+		n := connections
+		mu.Unlock()
+
+		var raw []json.RawMessage
+		if err := websocket.JSON.Receive(conn, &raw); err != nil {
+			return
+		}
+		subid, _ := parseSubscriptionMessage(t, raw)
+		mu.Lock()
+		subids = append(subids, subid)
+		mu.Unlock()
+		if n == 1 {
+			return
+		}
+		websocket.JSON.Send(conn, []any{"EVENT", subid, textNote})
+		io.ReadAll(conn)
+	})
+	defer ws.Close()
+
+	rl := &Relay{
+		URL:       NormalizeURL(ws.URL),
+		Reconnect: &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 3},
+	}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("rl.Connect: %v", err)
+	}
+	defer rl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub := rl.Subscribe(ctx, Filters{{Kinds: []int{1}}})
+
+	select {
+	case err := <-rl.Reconnections:
+		if err != nil {
+			t.Fatalf("reconnection failed: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for reconnection")
+	}
+
+	select {
+	case evt := <-sub.Events:
+		if evt.ID != textNote.ID {
+			t.Errorf("received event %s; want %s", evt.ID, textNote.ID)
+		}
+	case <-ctx.Done():
+		t.Error("timed out waiting for event after reconnection")
+	}
+
+	// the REQ is sent again with the same id
+	mu.Lock()
+	defer mu.Unlock()
+	if len(subids) != 2 || subids[0] != sub.ID() || subids[1] != sub.ID() {
+		t.Errorf("got REQs with ids %v; want %s twice", subids, sub.ID())
+	}
+}
+
+func TestReconnectClosesPreviousSocket(t *testing.T) {
+	// fake relay server not answering pings on the first connection, which then reports
+	// whether the client closed it
+	var connections int32
+	stuck := make(chan struct{})
+	closed := make(chan error, 1)
+	ws := newWebsocketServer(func(conn *websocket.Conn) {
+		if atomic.AddInt32(&connections, 1) > 1 {
+			io.ReadAll(conn)
+			return
+		}
+		<-stuck
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadAll(conn)
+		closed <- err
+	})
+	defer ws.Close()
+
+	rl := &Relay{
+		URL:          NormalizeURL(ws.URL),
+		PingInterval: 50 * time.Millisecond,
+		Reconnect:    &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 3},
+	}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("rl.Connect: %v", err)
+	}
+	defer rl.Close()
+
+	select {
+	case err := <-rl.Reconnections:
+		if err != nil {
+			t.Fatalf("reconnection failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for reconnection")
+	}
+	close(stuck)
+	// reading ends with io.EOF or a failure to answer the pings left, but not a timeout
+	var netErr net.Error
+	if err := <-closed; errors.As(err, &netErr) && netErr.Timeout() {
+		t.Errorf("the previous connection wasn't closed: %v", err)
+	}
+}
+
+func TestSkipVerify(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	forged := Event{Kind: 1, Content: "forged", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &forged)
+	other := Event{Kind: 1, Content: "other", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &other)
+	forged.Sig = other.Sig // the id is still right, the signature isn't
+
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.Store(forged)
+
+	for _, skip := range []bool{false, true} {
+		rl := &Relay{URL: relay.URL, SkipVerify: skip, Logger: log.New(io.Discard, "", 0)}
+		if err := rl.Connect(context.Background()); err != nil {
+			t.Fatalf("rl.Connect: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		sub := rl.Subscribe(ctx, Filters{{Kinds: []int{1}}})
+		var got int
+	loop:
+		for {
+			select {
+			case <-sub.Events:
+				got++
+			case <-sub.EndOfStoredEvents:
+				break loop
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for EOSE")
+			}
+		}
+		cancel()
+		rl.Close()
+
+		if want := map[bool]int{false: 0, true: 1}[skip]; got != want {
+			t.Errorf("with SkipVerify %v got %d events with a bad signature; want %d", skip, got, want)
+		}
+	}
+
+	// and through a pool, for that relay only
+	pool := NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, &Policy{Read: true, SkipVerify: true}); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	if events, err := pool.QuerySync(ctx, Filters{{Kinds: []int{1}}}); err != nil || len(events) != 1 {
+		t.Errorf("QuerySync returned %d events, %v; want the forged one", len(events), err)
+	}
+}
+
+func TestUnsubWithPendingEvents(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.Store(textNote, textNote)
+
+	rl := mustRelayConnect(relay.URL)
+	defer rl.Close()
+	sub := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+
+	// nobody reads sub.Events, so the reader is stuck delivering the first event
+	time.Sleep(100 * time.Millisecond)
+	unsubscribed := make(chan struct{})
+	go func() {
+		sub.Unsub()
+		close(unsubscribed)
+	}()
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Unsub blocked on an event nobody read")
+	}
+
+	// the connection is still usable
+	other := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+	defer other.Unsub()
+	select {
+	case <-other.Events:
+	case <-time.After(time.Second):
+		t.Error("timed out waiting for an event on another subscription")
+	}
+}
+
+func TestReconnectResume(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	textNote := Event{Kind: 1, Content: "hello", CreatedAt: time.Unix(1672068534, 0), PubKey: pub}
+	mustSignEvent(t, priv, &textNote)
+
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	relay.Store(textNote)
+
+	rl := &Relay{
+		URL:       relay.URL,
+		Reconnect: &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, Resume: true, ResumeOverlap: 30 * time.Second},
+	}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("rl.Connect: %v", err)
+	}
+	defer rl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	sub := rl.Subscribe(ctx, Filters{{Kinds: []int{1}}})
+	select {
+	case <-sub.Events:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the stored event")
+	}
+
+	relay.Disconnect()
+	select {
+	case err := <-rl.Reconnections:
+		if err != nil {
+			t.Fatalf("reconnection failed: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for reconnection")
+	}
+
+	// the REQ sent again asks only for events since the one received, minus the overlap
+	var reqs [][]json.RawMessage
+	for deadline := time.Now().Add(time.Second); len(reqs) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		reqs = relay.Received("REQ")
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("relay received %d REQs; want 2", len(reqs))
+	}
+	var filter Filter
+	if err := json.Unmarshal(reqs[1][1], &filter); err != nil {
+		t.Fatalf("invalid filter in the second REQ: %v", err)
+	}
+	want := textNote.CreatedAt.Add(-30 * time.Second)
+	if filter.Since == nil || !filter.Since.Equal(want) {
+		t.Errorf("second REQ has since %v; want %v", filter.Since, want)
+	}
+	if sub.Filters[0].Since != nil {
+		t.Error("resuming changed sub.Filters")
+	}
+}
+
+func TestReconnectDedup(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	var stored []Event
+	for i := 0; i < 3; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprintf("stored %d", i), CreatedAt: time.Unix(int64(1672068534+i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		stored = append(stored, note)
+	}
+	live := Event{Kind: 1, Content: "live", CreatedAt: time.Unix(1672068600, 0), PubKey: pub}
+	mustSignEvent(t, priv, &live)
+
+	// the mock relay ignores since, so it replays every stored event after each reconnection
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	for _, note := range stored {
+		relay.Store(note)
+	}
+
+	rl := &Relay{
+		URL:         relay.URL,
+		Logger:      log.New(io.Discard, "", 0),
+		EventBuffer: 100, // so nothing waits for the consumer
+		Reconnect:   &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, Resume: true},
+	}
+	if err := rl.Connect(context.Background()); err != nil {
+		t.Fatalf("rl.Connect: %v", err)
+	}
+	defer rl.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	sub := rl.Subscribe(ctx, Filters{{Kinds: []int{1}}})
+
+	received := make(map[string]int)
+	receive := func(content string) {
+		t.Helper()
+		for {
+			select {
+			case event := <-sub.Events:
+				received[event.ID]++
+				if event.Content == content {
+					return
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for %q", content)
+			}
+		}
+	}
+	receive("stored 2")
+
+	for i := 0; i < 2; i++ {
+		relay.Disconnect()
+		select {
+		case err := <-rl.Reconnections:
+			if err != nil {
+				t.Fatalf("reconnection failed: %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for reconnection")
+		}
+		for deadline := time.Now().Add(time.Second); len(relay.Received("REQ")) < i+2 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	relay.Broadcast(live)
+	receive("live")
+	// anything replayed after the live event would show up by now
+	time.Sleep(100 * time.Millisecond)
+	for empty := false; !empty; {
+		select {
+		case event := <-sub.Events:
+			received[event.ID]++
+		default:
+			empty = true
+		}
+	}
+
+	if len(received) != 4 {
+		t.Errorf("received %d different events; want 4", len(received))
+	}
+	for id, n := range received {
+		if n > 1 {
+			t.Errorf("received %s %d times", id, n)
+		}
+	}
+}
+
 func newWebsocketServer(handler func(*websocket.Conn)) *httptest.Server {
 	return httptest.NewServer(&websocket.Server{
 		Handshake: anyOriginHandshake,
@@ -179,6 +1395,10 @@ func parseEventMessage(t *testing.T, raw []json.RawMessage) Event {
 	if typ != "EVENT" {
 		t.Errorf("typ = %q; want EVENT", typ)
 	}
+	// the event must be sent as an object, not as a string holding its (base64) json
+	if len(raw[1]) == 0 || raw[1][0] != '{' {
+		t.Errorf("event sent as %s; want a json object", raw[1])
+	}
 	var event Event
 	if err := json.Unmarshal(raw[1], &event); err != nil {
 		t.Errorf("json.Unmarshal: %v", err)
@@ -210,3 +1430,98 @@ func parseSubscriptionMessage(t *testing.T, raw []json.RawMessage) (subid string
 	}
 	return id, ff
 }
+
+func TestVerifyWorkers(t *testing.T) {
+	priv, pub := makeKeyPair(t)
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	var want []string
+	for i := 0; i < 50; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprint(i), CreatedAt: time.Unix(1672068534+int64(i), 0), PubKey: pub}
+		mustSignEvent(t, priv, &note)
+		if i == 25 {
+			note.Sig = strings.Repeat("0", 128) // dropped
+		} else {
+			want = append(want, note.ID)
+		}
+		relay.Store(note)
+	}
+
+	for _, unordered := range []bool{false, true} {
+		rl := &Relay{URL: relay.URL, VerifyWorkers: 4, VerifyUnordered: unordered, Logger: log.New(io.Discard, "", 0)}
+		if err := rl.Connect(context.Background()); err != nil {
+			t.Fatalf("rl.Connect: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		sub := rl.Subscribe(ctx, Filters{{Kinds: []int{1}}})
+		var got []string
+	loop:
+		for {
+			select {
+			case event := <-sub.Events:
+				got = append(got, event.ID)
+			case <-sub.EndOfStoredEvents:
+				break loop
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for EOSE")
+			}
+		}
+		cancel()
+		rl.Close()
+
+		if len(got) != len(want) {
+			t.Errorf("with VerifyUnordered %v got %d events before EOSE; want %d", unordered, len(got), len(want))
+			continue
+		}
+		if !unordered {
+			for i := range got {
+				if got[i] != want[i] {
+					t.Errorf("event %d is %s; want %s", i, got[i], want[i])
+					break
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkVerifyWorkers(b *testing.B) {
+	priv := GeneratePrivateKey()
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	for i := 0; i < 10000; i++ {
+		note := Event{Kind: 1, Content: fmt.Sprint(i), CreatedAt: time.Unix(1672068534+int64(i), 0)}
+		if err := note.Sign(priv); err != nil {
+			b.Fatal(err)
+		}
+		relay.Store(note)
+	}
+
+	for _, bc := range []struct {
+		name      string
+		workers   int
+		unordered bool
+	}{
+		{"reader", 0, false},
+		{"workers", runtime.NumCPU(), false},
+		{"workers-unordered", runtime.NumCPU(), true},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			rl := &Relay{URL: relay.URL, VerifyWorkers: bc.workers, VerifyUnordered: bc.unordered, EventBuffer: 1000}
+			if err := rl.Connect(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+			defer rl.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sub := rl.Subscribe(context.Background(), Filters{{Kinds: []int{1}}})
+				for got := 0; got < 10000; got++ {
+					<-sub.Events
+				}
+				<-sub.EndOfStoredEvents
+				sub.Unsub()
+			}
+		})
+	}
+}
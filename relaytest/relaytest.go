@@ -0,0 +1,270 @@
+// Package relaytest provides an in-process relay for tests of code that talks to relays.
+//
+//	relay := relaytest.StartMockRelay()
+//	defer relay.Close()
+//	relay.Store(event)            // returned to every "REQ", then "EOSE"
+//	pool.Add(ctx, relay.URL, nil)
+//	relay.Send("NOTICE", "hello") // any frame, to every client
+//	relay.Disconnect()            // drops every client connection
+//	relay.Restart()               // and comes back on the same URL
+//
+// The mock doesn't check filters, ids or signatures: every "REQ" gets all the stored events,
+// every "EVENT" and "AUTH" gets an "OK" and every "COUNT" gets the number of stored events.
+// It doesn't depend on the nostr package, so events can be of any type that marshals to
+// JSON, and the package can be used from the tests of the nostr package itself.
+package relaytest
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// MockRelay is a relay running in-process on a random local port.
+type MockRelay struct {
+	// URL is the ws:// URL of the relay
+	URL string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mutex       sync.Mutex
+	conns       map[*conn]struct{}
+	stored      []any
+	received    [][]json.RawMessage
+	rejectEvent string
+	closeReason string
+	noEOSE      bool
+}
+
+// conn is a client connected to a MockRelay.
+type conn struct {
+	socket *websocket.Conn
+	mutex  sync.Mutex // only one writer at a time
+	subs   map[string]bool
+}
+
+func (c *conn) send(frame []any) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.socket.WriteJSON(frame)
+}
+
+// StartMockRelay starts a MockRelay, which must be closed with Close.
+func StartMockRelay() *MockRelay {
+	r := &MockRelay{conns: make(map[*conn]struct{})}
+	r.upgrader.CheckOrigin = func(*http.Request) bool { return true }
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	r.URL = "ws" + strings.TrimPrefix(r.server.URL, "http")
+	return r
+}
+
+// Close disconnects every client and stops the relay.
+func (r *MockRelay) Close() {
+	r.Disconnect()
+	r.server.Close()
+}
+
+// Store adds events to the ones sent in answer to every "REQ", before the "EOSE".
+func (r *MockRelay) Store(events ...any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stored = append(r.stored, events...)
+}
+
+// Broadcast sends event to every open subscription, as a live event.
+func (r *MockRelay) Broadcast(event any) {
+	for c, subs := range r.subscriptions() {
+		for _, subid := range subs {
+			c.send([]any{"EVENT", subid, event})
+		}
+	}
+}
+
+// Send sends a frame made of label and values, e.g. Send("NOTICE", "hello") or
+// Send("CLOSED", subid, "error: shutting down"), to every connected client.
+func (r *MockRelay) Send(label string, values ...any) {
+	frame := append([]any{label}, values...)
+	r.mutex.Lock()
+	conns := make([]*conn, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mutex.Unlock()
+
+	for _, c := range conns {
+		c.send(frame)
+	}
+}
+
+// RejectEvents makes the relay answer every "EVENT" with an "OK" false and reason, e.g.
+// "blocked: not allowed". An empty reason makes it accept them again.
+func (r *MockRelay) RejectEvents(reason string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rejectEvent = reason
+}
+
+// CloseSubscriptions makes the relay answer every "REQ" with a "CLOSED" with reason, e.g.
+// "auth-required: sign in first", instead of the stored events. An empty reason makes it
+// accept subscriptions again.
+func (r *MockRelay) CloseSubscriptions(reason string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closeReason = reason
+}
+
+// WithholdEOSE makes the relay not send "EOSE" after the stored events of a "REQ", for
+// testing clients waiting for it.
+func (r *MockRelay) WithholdEOSE(withhold bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.noEOSE = withhold
+}
+
+// Disconnect drops the connection of every client, as if the network failed.
+func (r *MockRelay) Disconnect() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for c := range r.conns {
+		c.socket.Close()
+		delete(r.conns, c)
+	}
+}
+
+// Restart drops the connection of every client and stops the relay, as if it crashed, then
+// starts it again on the same URL, keeping the stored events and the received frames.
+func (r *MockRelay) Restart() {
+	addr := r.server.Listener.Addr().String()
+	r.Close()
+
+	r.server = httptest.NewUnstartedServer(http.HandlerFunc(r.serve))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic("relaytest: failed to listen on " + addr + " again: " + err.Error())
+	}
+	r.server.Listener.Close()
+	r.server.Listener = listener
+	r.server.Start()
+}
+
+// Received returns the frames received from clients with label, e.g. "REQ" or "EVENT",
+// in the order they arrived, each as its elements after the label.
+func (r *MockRelay) Received(label string) [][]json.RawMessage {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var frames [][]json.RawMessage
+	for _, frame := range r.received {
+		var l string
+		if json.Unmarshal(frame[0], &l) == nil && l == label {
+			frames = append(frames, frame[1:])
+		}
+	}
+	return frames
+}
+
+// Subscriptions returns the ids of the open subscriptions of every client.
+func (r *MockRelay) Subscriptions() []string {
+	var ids []string
+	for _, subs := range r.subscriptions() {
+		ids = append(ids, subs...)
+	}
+	return ids
+}
+
+func (r *MockRelay) subscriptions() map[*conn][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	subs := make(map[*conn][]string, len(r.conns))
+	for c := range r.conns {
+		for subid := range c.subs {
+			subs[c] = append(subs[c], subid)
+		}
+	}
+	return subs
+}
+
+func (r *MockRelay) serve(w http.ResponseWriter, req *http.Request) {
+	socket, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	c := &conn{socket: socket, subs: make(map[string]bool)}
+	r.mutex.Lock()
+	r.conns[c] = struct{}{}
+	r.mutex.Unlock()
+
+	defer func() {
+		r.mutex.Lock()
+		delete(r.conns, c)
+		r.mutex.Unlock()
+		socket.Close()
+	}()
+
+	for {
+		_, message, err := socket.ReadMessage()
+		if err != nil {
+			return
+		}
+		var frame []json.RawMessage
+		if err := json.Unmarshal(message, &frame); err != nil || len(frame) < 2 {
+			continue
+		}
+		r.handle(c, frame)
+	}
+}
+
+// handle answers a frame received from c.
+func (r *MockRelay) handle(c *conn, frame []json.RawMessage) {
+	var label, subid string
+	json.Unmarshal(frame[0], &label)
+
+	r.mutex.Lock()
+	r.received = append(r.received, frame)
+	stored := append([]any(nil), r.stored...)
+	rejectEvent, closeReason, noEOSE := r.rejectEvent, r.closeReason, r.noEOSE
+	r.mutex.Unlock()
+
+	switch label {
+	case "REQ":
+		json.Unmarshal(frame[1], &subid)
+		if closeReason != "" {
+			c.send([]any{"CLOSED", subid, closeReason})
+			return
+		}
+		r.mutex.Lock()
+		c.subs[subid] = true
+		r.mutex.Unlock()
+		for _, event := range stored {
+			c.send([]any{"EVENT", subid, event})
+		}
+		if !noEOSE {
+			c.send([]any{"EOSE", subid})
+		}
+	case "CLOSE":
+		json.Unmarshal(frame[1], &subid)
+		r.mutex.Lock()
+		delete(c.subs, subid)
+		r.mutex.Unlock()
+	case "EVENT", "AUTH":
+		var event struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(frame[1], &event)
+		if label == "EVENT" && rejectEvent != "" {
+			c.send([]any{"OK", event.ID, false, rejectEvent})
+		} else {
+			c.send([]any{"OK", event.ID, true, ""})
+		}
+	case "COUNT":
+		json.Unmarshal(frame[1], &subid)
+		c.send([]any{"COUNT", subid, map[string]int{"count": len(stored)}})
+	}
+}
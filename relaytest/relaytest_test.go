@@ -0,0 +1,116 @@
+package relaytest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/relaytest"
+)
+
+func makeNote(t *testing.T, content string) nostr.Event {
+	t.Helper()
+	note := nostr.Event{Kind: 1, Content: content}
+	if err := note.Sign(nostr.GeneratePrivateKey()); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return note
+}
+
+func TestMockRelaySubscription(t *testing.T) {
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	stored, live := makeNote(t, "stored"), makeNote(t, "live")
+	relay.Store(stored)
+
+	pool := nostr.NewRelayPool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := pool.Add(ctx, relay.URL, nil); err != nil {
+		t.Fatalf("pool.Add: %v", err)
+	}
+	sub := pool.Sub(ctx, nostr.Filters{{Kinds: []int{1}}})
+
+	receive := func(want nostr.Event) {
+		t.Helper()
+		select {
+		case msg := <-sub.Events:
+			if msg.Event.ID != want.ID {
+				t.Errorf("got event %q; want %q", msg.Event.Content, want.Content)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for event %q", want.Content)
+		}
+	}
+	receive(stored)
+	select {
+	case <-sub.EndOfStoredEvents:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for EOSE")
+	}
+
+	if ids := relay.Subscriptions(); len(ids) != 1 || ids[0] != sub.ID() {
+		t.Fatalf("relay has subscriptions %v; want %s", ids, sub.ID())
+	}
+	relay.Broadcast(live)
+	receive(live)
+
+	relay.Send("NOTICE", "hello")
+	select {
+	case notice := <-pool.Notices:
+		if notice.Message != "hello" {
+			t.Errorf("got notice %q; want hello", notice.Message)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the notice")
+	}
+
+	if reqs := relay.Received("REQ"); len(reqs) != 1 {
+		t.Errorf("relay received %d REQs; want 1", len(reqs))
+	}
+}
+
+func TestMockRelayPublish(t *testing.T) {
+	relay := relaytest.StartMockRelay()
+	defer relay.Close()
+	note := makeNote(t, "hello")
+
+	conn, err := nostr.RelayConnect(context.Background(), relay.URL)
+	if err != nil {
+		t.Fatalf("RelayConnect: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if status := conn.PublishWithStatus(ctx, note); status.Status != nostr.PublishStatusSucceeded {
+		t.Errorf("publish status is %s (%q); want success", status.Status, status.Message)
+	}
+	relay.RejectEvents("blocked: no")
+	if status := conn.PublishWithStatus(ctx, note); status.Status != nostr.PublishStatusRejected || status.Message != "blocked: no" {
+		t.Errorf("publish status is %s (%q); want failure", status.Status, status.Message)
+	}
+	if events := relay.Received("EVENT"); len(events) != 2 {
+		t.Errorf("relay received %d events; want 2", len(events))
+	}
+
+	relay.CloseSubscriptions("auth-required: sign in")
+	sub := conn.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	select {
+	case reason := <-sub.ClosedReason:
+		if reason != "auth-required: sign in" {
+			t.Errorf("subscription closed with %q", reason)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for CLOSED")
+	}
+
+	relay.Disconnect()
+	select {
+	case <-conn.ConnectionError:
+	case <-ctx.Done():
+		t.Fatal("Disconnect didn't break the connection")
+	}
+}
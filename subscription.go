@@ -2,9 +2,17 @@ package nostr
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrTooManySubscriptions is returned when opening a subscription would go over the
+// max_subscriptions of the relay's NIP-11 document.
+var ErrTooManySubscriptions = errors.New("relay doesn't allow any more subscriptions")
+
 type Subscription struct {
 	id    string
 	conn  *Connection
@@ -15,47 +23,188 @@ type Subscription struct {
 	Events            chan *Event
 	EndOfStoredEvents chan struct{}
 
+	// ClosedReason receives the message of the "CLOSED" the relay sends when it ends the
+	// subscription on its side, e.g. one starting with "auth-required:" if it only serves
+	// authenticated clients (NIP-42). sub.Events is not closed until Unsub is called.
+	// Values are dropped if nobody is reading.
+	ClosedReason chan string
+
 	stopped  bool
+	fired    bool // a "REQ" was written, so the relay needs a "CLOSE"
 	emitEose sync.Once
+
+	// unsubscribed is closed by Unsub before taking mutex, so the reader goroutine lets go
+	// of it if it is blocked delivering an event nobody reads from sub.Events
+	unsubscribed chan struct{}
+	unsubOnce    sync.Once
+
+	// newest is the created_at of the newest event received, see ReconnectPolicy.Resume
+	newest time.Time
+	// seen holds the ids of the last events delivered, see ReconnectPolicy.DedupSize
+	seen *idCache
+
+	// dropped counts the events not delivered because of Relay.DeliveryTimeout
+	dropped uint64
 }
 
 type EventMessage struct {
 	Event Event
 	Relay string
+
+	// EndOfStoredEvents is set, with an empty Event, on the message a PoolSubscription
+	// with LiveAfterStored emits between the stored and the live events.
+	EndOfStoredEvents bool
+}
+
+// ID returns the subscription id sent to the relay in "REQ" and "CLOSE".
+func (sub *Subscription) ID() string {
+	return sub.id
+}
+
+// Dropped returns how many events the relay dropped because they weren't read from
+// sub.Events within Relay.DeliveryTimeout.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
 }
 
 // Unsub closes the subscription, sending "CLOSE" to relay as in NIP-01.
-// Unsub() also closes the channel sub.Events.
+// Unsub() also closes the channel sub.Events and forgets the subscription,
+// so the relay stops routing events to it. Calling it again does nothing.
+// It doesn't need sub.Events to be drained first: an event the relay is waiting to deliver
+// is dropped.
 func (sub *Subscription) Unsub() {
+	if sub.unsubscribed != nil {
+		sub.unsubOnce.Do(func() { close(sub.unsubscribed) })
+	}
+
 	sub.mutex.Lock()
 	defer sub.mutex.Unlock()
 
+	if sub.stopped {
+		return
+	}
+	sub.stopped = true
+
 	sub.conn.WriteJSON([]interface{}{"CLOSE", sub.id})
-	if sub.stopped == false && sub.Events != nil {
+	if sub.Events != nil {
 		close(sub.Events)
 	}
-	sub.stopped = true
+	sub.Relay.subscriptions.Delete(sub.id)
 }
 
 // Sub sets sub.Filters and then calls sub.Fire(ctx).
-func (sub *Subscription) Sub(ctx context.Context, filters Filters) {
+func (sub *Subscription) Sub(ctx context.Context, filters Filters) error {
+	// the reader goroutine matches incoming events against sub.Filters while holding the mutex
+	sub.mutex.Lock()
 	sub.Filters = filters
-	sub.Fire(ctx)
+	sub.mutex.Unlock()
+
+	return sub.Fire(ctx)
 }
 
 // Fire sends the "REQ" command to the relay.
 // When ctx is cancelled, sub.Unsub() is called, closing the subscription.
-func (sub *Subscription) Fire(ctx context.Context) {
-	message := []interface{}{"REQ", sub.id}
-	for _, filter := range sub.Filters {
-		message = append(message, filter)
+// If the relay's limits are known (see RelayPool.RelayInfo) and it already has as many
+// subscriptions as its max_subscriptions, nothing is sent, the subscription is closed
+// (with a "CLOSE" if an earlier Fire sent a "REQ"), closing sub.Events, and
+// ErrTooManySubscriptions is returned. The same happens, returning the write error, if the
+// "REQ" can't be written. A "REQ" over its max_message_length is still sent, as the relay
+// may be lenient, but a warning is logged.
+func (sub *Subscription) Fire(ctx context.Context) error {
+	if err := sub.Relay.checkLimitation(sub); err != nil {
+		sub.stop()
+		return err
+	}
+	if err := sub.fire(); err != nil {
+		sub.stop()
+		return fmt.Errorf("failed to send REQ to '%s': %w", sub.Relay.URL, err)
 	}
-
-	sub.conn.WriteJSON(message)
 
 	// the subscription ends once the context is canceled
 	go func() {
 		<-ctx.Done()
 		sub.Unsub()
 	}()
+	return nil
+}
+
+// stop closes the subscription after Fire failed, with Unsub if the relay got a "REQ"
+// before, or with abandon if it never heard of it.
+func (sub *Subscription) stop() {
+	sub.mutex.Lock()
+	fired := sub.fired
+	sub.mutex.Unlock()
+
+	if fired {
+		sub.Unsub()
+	} else {
+		sub.abandon()
+	}
+}
+
+// request returns the "REQ" command for the current sub.Filters.
+// It must be called with sub.mutex held.
+func (sub *Subscription) request() []interface{} {
+	message := []interface{}{"REQ", sub.id}
+	for _, filter := range sub.Filters {
+		message = append(message, filter)
+	}
+	return message
+}
+
+// fire writes the "REQ" for the current sub.Filters, unless the subscription was already closed.
+func (sub *Subscription) fire() error {
+	sub.mutex.Lock()
+	if sub.stopped {
+		sub.mutex.Unlock()
+		return nil
+	}
+	message := sub.request()
+	sub.mutex.Unlock()
+
+	if err := sub.conn.WriteJSON(message); err != nil {
+		return err
+	}
+	sub.mutex.Lock()
+	sub.fired = true
+	sub.mutex.Unlock()
+	return nil
+}
+
+// resume is like fire, but asks only for the events created after the newest one received,
+// minus overlap, by raising the since of every filter in the "REQ" (not in sub.Filters).
+func (sub *Subscription) resume(overlap time.Duration) error {
+	sub.mutex.Lock()
+	if sub.stopped {
+		sub.mutex.Unlock()
+		return nil
+	}
+	message := sub.request()
+	if !sub.newest.IsZero() {
+		since := sub.newest.Add(-overlap)
+		for i, filter := range sub.Filters {
+			if filter.Since == nil || filter.Since.Before(since) {
+				filter.Since = &since
+				message[2+i] = filter
+			}
+		}
+	}
+	sub.mutex.Unlock()
+
+	return sub.conn.WriteJSON(message)
+}
+
+// abandon forgets a subscription that was never sent to the relay, closing sub.Events.
+func (sub *Subscription) abandon() {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+
+	if sub.stopped {
+		return
+	}
+	sub.stopped = true
+	if sub.Events != nil {
+		close(sub.Events)
+	}
+	sub.Relay.subscriptions.Delete(sub.id)
 }
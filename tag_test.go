@@ -46,3 +46,25 @@ func TestTagHelpers(t *testing.T) {
 		t.Error("append unique changed the order")
 	}
 }
+
+func TestTagHelpersShortTags(t *testing.T) {
+	tags := Tags{Tag{}, Tag{"e"}, Tag{"p", "abcdef"}}
+
+	if tags.GetFirst([]string{"e", ""}) != nil {
+		t.Error("got a value-less tag with a value prefix")
+	}
+	if tags.GetFirst([]string{"e"}) == nil {
+		t.Error("failed to get value-less tag")
+	}
+	if len(tags.FilterOut([]string{"e"})) != 2 {
+		t.Error("failed to filter out value-less tag")
+	}
+	for _, tag := range tags {
+		if tag.Relay() != "" || (tag.Key() != "p" && tag.Value() != "") {
+			t.Errorf("unexpected values from short tag %v", tag)
+		}
+	}
+	if len(tags.AppendUnique(Tag{})) != 3 {
+		t.Error("append unique appended an empty tag")
+	}
+}
@@ -20,6 +20,9 @@ type Tag []string
 func (tag Tag) StartsWith(prefix []string) bool {
 	prefixLen := len(prefix)
 
+	if prefixLen == 0 {
+		return true
+	}
 	if prefixLen > len(tag) {
 		return false
 	}
@@ -48,7 +51,7 @@ func (tag Tag) Value() string {
 }
 
 func (tag Tag) Relay() string {
-	if (tag[0] == "e" || tag[0] == "p") && len(tag) > 2 {
+	if len(tag) > 2 && (tag[0] == "e" || tag[0] == "p") {
 		return tag[2]
 	}
 	return ""
@@ -114,6 +117,19 @@ func (tags Tags) AppendUnique(tag Tag) Tags {
 	}
 }
 
+// Clone returns a deep copy of tags, so changes to it or to any of its tags don't
+// affect the original.
+func (tags Tags) Clone() Tags {
+	if tags == nil {
+		return nil
+	}
+	clone := make(Tags, len(tags))
+	for i, tag := range tags {
+		clone[i] = append(Tag(nil), tag...)
+	}
+	return clone
+}
+
 func (t *Tags) Scan(src interface{}) error {
 	var jtags []byte = make([]byte, 0)
 
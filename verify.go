@@ -0,0 +1,108 @@
+package nostr
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// verifyJob is an event (or an "EOSE", if event is nil) of sub, waiting in the queue of
+// the verify workers, see Relay.VerifyWorkers.
+type verifyJob struct {
+	sub   *Subscription
+	event *Event
+	valid bool
+	done  chan struct{} // closed once valid is set
+}
+
+// startVerifiers starts r.VerifyWorkers goroutines checking events, plus one delivering
+// them in the order they arrived, and returns the function the reader hands events to.
+// Jobs go to the delivery queue before the workers, so an "EOSE" only gets out after the
+// stored events that came before it, even if they are delivered unordered.
+func (r *Relay) startVerifiers() func(*verifyJob) {
+	queue := make(chan *verifyJob, r.VerifyWorkers*16)
+	jobs := make(chan *verifyJob, r.VerifyWorkers*4)
+
+	for i := 0; i < r.VerifyWorkers; i++ {
+		r.readers.Add(1)
+		go func() {
+			defer r.readers.Done()
+			for {
+				select {
+				case job := <-jobs:
+					job.valid = r.checkEvent(job.event)
+					if job.valid && r.VerifyUnordered {
+						r.deliverEvent(job.sub, job.event)
+					}
+					close(job.done)
+				case <-r.connectionContext.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	r.readers.Add(1)
+	go func() {
+		defer r.readers.Done()
+		for {
+			select {
+			case job := <-queue:
+				if job.event == nil {
+					r.endOfStoredEvents(job.sub)
+					continue
+				}
+				select {
+				case <-job.done:
+				case <-r.connectionContext.Done():
+					return
+				}
+				if job.valid && !r.VerifyUnordered {
+					r.deliverEvent(job.sub, job.event)
+				}
+			case <-r.connectionContext.Done():
+				return
+			}
+		}
+	}()
+
+	return func(job *verifyJob) {
+		if job.event != nil {
+			job.done = make(chan struct{})
+		}
+		select {
+		case queue <- job:
+		case <-r.connectionContext.Done():
+			return
+		}
+		if job.event != nil {
+			select {
+			case jobs <- job:
+			case <-r.connectionContext.Done():
+			}
+		}
+	}
+}
+
+// checkEvent tells whether the id and signature (unless r.SkipVerify is set) of event are
+// valid, logging why and sending a *VerifyError on r.VerifyErrors if they aren't.
+func (r *Relay) checkEvent(event *Event) bool {
+	var err error
+	if !event.CheckID() {
+		r.logf("bad id: %s", event.ID)
+		err = fmt.Errorf("%w: it is %s", ErrIDMismatch, event.GetID())
+	} else if !r.SkipVerify {
+		if _, err = event.CheckSignature(); err != nil {
+			r.logf("bad signature: %s", err)
+		}
+	}
+	if err != nil {
+		select {
+		case r.VerifyErrors <- &VerifyError{Relay: r.URL, Event: event, Err: err}:
+		default:
+		}
+		return false
+	}
+
+	atomic.AddUint64(&r.eventsReceived, 1)
+	return true
+}